@@ -0,0 +1,269 @@
+package autoscale
+
+import (
+	"fmt"
+	gomath "math"
+	"sort"
+	"time"
+
+	"github.com/weka/go-cloud-lib/lib/math"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// Sample is a single observation of cluster activity and capacity, e.g. taken from
+// weka.StatusResponse.Activity and protocol.WekaStatus.Capacity on every scale function run
+type Sample struct {
+	Time     time.Time
+	Activity weka.Activity
+	Capacity protocol.ClusterCapacity
+	// the activity served by the NFS gateways, e.g. the weka stats of their frontend containers. The cluster Activity
+	// includes the native clients and the other protocols, so it doesn't size the NFS gateways.
+	NfsActivity weka.Activity
+}
+
+// Policy defines the bounds and per-instance throughput figures used to derive recommendations
+type Policy struct {
+	MinBackends    int `json:"min_backends"`
+	MaxBackends    int `json:"max_backends"`
+	MinNfsGateways int `json:"min_nfs_gateways"`
+	MaxNfsGateways int `json:"max_nfs_gateways"`
+
+	// sustainable load of a single backend / NFS gateway, zero disables the corresponding dimension
+	OpsPerBackend        float32       `json:"ops_per_backend"`
+	BytesPerBackend      float32       `json:"bytes_per_backend"`     // read + write bytes per second
+	ObsBytesPerBackend   float32       `json:"obs_bytes_per_backend"` // OBS upload + download bytes per second
+	OpsPerNfsGateway     float32       `json:"ops_per_nfs_gateway"`
+	BytesPerNfsGateway   float32       `json:"bytes_per_nfs_gateway"`
+	TargetUtilization    float32       `json:"target_utilization"`   // fraction of the sustainable load to plan for, e.g. 0.7
+	CapacityUtilization  float32       `json:"capacity_utilization"` // max fraction of total capacity to be provisioned, zero disables the dimension
+	Percentile           float64       `json:"percentile"`           // percentile of the window used as the observed load, e.g. 0.95
+	Horizon              time.Duration `json:"horizon"`
+	MaxScaleUpStep       int           `json:"max_scale_up_step"`      // zero means unlimited
+	MaxScaleDownStep     int           `json:"max_scale_down_step"`    // zero means unlimited
+	ScaleDownUtilization float32       `json:"scale_down_utilization"` // scale down only when the planned load is below this fraction of the current fleet, zero never scales down
+}
+
+func (p *Policy) Validate() error {
+	var errs []error
+	if p.MinBackends <= 0 {
+		errs = append(errs, fmt.Errorf("min_backends should be greater than 0"))
+	}
+	if p.MaxBackends < p.MinBackends {
+		errs = append(errs, fmt.Errorf("max_backends should be greater or equal to min_backends"))
+	}
+	if p.MinNfsGateways < 0 {
+		errs = append(errs, fmt.Errorf("min_nfs_gateways should not be negative"))
+	}
+	if p.MaxNfsGateways < p.MinNfsGateways {
+		errs = append(errs, fmt.Errorf("max_nfs_gateways should be greater or equal to min_nfs_gateways"))
+	}
+	if p.TargetUtilization <= 0 || p.TargetUtilization > 1 {
+		errs = append(errs, fmt.Errorf("target_utilization should be in (0, 1]"))
+	}
+	if p.CapacityUtilization < 0 || p.CapacityUtilization > 1 {
+		errs = append(errs, fmt.Errorf("capacity_utilization should be in [0, 1]"))
+	}
+	if p.Percentile < 0 || p.Percentile > 1 {
+		errs = append(errs, fmt.Errorf("percentile should be in [0, 1]"))
+	}
+	if p.ScaleDownUtilization < 0 || p.ScaleDownUtilization > 1 {
+		errs = append(errs, fmt.Errorf("scale_down_utilization should be in [0, 1]"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+type Recommendation struct {
+	WekaBackendsDesiredCapacity int      `json:"weka_backends_desired_capacity"`
+	NfsBackendsDesiredCapacity  int      `json:"nfs_backends_desired_capacity"`
+	Explanation                 []string `json:"explanation"`
+}
+
+type metric func(s Sample) float64
+
+func ops(s Sample) float64 {
+	return float64(s.Activity.NumOps)
+}
+
+func throughput(s Sample) float64 {
+	return float64(s.Activity.SumBytesRead) + float64(s.Activity.SumBytesWritten)
+}
+
+func nfsOps(s Sample) float64 {
+	return float64(s.NfsActivity.NumOps)
+}
+
+func nfsThroughput(s Sample) float64 {
+	return float64(s.NfsActivity.SumBytesRead) + float64(s.NfsActivity.SumBytesWritten)
+}
+
+func obsThroughput(s Sample) float64 {
+	return float64(s.Activity.ObsUploadBytesPerSecond) + float64(s.Activity.ObsDownloadBytesPerSecond)
+}
+
+func provisionedBytes(s Sample) float64 {
+	return float64(s.Capacity.TotalBytes) - float64(s.Capacity.UnprovisionedBytes)
+}
+
+// percentile returns the p-th percentile of the metric over the samples (nearest rank)
+func percentile(samples []Sample, m metric, p float64) float64 {
+	values := make([]float64, 0, len(samples))
+	for _, s := range samples {
+		values = append(values, m(s))
+	}
+	sort.Float64s(values)
+	rank := int(gomath.Ceil(p*float64(len(values)))) - 1
+	rank = math.Max(0, math.Min(rank, len(values)-1))
+	return values[rank]
+}
+
+// forecast extrapolates the least squares linear trend of the metric to horizon past the last sample
+func forecast(samples []Sample, m metric, horizon time.Duration) float64 {
+	last := samples[len(samples)-1]
+	if len(samples) < 2 || horizon <= 0 {
+		return m(last)
+	}
+	origin := samples[0].Time
+	var n, sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x := s.Time.Sub(origin).Seconds()
+		y := m(s)
+		n++
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return m(last)
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - slope*sumX) / n
+	x := last.Time.Add(horizon).Sub(origin).Seconds()
+	return gomath.Max(0, intercept+slope*x)
+}
+
+// plannedLoad is the load we should be able to serve: the max of the observed percentile and the forecast
+func plannedLoad(samples []Sample, m metric, policy Policy) float64 {
+	return gomath.Max(percentile(samples, m, policy.Percentile), forecast(samples, m, policy.Horizon))
+}
+
+func instancesFor(load float64, perInstance float32, utilization float32) int {
+	return int(gomath.Ceil(load / (float64(perInstance) * float64(utilization))))
+}
+
+type dimension struct {
+	name        string
+	m           metric
+	perInstance float32
+}
+
+func recommendCount(samples []Sample, dimensions []dimension, current, minCount, maxCount int, policy Policy, explanation *[]string, kind string) int {
+	required := minCount
+	reason := "min bound"
+	maxLoadRatio := 0.0
+	enabled := 0
+	for _, d := range dimensions {
+		if d.perInstance <= 0 {
+			continue
+		}
+		enabled++
+		load := plannedLoad(samples, d.m, policy)
+		count := instancesFor(load, d.perInstance, policy.TargetUtilization)
+		*explanation = append(*explanation, fmt.Sprintf("%s: planned %s %.0f requires %d", kind, d.name, load, count))
+		if count > required {
+			required = count
+			reason = d.name
+		}
+		if current > 0 {
+			maxLoadRatio = gomath.Max(maxLoadRatio, load/(float64(d.perInstance)*float64(current)))
+		}
+	}
+
+	if enabled == 0 {
+		required = math.Max(current, minCount)
+		reason = "current size, no load dimensions configured"
+	}
+
+	recommended := required
+	if enabled > 0 && recommended < current {
+		if policy.ScaleDownUtilization == 0 {
+			*explanation = append(*explanation, fmt.Sprintf("%s: keeping %d, scale down is disabled", kind, current))
+			recommended = current
+		} else if maxLoadRatio >= float64(policy.ScaleDownUtilization) {
+			*explanation = append(*explanation, fmt.Sprintf("%s: keeping %d, load is at %.0f%% of current fleet which is above scale down threshold %.0f%%",
+				kind, current, maxLoadRatio*100, policy.ScaleDownUtilization*100))
+			recommended = current
+		}
+	}
+	if policy.MaxScaleUpStep > 0 && recommended > current+policy.MaxScaleUpStep {
+		*explanation = append(*explanation, fmt.Sprintf("%s: scale up limited to %d per step", kind, policy.MaxScaleUpStep))
+		recommended = current + policy.MaxScaleUpStep
+	}
+	if policy.MaxScaleDownStep > 0 && recommended < current-policy.MaxScaleDownStep {
+		*explanation = append(*explanation, fmt.Sprintf("%s: scale down limited to %d per step", kind, policy.MaxScaleDownStep))
+		recommended = current - policy.MaxScaleDownStep
+	}
+	if recommended < minCount {
+		recommended = minCount
+	}
+	if recommended > maxCount {
+		*explanation = append(*explanation, fmt.Sprintf("%s: %d capped by max bound %d", kind, recommended, maxCount))
+		recommended = maxCount
+	}
+	*explanation = append(*explanation, fmt.Sprintf("%s: recommended %d (current %d, driven by %s)", kind, recommended, current, reason))
+	return recommended
+}
+
+// Recommend derives the desired number of weka backends and NFS gateways from a time series of samples.
+// currentBackends and currentNfsGateways are the current desired capacities, they are used for the capacity dimension
+// (drive capacity grows linearly with backends) and to limit the step size.
+func Recommend(samples []Sample, currentBackends, currentNfsGateways int, policy Policy) (recommendation Recommendation, err error) {
+	err = policy.Validate()
+	if err != nil {
+		return
+	}
+	if len(samples) == 0 {
+		err = fmt.Errorf("no samples provided")
+		return
+	}
+
+	sorted := make([]Sample, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	backendDimensions := []dimension{
+		{"ops", ops, policy.OpsPerBackend},
+		{"throughput", throughput, policy.BytesPerBackend},
+		{"obs throughput", obsThroughput, policy.ObsBytesPerBackend},
+	}
+	last := sorted[len(sorted)-1]
+	if policy.CapacityUtilization > 0 && currentBackends > 0 && last.Capacity.TotalBytes > 0 {
+		bytesPerBackend := float64(last.Capacity.TotalBytes) / float64(currentBackends)
+		// capacity is planned for with its own utilization factor, so compensate the target utilization
+		backendDimensions = append(backendDimensions, dimension{
+			name:        "provisioned capacity",
+			m:           provisionedBytes,
+			perInstance: float32(bytesPerBackend * float64(policy.CapacityUtilization) / float64(policy.TargetUtilization)),
+		})
+	}
+
+	nfsDimensions := []dimension{
+		{"nfs ops", nfsOps, policy.OpsPerNfsGateway},
+		{"nfs throughput", nfsThroughput, policy.BytesPerNfsGateway},
+	}
+
+	recommendation.WekaBackendsDesiredCapacity = recommendCount(
+		sorted, backendDimensions, currentBackends, policy.MinBackends, policy.MaxBackends, policy, &recommendation.Explanation, "backends",
+	)
+	recommendation.NfsBackendsDesiredCapacity = recommendCount(
+		sorted, nfsDimensions, currentNfsGateways, policy.MinNfsGateways, policy.MaxNfsGateways, policy, &recommendation.Explanation, "nfs gateways",
+	)
+	return
+}
@@ -0,0 +1,146 @@
+package autoscale
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func getSamples(opsSeries []float32) []Sample {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var samples []Sample
+	for i, ops := range opsSeries {
+		samples = append(samples, Sample{
+			Time:     start.Add(time.Duration(i) * time.Minute),
+			Activity: weka.Activity{NumOps: ops},
+			Capacity: protocol.ClusterCapacity{TotalBytes: 1000, UnprovisionedBytes: 900},
+		})
+	}
+	return samples
+}
+
+func TestRecommend(t *testing.T) {
+	policy := Policy{
+		MinBackends:          6,
+		MaxBackends:          20,
+		MinNfsGateways:       0,
+		MaxNfsGateways:       4,
+		OpsPerBackend:        1000,
+		TargetUtilization:    1,
+		Percentile:           1,
+		ScaleDownUtilization: 0.5,
+	}
+
+	tests := []struct {
+		name            string
+		ops             []float32
+		current         int
+		policy          func(p Policy) Policy
+		expected        int
+		expectedNfsSize int
+	}{
+		{"steady load", []float32{8000, 8000, 8000}, 8, nil, 8, 0},
+		{"peak load", []float32{2000, 12000, 3000}, 8, nil, 12, 0},
+		{"max bound", []float32{50000}, 8, nil, 20, 0},
+		{"min bound", []float32{10}, 6, nil, 6, 0},
+		{"above scale down threshold", []float32{5000}, 8, nil, 8, 0},
+		{"below scale down threshold", []float32{3000}, 10, nil, 6, 0},
+		{"scale down disabled", []float32{0}, 10, func(p Policy) Policy {
+			p.ScaleDownUtilization = 0
+			return p
+		}, 10, 0},
+		{"trend", []float32{1000, 2000, 3000, 4000}, 6, func(p Policy) Policy {
+			p.Horizon = 2 * time.Minute
+			return p
+		}, 6, 0},
+		{"growing trend", []float32{4000, 5000, 6000, 7000}, 7, func(p Policy) Policy {
+			p.Horizon = 3 * time.Minute
+			return p
+		}, 10, 0},
+		{"scale up step", []float32{20000}, 8, func(p Policy) Policy {
+			p.MaxScaleUpStep = 2
+			return p
+		}, 10, 0},
+		// without NFS activity, the cluster activity doesn't need NFS gateways
+		{"no nfs activity", []float32{6000}, 6, func(p Policy) Policy {
+			p.OpsPerNfsGateway = 2000
+			return p
+		}, 6, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := policy
+			if tt.policy != nil {
+				p = tt.policy(p)
+			}
+			recommendation, err := Recommend(getSamples(tt.ops), tt.current, 0, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recommendation.WekaBackendsDesiredCapacity != tt.expected {
+				t.Errorf("backends = %d; want %d (%v)", recommendation.WekaBackendsDesiredCapacity, tt.expected, recommendation.Explanation)
+			}
+			if recommendation.NfsBackendsDesiredCapacity != tt.expectedNfsSize {
+				t.Errorf("nfs gateways = %d; want %d (%v)", recommendation.NfsBackendsDesiredCapacity, tt.expectedNfsSize, recommendation.Explanation)
+			}
+		})
+	}
+}
+
+func TestRecommendNfs(t *testing.T) {
+	policy := Policy{
+		MinBackends:        6,
+		MaxBackends:        20,
+		MinNfsGateways:     1,
+		MaxNfsGateways:     8,
+		OpsPerBackend:      1000,
+		OpsPerNfsGateway:   2000,
+		BytesPerNfsGateway: 1e9,
+		TargetUtilization:  1,
+		Percentile:         1,
+	}
+
+	tests := []struct {
+		name     string
+		nfs      weka.Activity
+		expected int
+	}{
+		{"no nfs activity", weka.Activity{}, 1},
+		// the cluster ops are of native clients too, the NFS gateways are sized by the NFS ops only
+		{"nfs ops", weka.Activity{NumOps: 6000}, 3},
+		{"nfs throughput", weka.Activity{NumOps: 1000, SumBytesRead: 3e9, SumBytesWritten: 1e9}, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := getSamples([]float32{12000, 12000})
+			for i := range samples {
+				samples[i].NfsActivity = tt.nfs
+			}
+			recommendation, err := Recommend(samples, 12, 1, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recommendation.WekaBackendsDesiredCapacity != 12 {
+				t.Errorf("backends = %d; want 12 (%v)", recommendation.WekaBackendsDesiredCapacity, recommendation.Explanation)
+			}
+			if recommendation.NfsBackendsDesiredCapacity != tt.expected {
+				t.Errorf("nfs gateways = %d; want %d (%v)", recommendation.NfsBackendsDesiredCapacity, tt.expected, recommendation.Explanation)
+			}
+		})
+	}
+}
+
+func TestRecommendValidation(t *testing.T) {
+	_, err := Recommend(getSamples([]float32{1}), 1, 0, Policy{})
+	if err == nil {
+		t.Error("expected validation error")
+	}
+	_, err = Recommend(nil, 1, 0, Policy{MinBackends: 1, MaxBackends: 1, TargetUtilization: 1})
+	if err == nil {
+		t.Error("expected error on empty samples")
+	}
+}
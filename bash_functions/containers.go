@@ -0,0 +1,77 @@
+package bash_functions
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
+)
+
+// WekaContainersSetup sets up the containers of the layout in order, each on its own cores and, with DPDK,
+// on as many NICs as cores, starting after the management NIC and up to nicsNum if set. When nicsNum is set, the last
+// frontend container takes all the remaining NICs. setupArgs are added to every setup command. Depends on get_core_ids, getNetStrForDpdk (after getAllInterfaces) and INSTALL_DPDK.
+// The containers of a converged layout don't dedicate the instance, and its frontends serve local mounts only.
+func WekaContainersSetup(layout protocol.ContainerLayout, setupArgs, nicsNum string) string {
+	maxNic, err := strconv.Atoi(nicsNum)
+	if err != nil {
+		maxNic = math.MaxInt
+	}
+
+	lastFrontend := -1
+	for i, container := range layout.Containers {
+		if container.Role == protocol.FrontendContainer {
+			lastFrontend = i
+		}
+	}
+
+	var sb strings.Builder
+	nic := 1
+	for i, container := range layout.Containers {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		args := []string{
+			"--name", container.Name,
+			"--base-port", fmt.Sprint(container.BasePort),
+			"--cores", fmt.Sprint(container.Cores),
+		}
+		switch container.Role {
+		case protocol.DriveContainer:
+			args = append(args, "--no-frontends", "--drives-dedicated-cores", fmt.Sprint(container.Cores))
+		case protocol.ComputeContainer:
+			args = append(args, "--no-frontends", "--compute-dedicated-cores", fmt.Sprint(container.Cores))
+			if container.Memory != "" {
+				args = append(args, "--memory", script.Quote(container.Memory))
+			}
+		case protocol.FrontendContainer:
+			args = append(args, "--frontend-dedicated-cores", fmt.Sprint(container.Cores))
+			if !layout.Converged {
+				args = append(args, "--allow-protocols", "true")
+			}
+		}
+		if setupArgs != "" {
+			args = append(args, setupArgs)
+		}
+		args = append(args, "--core-ids", "$container_core_ids")
+		if !layout.Converged {
+			args = append(args, "--dedicate")
+		}
+		args = append(args, "$net")
+
+		sb.WriteString(fmt.Sprintf("# %s container\n", container.Name))
+		sb.WriteString(fmt.Sprintf("get_core_ids %d container_core_ids\n", container.Cores))
+		sb.WriteString("if [[ $INSTALL_DPDK == true ]]; then\n")
+		lastNic := min(nic+container.Cores, maxNic)
+		if i == lastFrontend && maxNic != math.MaxInt {
+			lastNic = maxNic
+		}
+		sb.WriteString(fmt.Sprintf("\tgetNetStrForDpdk %d %d\n", nic, lastNic))
+		sb.WriteString("else\n\tnet=\"--net udp\"\nfi\n")
+		sb.WriteString(fmt.Sprintf("sudo weka local setup container %s\n", strings.Join(args, " ")))
+		nic += container.Cores
+	}
+	return sb.String()
+}
@@ -134,7 +134,7 @@ func GetWekaPartitionScript() string {
 	# requires 'report' function to be and PROTOCOL var (if needed)
 	handle_error() {
 	if [ "$1" -ne 0 ]; then
-		report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"error\", \"message\": \"${2}\"}"
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "${2}")"
 		exit 1
 	fi
 	}
@@ -165,7 +165,7 @@ func WekaRestFunction() string {
 		data="$2"
 		set +x
 		tmpfile=$(mktemp)
-		http_code=$(curl -sS -X POST --insecure -w "%{http_code}" -o "$tmpfile" "https://$backend_ip:14000/api/v2/login" -H "Content-Type: application/json" -d "{\"username\":\"$WEKA_USERNAME\",\"password\":\"$WEKA_PASSWORD\"}")
+		http_code=$(curl -sS -X POST --insecure -w "%{http_code}" -o "$tmpfile" "https://$backend_ip:14000/api/v2/login" -H "Content-Type: application/json" -d "$(json_object username "$WEKA_USERNAME" password "$WEKA_PASSWORD")")
 		response=$(cat "$tmpfile")
 		rm -f "$tmpfile"
 		if [ "$http_code" -lt 200 ] || [ "$http_code" -ge 300 ]; then
@@ -251,3 +251,69 @@ func PrefixToNetmask() string {
 
 	return dedent.Dedent(s)
 }
+
+func JsonObjectFunction() string {
+	s := `
+	function json_escape() {
+		local s="$1"
+		s="${s//\\/\\\\}"
+		s="${s//\"/\\\"}"
+		s="${s//$'\n'/\\n}"
+		s="${s//$'\r'/\\r}"
+		s="${s//$'\t'/\\t}"
+		printf '%s' "$s" | tr -d '\000-\010\013\014\016-\037'
+	}
+
+	function json_object() {
+		# Prints a json object of string values from key value pairs, escaping both
+		# Example: json_object hostname "$HOSTNAME" type progress -> {"hostname": "...", "type": "progress"}
+		local object="" separator=""
+		while [ $# -gt 1 ]; do
+			object+="$separator\"$(json_escape "$1")\": \"$(json_escape "$2")\""
+			separator=", "
+			shift 2
+		done
+		printf '{%s}' "$object"
+	}
+	`
+
+	return dedent.Dedent(s)
+}
+
+// DpdkDrivers are the NIC drivers weka DPDK networking supports in the clouds
+var DpdkDrivers = []string{"ena", "gve", "mlx5_core", "mlx4_core", "mana", "hv_netvsc", "ixgbevf", "iavf", "virtio_net", "vfio-pci"}
+
+func ReportInventoryFunction() string {
+	s := `
+	function report_inventory() {
+		# Reports the preflight inventory of the VM, validated across the VMs before clusterization
+		# requires report, getAllInterfaces, the devices array of find_drives.py, DPDK_DRIVERS and PROTOCOL
+		getAllInterfaces
+		local nics="[]" nic mtu driver dpdk_capable
+		for nic in "${all_interfaces[@]}"; do
+			mtu=$(cat "/sys/class/net/$nic/mtu")
+			driver=$(basename "$(readlink -f "/sys/class/net/$nic/device/driver")")
+			dpdk_capable=false
+			if [[ " ${DPDK_DRIVERS[*]} " == *" $driver "* ]]; then
+				dpdk_capable=true
+			fi
+			nics=$(echo "$nics" | jq -c --arg name "$nic" --argjson mtu "$mtu" --arg driver "$driver" --argjson dpdk_capable "$dpdk_capable" \
+				'. + [{name: $name, mtu: $mtu, driver: $driver, dpdk_capable: $dpdk_capable}]')
+		done
+
+		local inventory
+		inventory=$(jq -nc \
+			--arg weka_version "$(weka version current)" \
+			--argjson cores "$(nproc --all)" \
+			--argjson memory_bytes "$(( $(awk '/^MemTotal:/ {print $2}' /proc/meminfo) * 1024 ))" \
+			--arg drives "${devices[*]}" \
+			--argjson nics "$nics" \
+			--argjson clock_unix_ms "$(date +%s%3N)" \
+			'{weka_version: $weka_version, cores: $cores, memory_bytes: $memory_bytes, drives: ($drives | split(" ") | map(select(. != ""))), nics: $nics, clock_unix_ms: $clock_unix_ms}')
+		report "$(jq -nc --arg hostname "$HOSTNAME" --arg protocol "$PROTOCOL" --argjson inventory "$inventory" \
+			'{hostname: $hostname, protocol: $protocol, type: "inventory", message: "Preflight inventory", inventory: $inventory}')"
+	}
+	`
+
+	return dedent.Dedent(s)
+}
@@ -1,6 +1,7 @@
 package bash_functions
 
 import (
+	"encoding/json"
 	"os/exec"
 	"strings"
 	"testing"
@@ -41,3 +42,34 @@ func TestPrefixToNetmask(t *testing.T) {
 		})
 	}
 }
+
+func TestJsonObject(t *testing.T) {
+	tests := []string{
+		"simple",
+		"",
+		`with "quotes" and \\ backslash`,
+		"$(reboot) `reboot` ${HOME}",
+		"multi\nline\twith\rcontrol\x01chars",
+	}
+
+	bashScript := JsonObjectFunction()
+
+	for _, value := range tests {
+		t.Run(value, func(t *testing.T) {
+			cmd := exec.Command("bash", "-c", bashScript+"\njson_object message \"$1\" type progress", "bash", value)
+			output, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("Failed to execute bash function: %v", err)
+			}
+
+			var result map[string]string
+			if err := json.Unmarshal(output, &result); err != nil {
+				t.Fatalf("json_object output %s is not valid json: %v", output, err)
+			}
+			expected := strings.ReplaceAll(value, "\x01", "")
+			if result["message"] != expected || result["type"] != "progress" {
+				t.Errorf("json_object(%q) = %v; want message %q", value, result, expected)
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package clusterize
 
 import (
 	"fmt"
-	"strings"
 
+	"github.com/weka/go-cloud-lib/bash_functions"
+	"github.com/weka/go-cloud-lib/common"
 	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
 
 	"github.com/lithammer/dedent"
 )
@@ -37,6 +40,11 @@ type ClusterParams struct {
 	PostClusterCreationScript string
 	SetDefaultFs              bool
 	PostClusterSetupScript    string
+	ContainerLayout           *protocol.ContainerLayout // names and ports of the containers, defaults to drives0, compute0 and frontend0 if AddFrontend
+	Converged                 bool                      // the backends are shared with application workloads, see protocol.ConvergedContainerLayout
+	FilesystemGroups          []FilesystemGroup         // in addition to the default group, which may be listed to override its tiering settings
+	Filesystems               []Filesystem              // created in order, before the default filesystem
+	Kms                       *KmsParams                // the default filesystem and Filesystems are encrypted with it
 }
 
 type ClusterizeScriptGenerator struct {
@@ -45,79 +53,151 @@ type ClusterizeScriptGenerator struct {
 }
 
 func (c *ClusterizeScriptGenerator) GetClusterizeScript() string {
-	reportFuncDef := c.FuncDef.GetFunctionCmdDefinition(functions_def.Report)
-	clusterizeFinFuncDef := c.FuncDef.GetFunctionCmdDefinition(functions_def.ClusterizeFinalization)
-	fetchFuncDef := c.FuncDef.GetFunctionCmdDefinition(functions_def.Fetch)
+	clusterizeScript, err := c.clusterizeScript().Build()
+	if err != nil {
+		return common.GetErrorScript(err, c.FuncDef.GetFunctionCmdDefinition(functions_def.Report), "")
+	}
+	return clusterizeScript
+}
+
+// Validate renders the clusterize script and checks it statically, see script.Validate
+func (c *ClusterizeScriptGenerator) Validate() error {
+	clusterizeScript, err := c.clusterizeScript().Build()
+	if err != nil {
+		return err
+	}
+	return script.Validate(clusterizeScript)
+}
+
+func (c *ClusterizeScriptGenerator) containerLayout() protocol.ContainerLayout {
+	if c.Params.ContainerLayout != nil {
+		layout := *c.Params.ContainerLayout
+		layout.Converged = layout.Converged || c.Params.Converged
+		return layout
+	}
+	if c.Params.Converged {
+		return protocol.ConvergedContainerLayout(1, 1, "")
+	}
+	frontend := 0
+	if c.Params.AddFrontend {
+		frontend = 1
+	}
+	return protocol.DefaultContainerLayout(1, 1, frontend, "")
+}
+
+func (c *ClusterizeScriptGenerator) clusterizeScript() *script.Builder {
 	params := c.Params
 
-	clusterizeScriptTemplate := `
-	#!/bin/bash
-	set -ex
-	VMS=(%s)
-	IPS=(%s)
-	CLUSTER_NAME=%s
-	HOSTS_NUM=%d
-	SET_OBS=%t
-	STRIPE_WIDTH=%d
-	PROTECTION_LEVEL=%d
-	HOTSPARE=%d
-	INSTALL_DPDK=%t
-	ADD_FRONTEND=%t
-	PROXY_URL="%s"
-	WEKA_HOME_URL="%s"
-	TARGET_SSD_RETENTION=%d
-	START_DEMOTE=%d
-	SET_DEFAULT_FS=%t
+	layout := c.containerLayout()
+	if err := layout.Validate(); err != nil {
+		return script.New().Fail(fmt.Errorf("container layout: %w", err))
+	}
+	if err := c.validateFilesystems(); err != nil {
+		return script.New().Fail(fmt.Errorf("filesystems: %w", err))
+	}
+	if params.Kms != nil {
+		if err := params.Kms.Validate(); err != nil {
+			return script.New().Fail(fmt.Errorf("kms: %w", err))
+		}
+	}
+	defaultFsOptions := ""
+	if params.Kms != nil {
+		defaultFsOptions = "--encrypted"
+	}
+	var driveContainers []string
+	for _, container := range layout.ByRole(protocol.DriveContainer) {
+		driveContainers = append(driveContainers, container.Name)
+	}
+
+	var groupNames []string
+	var groupRetentions, groupDemotes []int
+	for _, group := range c.filesystemGroups() {
+		groupNames = append(groupNames, group.Name)
+		groupRetentions = append(groupRetentions, group.TargetSSDRetention)
+		groupDemotes = append(groupDemotes, group.StartDemote)
+	}
+	var fsNames, fsGroups, fsCapacities, fsOptions, fsTiered, fsThin []string
+	for _, fs := range params.Filesystems {
+		fs.Encrypted = fs.Encrypted || params.Kms != nil
+		fsNames = append(fsNames, fs.Name)
+		fsGroups = append(fsGroups, fs.group())
+		fsCapacities = append(fsCapacities, fs.Capacity)
+		fsOptions = append(fsOptions, fs.options())
+		fsTiered = append(fsTiered, fmt.Sprint(fs.Tiered))
+		fsThin = append(fsThin, fmt.Sprint(fs.ThinProvisioned))
+	}
 
+	s := script.New().Shebang().Raw("set -ex\n").
+		Var("VMS", params.VMNames).
+		Var("IPS", params.IPs).
+		Var("CLUSTER_NAME", params.ClusterName).
+		Var("HOSTS_NUM", params.ClusterizationTarget).
+		Var("SET_OBS", params.SetObs).
+		Var("STRIPE_WIDTH", params.DataProtection.StripeWidth).
+		Var("PROTECTION_LEVEL", params.DataProtection.ProtectionLevel).
+		Var("HOTSPARE", params.DataProtection.Hotspare).
+		Var("INSTALL_DPDK", params.InstallDpdk).
+		Var("CONTAINER_NAMES", layout.Names()).
+		Var("PORTS", layout.Ports()).
+		Var("DRIVE_CONTAINERS", driveContainers).
+		Var("COMPUTE_CONTAINER", layout.ByRole(protocol.ComputeContainer)[0].Name).
+		Var("PROXY_URL", params.ProxyUrl).
+		Var("WEKA_HOME_URL", params.WekaHomeUrl).
+		Var("FS_GROUP_NAMES", groupNames).
+		Var("FS_GROUP_TARGET_SSD_RETENTIONS", groupRetentions).
+		Var("FS_GROUP_START_DEMOTES", groupDemotes).
+		Var("FS_NAMES", fsNames).
+		Var("FS_GROUPS", fsGroups).
+		Var("FS_CAPACITIES", fsCapacities).
+		Var("FS_OPTIONS", fsOptions).
+		Var("FS_TIERED", fsTiered).
+		Var("FS_THIN_PROVISIONED", fsThin).
+		Var("SET_DEFAULT_FS", params.SetDefaultFs).
+		Var("DEFAULT_FS_OPTIONS", defaultFsOptions).
+		Var("OBS_TIERING_SSD_PERCENT", params.TieringSSDPercent).
+		Var("post_cluster_setup_script", params.PostClusterSetupScript)
+
+	findDrivesTemplate := `
 	mkdir -p /opt/weka/tmp
 	cat >/opt/weka/tmp/find_drives.py <<EOL%sEOL
+	`
+	s.Section("", fmt.Sprintf(dedent.Dedent(findDrivesTemplate), params.FindDrivesScript))
 
-	# fetch function definition
-	%s
+	s.CloudFunctions(c.FuncDef, functions_def.Fetch, functions_def.Report, functions_def.ClusterizeFinalization)
+	s.Function("json_object", bash_functions.JsonObjectFunction())
 
+	s.Section("fetch weka credentials and drives", `
 	set +x
 	fetch_result=$(fetch "{\"fetch_weka_credentials\": true, \"show_admin_password\": true}")
 	if [ -z "$fetch_result" ] || [ "$fetch_result" == "null" ]; then
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed fetching weka credentials\"}"
+		report "$(json_object hostname "$HOSTNAME" type "error" message "Failed fetching weka credentials")"
 		exit 1
 	fi
 	export WEKA_DEPLOYMENT_USERNAME="$(echo $fetch_result | jq -r .username)"
 	if [ -z "$WEKA_DEPLOYMENT_USERNAME" ] || [ "$WEKA_DEPLOYMENT_USERNAME" == "null" ]; then
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed fetching deployment username\"}"
+		report "$(json_object hostname "$HOSTNAME" type "error" message "Failed fetching deployment username")"
 		exit 1
 	fi
 	export WEKA_DEPLOYMENT_PASSWORD="$(echo $fetch_result | jq -r .password)"
 	if [ -z "$WEKA_DEPLOYMENT_PASSWORD" ] || [ "$WEKA_DEPLOYMENT_PASSWORD" == "null" ]; then
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed fetching deployment password\"}"
+		report "$(json_object hostname "$HOSTNAME" type "error" message "Failed fetching deployment password")"
 		exit 1
 	fi
 	export WEKA_ADMIN_PASSWORD="$(echo $fetch_result | jq -r .admin_password)"
 	if [ -z "$WEKA_ADMIN_PASSWORD" ] || [ "$WEKA_ADMIN_PASSWORD" == "null" ]; then
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed fetching admin password\"}"
+		report "$(json_object hostname "$HOSTNAME" type "error" message "Failed fetching admin password")"
 		exit 1
 	fi
 	export WEKA_RUN_CREDS="-e WEKA_USERNAME=admin -e WEKA_PASSWORD=$WEKA_ADMIN_PASSWORD"
-	devices=$(weka local run --container compute0 $WEKA_RUN_CREDS bash -ce 'wapi machine-query-info --info-types=DISKS -J | python3 /opt/weka/tmp/find_drives.py')
+	devices=$(weka local run --container $COMPUTE_CONTAINER $WEKA_RUN_CREDS bash -ce 'wapi machine-query-info --info-types=DISKS -J | python3 /opt/weka/tmp/find_drives.py')
 	set -x
 	devices=($devices)
+	`).Requires("fetch", "report", "json_object", "COMPUTE_CONTAINER").
+		Provides("WEKA_DEPLOYMENT_USERNAME", "WEKA_DEPLOYMENT_PASSWORD", "WEKA_ADMIN_PASSWORD", "devices")
 
-	CONTAINER_NAMES=(drives0 compute0)
-	PORTS=(14000 15000)
-
-	# report function definition
-	%s
-
-	# clusterize_finalization function definition
-	%s
-
+	s.Section("", `
 	last_vm_name=${VMS[${#VMS[@]} - 1]}
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"This ($last_vm_name) is instance $HOSTS_NUM that is ready for clusterization\"}"
-
-	if [[ $ADD_FRONTEND == true ]]; then
-		CONTAINER_NAMES+=(frontend0)
-		PORTS+=(16000)
-	fi
-
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "This ($last_vm_name) is instance $HOSTS_NUM that is ready for clusterization")"
 
 	HOST_IPS=()
 	HOST_NAMES=()
@@ -130,45 +210,64 @@ func (c *ClusterizeScriptGenerator) GetClusterizeScript() string {
 	host_ips=$(IFS=, ;echo "${HOST_IPS[*]}")
 	host_names=$(IFS=' ' ;echo "${HOST_NAMES[*]}")
 
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Running Clusterization\"}"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Running Clusterization")"
 
-	vms_string=$(printf "%%s "  "${VMS[@]}" | rev | cut -c2- | rev)
+	vms_string=$(printf "%s "  "${VMS[@]}" | rev | cut -c2- | rev)
+	`).Requires("report", "json_object", "VMS", "IPS", "HOSTS_NUM", "CONTAINER_NAMES", "PORTS").
+		Provides("host_ips", "host_names")
 
+	s.Section("", `
 	set +x
-	weka cluster create $host_names --host-ips $host_ips --admin-password "$WEKA_ADMIN_PASSWORD" || (report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed creating cluster\"}" && exit 1)
+	weka cluster create $host_names --host-ips $host_ips --admin-password "$WEKA_ADMIN_PASSWORD" || (report "$(json_object hostname "$HOSTNAME" type "error" message "Failed creating cluster")" && exit 1)
 	weka user login admin $WEKA_ADMIN_PASSWORD
 
 	# setup weka deployment user (internal, only used by cloud functions)
 	# weka user add <username> <role> [password]
-	weka user add $WEKA_DEPLOYMENT_USERNAME clusteradmin "$WEKA_DEPLOYMENT_PASSWORD" || report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed creating deployment user\"}"
+	weka user add $WEKA_DEPLOYMENT_USERNAME clusteradmin "$WEKA_DEPLOYMENT_PASSWORD" || report "$(json_object hostname "$HOSTNAME" type "error" message "Failed creating deployment user")"
 	weka user
 	set -x
 	
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Deployment user was created successfully\"}"
-	# post cluster creation script
-	function post_cluster_creation() {
-		echo "running post cluster creation script"
-		%s
-	}
-	post_cluster_creation || report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed running post cluster create script\"}"
-	
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Deployment user was created successfully")"
+	`).Requires("report", "json_object", "host_ips", "host_names", "WEKA_ADMIN_PASSWORD", "WEKA_DEPLOYMENT_USERNAME", "WEKA_DEPLOYMENT_PASSWORD")
+
+	s.Function("post_cluster_creation", userScriptFunction("post_cluster_creation", "running post cluster creation script", params.PostClusterCreationScript))
+	s.Section("", `
+	post_cluster_creation || report "$(json_object hostname "$HOSTNAME" type "error" message "Failed running post cluster create script")"
+	`).Requires("post_cluster_creation", "report", "json_object")
+
+	s.Section("", `
 	sleep 30s
 
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Adding drives\"}"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Adding drives")"
 
-	DRIVE_NUMS=( $(weka cluster container | grep drives | awk '{print $1;}') )
-	devices_str=$(IFS=' ' ;echo "${devices[*]}")
+	drive_containers_regex=$(IFS='|' ;echo "${DRIVE_CONTAINERS[*]}")
+	DRIVE_NUMS=( $(weka cluster container | grep -wE "($drive_containers_regex)" | awk '{print $1;}') )
 
+	# the devices of a host are split between its drive containers
 	function add_drives() {
 		bad_drives=false
 		drive_num=$1
 		drive_container_info=$(weka cluster container $drive_num -J)
 		drive_container_hostname=$(echo $drive_container_info | jq -r '.[0].hostname')
+		drive_container_name=$(echo $drive_container_info | jq -r '.[0].container_name')
+		drive_container_index=0
+		for k in "${!DRIVE_CONTAINERS[@]}"; do
+			if [ "${DRIVE_CONTAINERS[k]}" == "$drive_container_name" ]; then
+				drive_container_index=$k
+			fi
+		done
+		container_devices=()
+		for k in "${!devices[@]}"; do
+			if [ $((k % ${#DRIVE_CONTAINERS[@]})) -eq $drive_container_index ]; then
+				container_devices+=("${devices[k]}")
+			fi
+		done
+		devices_str=$(IFS=' ' ;echo "${container_devices[*]}")
 		if ! output=$(weka cluster drive add $drive_num $devices_str 2>&1); then
 			output="${output//$'\n'/ }"
-			report "{\"hostname\": \"$drive_container_hostname\", \"type\": \"error\", \"message\": \"Failed adding drives for drive container $drive_num: $devices_str Error: $output\"}"
+			report "$(json_object hostname "$drive_container_hostname" type "error" message "Failed adding drives for drive container $drive_num: $devices_str Error: $output")"
 		else
-			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Drives added successfully for $drive_container_hostname\"}"
+			report "$(json_object hostname "$HOSTNAME" type "progress" message "Drives added successfully for $drive_container_hostname")"
 		fi
 	}
 
@@ -177,7 +276,9 @@ func (c *ClusterizeScriptGenerator) GetClusterizeScript() string {
 		sleep 0.1 # give some time between drives additions to allow first drives additions to complete
 	done
 	wait
+	`).Requires("report", "json_object", "devices", "DRIVE_CONTAINERS")
 
+	s.Section("", `
 	weka cluster update --cluster-name="$CLUSTER_NAME"
 
 	if [ -n "$PROXY_URL" ]; then
@@ -197,34 +298,23 @@ func (c *ClusterizeScriptGenerator) GetClusterizeScript() string {
 	# weka cluster create defaults to 5, which is only correct for PROTECTION_LEVEL=2
 	RAFT_SIZE=$((2 * PROTECTION_LEVEL + 1))
 	if [ "$RAFT_SIZE" -gt 5 ]; then
-		weka cluster update --bucket-raft-size "$RAFT_SIZE" || (report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed updating raft size to $RAFT_SIZE\"}" && exit 1)
+		weka cluster update --bucket-raft-size "$RAFT_SIZE" || (report "$(json_object hostname "$HOSTNAME" type "error" message "Failed updating raft size to $RAFT_SIZE")" && exit 1)
 	fi
 
 	weka cluster hot-spare $HOTSPARE
+	`).Requires("report", "json_object", "CLUSTER_NAME", "PROXY_URL", "WEKA_HOME_URL", "STRIPE_WIDTH", "PROTECTION_LEVEL", "HOTSPARE")
 
-	# pre start-io script
-	function pre_start_io() {
-		echo "running pre start-io script"
-		%s
+	if params.Kms != nil {
+		addKmsSetup(s, *params.Kms)
 	}
-	pre_start_io || report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed running pre start-io script\"}"
 
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Running start-io\"}"
-	weka cluster start-io
-	
-	sleep 15s
-	
-	weka cluster process
-	weka cluster drive
-	weka cluster container
-	
-	weka fs group create default --target-ssd-retention=$TARGET_SSD_RETENTION --start-demote=$START_DEMOTE || report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed to create fs group\"}"
-	weka fs create .config_fs default 22GB
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"FS '.config_fs' was created successfully\"}"
-	weka nfs global-config set --config-fs .config_fs || echo "Failed to set NFS global config fs"
-	weka dataservice global-config set --config-fs .config_fs || true
+	s.Function("pre_start_io", userScriptFunction("pre_start_io", "running pre start-io script", params.PreStartIoScript))
+	s.Section("", `
+	pre_start_io || report "$(json_object hostname "$HOSTNAME" type "error" message "Failed running pre start-io script")"
+	`).Requires("pre_start_io", "report", "json_object")
 
-	if [[ $SET_DEFAULT_FS == true ]]; then
+	s.Function("get_unprovisioned_bytes", `
+	function get_unprovisioned_bytes() {
 		unprovisioned_bytes=""
 		elapsed=0
 		max_wait=600
@@ -236,19 +326,62 @@ func (c *ClusterizeScriptGenerator) GetClusterizeScript() string {
 				break
 			fi
 
-			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Failed to fetch capacity from weka, retrying in ${sleep_duration}s (elapsed: ${elapsed}s). Error: $unprovisioned_bytes\"}"
+			report "$(json_object hostname "$HOSTNAME" type "progress" message "Failed to fetch capacity from weka, retrying in ${sleep_duration}s (elapsed: ${elapsed}s). Error: $unprovisioned_bytes")"
 			sleep $sleep_duration
 			elapsed=$((elapsed + sleep_duration))
 			sleep_duration=$((sleep_duration * 2 > 120 ? 120 : sleep_duration * 2))
 		done
 
 		if [ -z "$unprovisioned_bytes" ] || [ "$unprovisioned_bytes" == "null" ]; then
-			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed to fetch capacity after 10 minutes\"}"
+			report "$(json_object hostname "$HOSTNAME" type "error" message "Failed to fetch capacity after 10 minutes")"
 			exit 1
 		fi
+	}
+	`).Requires("report", "json_object")
 
-		weka fs create default default "$unprovisioned_bytes"B
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Default FS was created successfully\"}"
+	s.Section("", `
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Running start-io")"
+	weka cluster start-io
+	
+	sleep 15s
+	
+	weka cluster process
+	weka cluster drive
+	weka cluster container
+	
+	for i in "${!FS_GROUP_NAMES[@]}"; do
+		weka fs group create "${FS_GROUP_NAMES[i]}" --target-ssd-retention=${FS_GROUP_TARGET_SSD_RETENTIONS[i]} --start-demote=${FS_GROUP_START_DEMOTES[i]} || report "$(json_object hostname "$HOSTNAME" type "error" message "Failed to create fs group ${FS_GROUP_NAMES[i]}")"
+	done
+	weka fs create .config_fs default 22GB
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "FS '.config_fs' was created successfully")"
+	weka nfs global-config set --config-fs .config_fs || echo "Failed to set NFS global config fs"
+	weka dataservice global-config set --config-fs .config_fs || true
+
+	if [ ${#FS_NAMES[@]} -gt 0 ]; then
+		# percent capacities are of the capacity unprovisioned before creating any of the filesystems
+		get_unprovisioned_bytes
+		total_unprovisioned_bytes=$unprovisioned_bytes
+		for i in "${!FS_NAMES[@]}"; do
+			capacity=${FS_CAPACITIES[i]}
+			if [[ $capacity == *% ]]; then
+				capacity="$((total_unprovisioned_bytes * ${capacity%\%} / 100))B"
+			fi
+			fs_options=(${FS_OPTIONS[i]})
+			if [[ ${FS_THIN_PROVISIONED[i]} == true ]]; then
+				fs_options+=(--thin-provision-min-ssd 0B --thin-provision-max-ssd "$capacity")
+			fi
+			if ! output=$(weka fs create "${FS_NAMES[i]}" "${FS_GROUPS[i]}" "$capacity" "${fs_options[@]}" 2>&1); then
+				report "$(json_object hostname "$HOSTNAME" type "error" message "Failed to create FS '${FS_NAMES[i]}': $output")"
+				exit 1
+			fi
+			report "$(json_object hostname "$HOSTNAME" type "progress" message "FS '${FS_NAMES[i]}' was created successfully ($((i + 1))/${#FS_NAMES[@]})")"
+		done
+	fi
+
+	if [[ $SET_DEFAULT_FS == true ]]; then
+		get_unprovisioned_bytes
+		weka fs create default default "$unprovisioned_bytes"B $DEFAULT_FS_OPTIONS
+		report "$(json_object hostname "$HOSTNAME" type "progress" message "Default FS was created successfully")"
 	fi
 
 	if [[ $INSTALL_DPDK == true ]]; then
@@ -259,64 +392,54 @@ func (c *ClusterizeScriptGenerator) GetClusterizeScript() string {
 	fi
 
 	echo "completed successfully" > /tmp/weka_clusterization_completion_validation
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Clusterization completed successfully\"}"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Clusterization completed successfully")"
 
 	clusterize_finalization "{}"
+	`).Requires("report", "json_object", "clusterize_finalization", "get_unprovisioned_bytes", "FS_GROUP_NAMES", "FS_GROUP_TARGET_SSD_RETENTIONS",
+		"FS_GROUP_START_DEMOTES", "FS_NAMES", "FS_GROUPS", "FS_CAPACITIES", "FS_OPTIONS", "FS_THIN_PROVISIONED", "SET_DEFAULT_FS", "DEFAULT_FS_OPTIONS", "INSTALL_DPDK").
+		Provides("unprovisioned_bytes")
 
+	s.Function("set_obs", userScriptFunction("set_obs", "running set obs script", params.ObsScript))
+	s.Section("", `
 	if [[ $SET_OBS == true ]]; then
-		function set_obs() {
-			# 'set obs' script
-			%s
-		}
-		set_obs || (report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"OBS setup failed\"}" && exit 1)
-		OBS_TIERING_SSD_PERCENT=%d
-		tiering_percent=$(($unprovisioned_bytes * 100 / $OBS_TIERING_SSD_PERCENT)) || (report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Tiering percent calculation failed\"}" && exit 1)
-		weka fs update default --total-capacity "$tiering_percent"B || (report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Tiering update failed\"}" && exit 1)
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"OBS setup completed successfully\"}"
+		set_obs || (report "$(json_object hostname "$HOSTNAME" type "error" message "OBS setup failed")" && exit 1)
+		tiering_percent=$(($unprovisioned_bytes * 100 / $OBS_TIERING_SSD_PERCENT)) || (report "$(json_object hostname "$HOSTNAME" type "error" message "Tiering percent calculation failed")" && exit 1)
+		weka fs update default --total-capacity "$tiering_percent"B || (report "$(json_object hostname "$HOSTNAME" type "error" message "Tiering update failed")" && exit 1)
+		for i in "${!FS_NAMES[@]}"; do
+			if [[ ${FS_TIERED[i]} != true ]]; then
+				continue
+			fi
+			# tiered filesystems use the OBS of the default filesystem
+			obs_name=$(weka fs tier s3 -J | jq -r '.[0].obs_name')
+			ssd_bytes=$(weka fs -J | jq -r --arg name "${FS_NAMES[i]}" '.[] | select(.name == $name).ssd_budget')
+			weka fs tier s3 attach "${FS_NAMES[i]}" "$obs_name" || (report "$(json_object hostname "$HOSTNAME" type "error" message "Attaching OBS to FS '${FS_NAMES[i]}' failed")" && exit 1)
+			weka fs update "${FS_NAMES[i]}" --total-capacity "$((ssd_bytes * 100 / OBS_TIERING_SSD_PERCENT))"B || (report "$(json_object hostname "$HOSTNAME" type "error" message "Tiering update of FS '${FS_NAMES[i]}' failed")" && exit 1)
+		done
+		report "$(json_object hostname "$HOSTNAME" type "progress" message "OBS setup completed successfully")"
 	else
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Skipping OBS setup\"}"
+		report "$(json_object hostname "$HOSTNAME" type "progress" message "Skipping OBS setup")"
 	fi
+	`).Requires("set_obs", "report", "json_object", "SET_OBS", "OBS_TIERING_SSD_PERCENT", "FS_NAMES", "FS_TIERED", "unprovisioned_bytes")
 
-	post_cluster_setup_script="%s"
+	s.Section("", `
 	if [ -n "$post_cluster_setup_script" ]; then
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Running post cluster setup script\"}"
+		report "$(json_object hostname "$HOSTNAME" type "progress" message "Running post cluster setup script")"
 		post_cluster_setup_script_path=/tmp/weka_post_cluster_setup_script.sh
 		echo "$post_cluster_setup_script" > "$post_cluster_setup_script_path"
 		chmod +x "$post_cluster_setup_script_path"
 		echo "running post clusterization script"
 		if "$post_cluster_setup_script_path"; then
-			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Running post cluster setup script completed successfully\"}"
+			report "$(json_object hostname "$HOSTNAME" type "progress" message "Running post cluster setup script completed successfully")"
 		else
-			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Running post cluster setup script failed\"}"
+			report "$(json_object hostname "$HOSTNAME" type "error" message "Running post cluster setup script failed")"
 		fi
 	fi
-	`
-	script := fmt.Sprintf(
-		dedent.Dedent(clusterizeScriptTemplate),
-		strings.Join(params.VMNames, " "),
-		strings.Join(params.IPs, " "),
-		params.ClusterName,
-		params.ClusterizationTarget,
-		params.SetObs,
-		params.DataProtection.StripeWidth,
-		params.DataProtection.ProtectionLevel,
-		params.DataProtection.Hotspare,
-		params.InstallDpdk,
-		params.AddFrontend,
-		params.ProxyUrl,
-		params.WekaHomeUrl,
-		params.TieringTargetSSDRetention,
-		params.TieringStartDemote,
-		params.SetDefaultFs,
-		params.FindDrivesScript,
-		fetchFuncDef,
-		reportFuncDef,
-		clusterizeFinFuncDef,
-		params.PostClusterCreationScript,
-		params.PreStartIoScript,
-		params.ObsScript,
-		params.TieringSSDPercent,
-		params.PostClusterSetupScript,
-	)
-	return script
+	`).Requires("report", "json_object", "post_cluster_setup_script")
+
+	return s
+}
+
+// userScriptFunction wraps a user provided script into a function, so its failure can be reported
+func userScriptFunction(name, message, userScript string) string {
+	return fmt.Sprintf("function %s() {\n\techo %q\n\t%s\n}\n", name, message, userScript)
 }
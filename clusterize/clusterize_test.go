@@ -0,0 +1,214 @@
+package clusterize
+
+import (
+	"testing"
+
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
+	"github.com/weka/go-cloud-lib/script/scripttest"
+)
+
+func testParams() ClusterParams {
+	return ClusterParams{
+		VMNames:                   []string{"weka-1", "weka-2", "weka-3"},
+		IPs:                       []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"},
+		ClusterName:               "poc",
+		ClusterizationTarget:      3,
+		TieringSSDPercent:         20,
+		TieringTargetSSDRetention: 86400,
+		TieringStartDemote:        10,
+		DataProtection:            DataProtectionParams{StripeWidth: 2, ProtectionLevel: 2, Hotspare: 1},
+		InstallDpdk:               true,
+		AddFrontend:               true,
+		FindDrivesScript:          "\nimport json\n",
+		SetDefaultFs:              true,
+	}
+}
+
+func TestClusterizeScript(t *testing.T) {
+	tests := map[string]func(*ClusterParams){
+		"clusterize":            func(p *ClusterParams) {},
+		"clusterize_udp":        func(p *ClusterParams) { p.InstallDpdk = false; p.AddFrontend = false },
+		"clusterize_obs":        func(p *ClusterParams) { p.SetObs = true; p.ObsScript = "weka fs tier s3 add obs" },
+		"clusterize_no_default": func(p *ClusterParams) { p.SetDefaultFs = false },
+		"clusterize_urls":       func(p *ClusterParams) { p.ProxyUrl = "http://proxy:8080"; p.WekaHomeUrl = "https://home.weka.io" },
+		"clusterize_scripts": func(p *ClusterParams) {
+			p.PreStartIoScript = "echo pre"
+			p.PostClusterCreationScript = "echo created"
+			p.PostClusterSetupScript = "#!/bin/bash\necho \"setup $HOSTNAME\"\n"
+		},
+		"clusterize_name_quote": func(p *ClusterParams) { p.ClusterName = `poc"; $(reboot) '` },
+		"clusterize_converged":  func(p *ClusterParams) { p.Converged = true; p.AddFrontend = false },
+		"clusterize_filesystems": func(p *ClusterParams) {
+			p.SetObs = true
+			p.ObsScript = "weka fs tier s3 add obs"
+			p.FilesystemGroups = []FilesystemGroup{{Name: "archive", TargetSSDRetention: 3600, StartDemote: 60}}
+			p.Filesystems = []Filesystem{
+				{Name: "home", Capacity: "25%", AuthRequired: true},
+				{Name: "scratch", Capacity: "10TB", ThinProvisioned: true},
+				{Name: "archive", Group: "archive", Capacity: "20%", Tiered: true},
+			}
+		},
+		"clusterize_kms": func(p *ClusterParams) {
+			p.Kms = &KmsParams{
+				Type:          VaultKms,
+				Address:       "https://vault.example.com:8200",
+				KeyIdentifier: "weka-key",
+				Namespace:     "weka",
+				CaBundle:      "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----",
+			}
+			p.Filesystems = []Filesystem{{Name: "home", Capacity: "25%", AuthRequired: true}}
+		},
+		"clusterize_kmip": func(p *ClusterParams) {
+			p.Kms = &KmsParams{Type: KmipKms, Address: "kmip.example.com:5696", KeyIdentifier: "1234"}
+		},
+		"clusterize_layout": func(p *ClusterParams) {
+			p.ContainerLayout = (&protocol.ContainerLayout{}).
+				Add(protocol.DriveContainer, 2, 2, "").
+				Add(protocol.ComputeContainer, 2, 3, "20GB")
+		},
+	}
+
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			params := testParams()
+			modify(&params)
+			c := ClusterizeScriptGenerator{Params: params, FuncDef: scripttest.FunctionDef{}}
+
+			if err := c.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			scripttest.CheckGolden(t, name, c.GetClusterizeScript())
+		})
+	}
+}
+
+func TestClusterizeInvalidFilesystems(t *testing.T) {
+	tests := map[string][]Filesystem{
+		"duplicate":        {{Name: "home", Capacity: "1TB"}, {Name: "home", Capacity: "1TB"}},
+		"default":          {{Name: "default", Capacity: "1TB"}},
+		"unknown group":    {{Name: "home", Group: "archive", Capacity: "1TB"}},
+		"invalid capacity": {{Name: "home", Capacity: "1 TB"}},
+		"all capacity":     {{Name: "home", Capacity: "60%"}, {Name: "scratch", Capacity: "40%"}},
+		"tiered":           {{Name: "home", Capacity: "1TB", Tiered: true}},
+		"encrypted":        {{Name: "home", Capacity: "1TB", Encrypted: true}},
+	}
+	for name, filesystems := range tests {
+		t.Run(name, func(t *testing.T) {
+			params := testParams()
+			params.Filesystems = filesystems
+			c := ClusterizeScriptGenerator{Params: params, FuncDef: scripttest.FunctionDef{}}
+			if err := c.Validate(); err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
+
+func TestNFSSetupScript(t *testing.T) {
+	c := ConfigureNfsScriptGenerator{
+		Params: protocol.NFSParams{
+			InterfaceGroupName: "weka-ig",
+			SecondaryIps:       []string{"10.0.0.10", "10.0.0.11"},
+			ContainersUid:      []string{"uid-1", "uid-2"},
+			NicNames:           []string{"eth0", "eth0"},
+			HostsNum:           2,
+		},
+		FuncDef: scripttest.FunctionDef{},
+		Name:    "weka-nfs-1",
+	}
+
+	nfsSetupScript := c.GetNFSSetupScript()
+	if err := script.Validate(nfsSetupScript); err != nil {
+		t.Fatal(err)
+	}
+	scripttest.CheckGolden(t, "nfs_setup", nfsSetupScript)
+
+	c.Params = protocol.NFSParams{
+		ContainersUid: []string{"uid-1", "uid-2"},
+		InterfaceGroups: []protocol.NFSInterfaceGroup{
+			{Name: "tenant-a", NicNames: []string{"eth1", "eth1"}, SecondaryIps: []string{"10.1.0.10"}},
+			{Name: "tenant-b", SubnetMask: "255.255.255.0", Gateway: "10.2.0.1", NicNames: []string{"eth2", "eth2"}, SecondaryIps: []string{"10.2.0.10"}},
+		},
+		ClientGroups: []protocol.NFSClientGroup{
+			{
+				Name: "tenant-a-clients",
+				Ips:  []string{"10.1.0.0/16"},
+				Permissions: []protocol.NFSPermission{
+					{Filesystem: "default"},
+					{Filesystem: "archive", Path: "/tenant-a", AccessType: protocol.NFSReadOnly, SquashMode: protocol.NFSAllSquash, AnonUid: 1000, AnonGid: 1000},
+				},
+			},
+			{Name: "tenant-b-clients", Dns: []string{"*.tenant-b.example.com"}, Permissions: []protocol.NFSPermission{{Filesystem: "default", SquashMode: protocol.NFSNoSquash}}},
+		},
+		HostsNum: 2,
+	}
+	nfsSetupScript = c.GetNFSSetupScript()
+	if err := script.Validate(nfsSetupScript); err != nil {
+		t.Fatal(err)
+	}
+	scripttest.CheckGolden(t, "nfs_setup_groups", nfsSetupScript)
+
+	c.Params.InterfaceGroups[1].Name = "tenant-a"
+	c.Params.InterfaceGroups[1].SubnetMask = "255.0.255.0"
+	c.Params.ClientGroups[1].Permissions[0].AccessType = "RX"
+	if _, err := c.nfsSetupScript().Build(); err == nil {
+		t.Error("expected validation error")
+	}
+}
+
+func TestSMBSetupScript(t *testing.T) {
+	for name, p := range map[string]protocol.ProtocolGW{"smb_setup": protocol.SMB, "smbw_setup": protocol.SMBW} {
+		c := ConfigureSmbScriptGenerator{
+			Params: protocol.SMBParams{
+				ClusterName:        "wekasmb",
+				DomainName:         "corp.example.com",
+				DomainJoinUsername: "admin",
+				ContainersUid:      []string{"uid-1", "uid-2"},
+				FloatingIps:        []string{"10.0.0.20", "10.0.0.21"},
+				Shares:             []protocol.SMBShare{{Name: "data"}, {Name: "home", Filesystem: "users", InternalPath: "/home"}},
+				HostsNum:           2,
+			},
+			Protocol: p,
+			FuncDef:  scripttest.FunctionDef{},
+			Name:     "weka-smb-1",
+		}
+
+		smbSetupScript := c.GetSMBSetupScript()
+		if err := script.Validate(smbSetupScript); err != nil {
+			t.Fatal(err)
+		}
+		scripttest.CheckGolden(t, name, smbSetupScript)
+	}
+
+	c := ConfigureSmbScriptGenerator{Protocol: protocol.NFS, FuncDef: scripttest.FunctionDef{}}
+	if _, err := c.smbSetupScript().Build(); err == nil {
+		t.Error("expected validation error")
+	}
+}
+
+func TestS3SetupScript(t *testing.T) {
+	c := ConfigureS3ScriptGenerator{
+		Params: protocol.S3Params{
+			ContainersUid:  []string{"uid-1", "uid-2"},
+			TLSCertificate: "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----",
+			BucketName:     "data",
+			AccessKeyUser:  "s3admin",
+			HostsNum:       2,
+		},
+		FuncDef:        scripttest.FunctionDef{},
+		LoadBalancerIP: "10.0.0.100",
+		Name:           "weka-s3-1",
+	}
+
+	s3SetupScript := c.GetS3SetupScript()
+	if err := script.Validate(s3SetupScript); err != nil {
+		t.Fatal(err)
+	}
+	scripttest.CheckGolden(t, "s3_setup", s3SetupScript)
+
+	c = ConfigureS3ScriptGenerator{Params: protocol.S3Params{ContainersUid: []string{"uid-1"}, TLSCertificate: "cert"}, FuncDef: scripttest.FunctionDef{}}
+	if _, err := c.s3SetupScript().Build(); err == nil {
+		t.Error("expected validation error")
+	}
+}
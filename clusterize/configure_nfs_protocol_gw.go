@@ -1,13 +1,11 @@
 package clusterize
 
 import (
-	"fmt"
-	"strings"
-
-	"github.com/lithammer/dedent"
 	"github.com/weka/go-cloud-lib/bash_functions"
+	"github.com/weka/go-cloud-lib/common"
 	"github.com/weka/go-cloud-lib/functions_def"
 	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
 )
 
 type ConfigureNfsScriptGenerator struct {
@@ -18,157 +16,224 @@ type ConfigureNfsScriptGenerator struct {
 }
 
 func (c *ConfigureNfsScriptGenerator) GetNFSSetupScript() string {
-	configureNFSScriptTemplate := `
-	#!/bin/bash
-	set -ex
-	
-	instance_name="%s"
-	interface_group_name="%s"
-	containersUid=(%s)
-	nic_names=(%s)
-	secondary_ips=(%s)
-	LOAD_BALANCER_IP="%s"
-
-	# fetch function definition
-	%s
-
-	# report function definition
-	%s
-
-	# clusterize_finalization function definition
-	%s
-
-	# set_backend_ip bash function definition
-	%s
-
-	set_backend_ip
-
-	# weka rest function definition (requires $backend_ip var to be set)
-	%s
-
-	# getAllInterfaces bash function definition
-	%s
-
-	getAllInterfaces
-	# set current management ip
-	%s
+	nfsSetupScript, err := c.nfsSetupScript().Build()
+	if err != nil {
+		return common.GetErrorScript(err, c.FuncDef.GetFunctionCmdDefinition(functions_def.Report), protocol.NFS)
+	}
+	return nfsSetupScript
+}
 
-	# prefix_to_netmask bash function definition
-	%s
+func (c *ConfigureNfsScriptGenerator) nfsSetupScript() *script.Builder {
+	if err := c.Params.Validate(); err != nil {
+		return script.New().Fail(err)
+	}
 
+	s := script.New().Shebang().Raw("set -ex\n").
+		Var("instance_name", c.Name).
+		Var("containersUid", c.Params.ContainersUid).
+		Var("LOAD_BALANCER_IP", c.LoadBalancerIP).
+		CloudFunctions(c.FuncDef, functions_def.Fetch, functions_def.Report, functions_def.ClusterizeFinalization).
+		Function("json_object", bash_functions.JsonObjectFunction()).
+		Function("set_backend_ip", bash_functions.SetBackendIpFunction()).Requires("fetch").
+		Section("", "set_backend_ip").Requires("set_backend_ip", "LOAD_BALANCER_IP").Provides("backend_ip").
+		Function("weka_rest", bash_functions.WekaRestFunction()).Requires("json_object").
+		Function("getAllInterfaces", bash_functions.GetAllInterfaces()).
+		Section("set current management ip", "getAllInterfaces\n"+bash_functions.SetCurrentManagementIp()).
+		Requires("getAllInterfaces").Provides("current_mngmnt_ip").
+		Function("prefix_to_netmask", bash_functions.PrefixToNetmask())
+
+	s.Section("", `
 	nfs_count=${#containersUid[@]}
 
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"nfs\", \"type\": \"progress\", \"message\": \"This ($instance_name) is nfs instance $nfs_count/$nfs_count that is ready for joining the interface group\"}"
+	report "$(json_object hostname "$HOSTNAME" protocol "nfs" type "progress" message "This ($instance_name) is nfs instance $nfs_count/$nfs_count that is ready for joining the interface group")"
 
 	set +x
 	fetch_result=$(fetch "{\"fetch_weka_credentials\": true}")
 	export WEKA_USERNAME="$(echo $fetch_result | jq -r .username)"
 	export WEKA_PASSWORD="$(echo $fetch_result | jq -r .password)"
 	set -x
-
-	nic_name=$(ip -o -f inet addr show | grep "$current_mngmnt_ip/"| awk '{print $2}')
-	gateway=$(ip r | grep default | awk '{print $3}')
-	prefix=$(ip -o -f inet addr show $nic_name | grep "$current_mngmnt_ip/" | awk '{print $4}' | cut -d'/' -f2)
-	subnet_mask=$(prefix_to_netmask $prefix)
-
-	function create_interface_group() {
-		if weka_rest interfacegroups | grep ${interface_group_name}; then
-			echo "$(date -u): interface group ${interface_group_name} already exists"
-			return
+	`).Requires("report", "json_object", "fetch", "instance_name", "containersUid", "backend_ip").
+		Provides("WEKA_USERNAME", "WEKA_PASSWORD")
+
+	s.Function("set_interface_group_network", `
+	# sets subnet_mask and gateway of the interface group, unless given, from the network of its NIC on this host
+	# or, if the NIC has no address, from the management network
+	function set_interface_group_network() {
+		subnet_mask=$interface_group_subnet_mask
+		gateway=$interface_group_gateway
+		nic_name=${nic_names[0]}
+		if ! ip -o -f inet addr show "$nic_name" 2>/dev/null | grep -q inet; then
+			nic_name=$(ip -o -f inet addr show | grep "$current_mngmnt_ip/"| awk '{print $2}')
 		fi
-		echo "$(date -u): creating interface group ${interface_group_name}"
-		weka_rest interfacegroups "{\"name\":\"$interface_group_name\",\"type\":\"nfs\",\"subnet\":\"$subnet_mask\",\"gateway\":\"$gateway\"}"
-		echo "$(date -u): interface group ${interface_group_name} created"
-	}
-	
-	function wait_for_weka_fs(){
-		filesystem_name="default"
-		max_retries=30 # 30 * 10 = 5 minutes
-		for (( i=0; i < max_retries; i++ )); do
-			if [ "$(weka_rest filesystems | grep -c $filesystem_name)" -ge 1 ]; then
-				echo "$(date -u): weka filesystem $filesystem_name is up"
-				break
-			fi
-			echo "$(date -u): waiting for weka filesystem $filesystem_name to be up"
-			sleep 10
-		done
-		if (( i > max_retries )); then
-			echo "$(date -u): timeout: weka filesystem $filesystem_name is not up after $max_retries attempts."
-			return 1
+		if [ -z "$subnet_mask" ]; then
+			prefix=$(ip -o -f inet addr show $nic_name | awk '{print $4}' | head -1 | cut -d'/' -f2)
+			subnet_mask=$(prefix_to_netmask $prefix)
+		fi
+		if [ -z "$gateway" ]; then
+			gateway=$(ip r show default dev $nic_name | awk '{print $3}' | head -1)
+		fi
+		if [ -z "$gateway" ]; then
+			gateway=$(ip r | grep default | awk '{print $3}' | head -1)
 		fi
 	}
+	`).Requires("prefix_to_netmask", "current_mngmnt_ip")
 
+	s.Function("wait_for_nfs_interface_group", `
 	function wait_for_nfs_interface_group(){
 	  max_retries=60 # 60 * 10 = 10 minutes
 	  for ((i=0; i<max_retries; i++)); do
-		status=$(weka_rest interfacegroups | jq .data | jq -r '.[] | select(.name == "'${interface_group_name}'").status')
+		status=$(weka_rest interfacegroups | jq .data | jq -r --arg name "$interface_group_name" '.[] | select(.name == $name).status')
 		if [ "$status" == "OK" ]; then
-			echo "$(date -u): interface group status: $status"
+			echo "$(date -u): interface group $interface_group_name status: $status"
 			break
 		fi
-		echo "$(date -u): waiting for interface group status to be OK, current status: $status"
+		echo "$(date -u): waiting for interface group $interface_group_name status to be OK, current status: $status"
 		sleep 10
 	  done
 	  if [ "$status" != "OK" ]; then
-		echo "$(date -u): failed to wait for the interface group status to be OK"
-		report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"nfs\", \"type\": \"error\", \"message\": \"NFS interface group status is not OK after 10 minutes\"}"
+		echo "$(date -u): failed to wait for the interface group $interface_group_name status to be OK"
+		report "$(json_object hostname "$HOSTNAME" protocol "nfs" type "error" message "NFS interface group $interface_group_name status is not OK after 10 minutes")"
 		return 1
 	  fi
 	}
+	`).Requires("report", "json_object", "weka_rest")
 
-	# create interface group if not exists
-	create_interface_group || (report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"nfs\", \"type\": \"error\", \"message\": \"Failed to create NFS interface group\"}" && exit 1)
-	
-	# show interface group
-	#weka nfs interface-group
-	weka_rest interfacegroups | jq -r .data
+	s.Function("setup_interface_group", `
+	# creates the interface group if not exists, and adds to it the ports of the containers and its secondary IPs
+	function setup_interface_group() {
+		set_interface_group_network
+		if weka_rest interfacegroups | jq -e --arg name "$interface_group_name" '.data[] | select(.name == $name)' >/dev/null; then
+			echo "$(date -u): interface group ${interface_group_name} already exists"
+		else
+			echo "$(date -u): creating interface group ${interface_group_name}"
+			if ! weka_rest interfacegroups "$(json_object name "$interface_group_name" type "nfs" subnet "$subnet_mask" gateway "$gateway")"; then
+				report "$(json_object hostname "$HOSTNAME" protocol "nfs" type "error" message "Failed to create NFS interface group $interface_group_name")"
+				return 1
+			fi
+			echo "$(date -u): interface group ${interface_group_name} created"
+		fi
 
-	#weka nfs interface-group port add ${interface_group_name} $container_id $nic_name
-	# add "port" to the interface group - basically it means adding a host and its net device to the group
-	interface_group_uid=$(weka_rest interfacegroups | jq -r .data[].uid)
-	
-	for index in "${!containersUid[@]}"; do
-		container_uid=${containersUid[$index]}
-		nic_name=${nic_names[$index]}
-		weka_rest "interfacegroups/$interface_group_uid/ports/$container_uid" "{\"port\":\"$nic_name\"}"
-	done
-
-	wait_for_nfs_interface_group || exit 1
-
-	# add secondary IPs for the group to use - these IPs will be used in order to mount
-	for secondary_ip in "${secondary_ips[@]}"; do
-		# add secondary ip to the interface group
-		#weka nfs interface-group ip-range add ${interface_group_name} $secondary_ip
-		weka_rest "interfacegroups/$interface_group_uid/ips" "{\"ips\":\"$secondary_ip\"}"
-		wait_for_nfs_interface_group || exit 1
-	done
+		#weka nfs interface-group port add ${interface_group_name} $container_id $nic_name
+		# add "port" to the interface group - basically it means adding a host and its net device to the group
+		interface_group_uid=$(weka_rest interfacegroups | jq -r --arg name "$interface_group_name" '.data[] | select(.name == $name).uid')
+
+		for index in "${!containersUid[@]}"; do
+			container_uid=${containersUid[$index]}
+			nic_name=${nic_names[$index]}
+			weka_rest "interfacegroups/$interface_group_uid/ports/$container_uid" "$(json_object port "$nic_name")"
+		done
+
+		wait_for_nfs_interface_group || return 1
+
+		# add secondary IPs for the group to use - these IPs will be used in order to mount
+		for secondary_ip in "${secondary_ips[@]}"; do
+			# add secondary ip to the interface group
+			#weka nfs interface-group ip-range add ${interface_group_name} $secondary_ip
+			weka_rest "interfacegroups/$interface_group_uid/ips" "$(json_object ips "$secondary_ip")"
+			wait_for_nfs_interface_group || return 1
+		done
+		report "$(json_object hostname "$HOSTNAME" protocol "nfs" type "progress" message "NFS interface group $interface_group_name is ready on subnet $subnet_mask via gateway $gateway")"
+	}
+	`).Requires("report", "json_object", "weka_rest", "set_interface_group_network", "wait_for_nfs_interface_group", "containersUid")
+
+	for _, group := range c.Params.Groups() {
+		s.Var("interface_group_name", group.Name).
+			Var("interface_group_subnet_mask", group.SubnetMask).
+			Var("interface_group_gateway", group.Gateway).
+			Var("nic_names", group.NicNames).
+			Var("secondary_ips", group.SecondaryIps).
+			Section("", "setup_interface_group || exit 1").
+			Requires("setup_interface_group", "WEKA_USERNAME", "WEKA_PASSWORD")
+	}
+
+	if len(c.Params.ClientGroups) > 0 {
+		addNfsClientGroupsSetup(s, c.Params.ClientGroups)
+	}
 
+	s.Section("", `
+	# show interface groups
+	#weka nfs interface-group
 	weka_rest interfacegroups | jq -r .data
 
 	echo "$(date -u): NFS setup complete"
 	
 	echo "completed successfully" > /tmp/weka_clusterization_completion_validation
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"nfs\", \"type\": \"progress\", \"message\": \"NFS configuration completed successfully\"}"
+	report "$(json_object hostname "$HOSTNAME" protocol "nfs" type "progress" message "NFS configuration completed successfully")"
 
 	clusterize_finalization "{\"protocol\": \"nfs\"}"
-	`
-	nfsSetupScript := fmt.Sprintf(
-		configureNFSScriptTemplate,
-		c.Name,
-		c.Params.InterfaceGroupName,
-		strings.Join(c.Params.ContainersUid, " "),
-		strings.Join(c.Params.NicNames, " "),
-		strings.Join(c.Params.SecondaryIps, " "),
-		c.LoadBalancerIP,
-		c.FuncDef.GetFunctionCmdDefinition(functions_def.Fetch),
-		c.FuncDef.GetFunctionCmdDefinition(functions_def.Report),
-		c.FuncDef.GetFunctionCmdDefinition(functions_def.ClusterizeFinalization),
-		bash_functions.SetBackendIpFunction(),
-		bash_functions.WekaRestFunction(),
-		bash_functions.GetAllInterfaces(),
-		bash_functions.SetCurrentManagementIp(),
-		bash_functions.PrefixToNetmask(),
-	)
-
-	return dedent.Dedent(nfsSetupScript)
+	`).Requires("report", "json_object", "weka_rest", "clusterize_finalization")
+
+	return s
+}
+
+// addNfsClientGroupsSetup creates the client groups, their rules and permissions which don't exist yet. Existing
+// ones are kept as they are, see nfs_permissions.Reconcile for updating them.
+func addNfsClientGroupsSetup(s *script.Builder, clientGroups []protocol.NFSClientGroup) {
+	s.Function("setup_client_group", `
+	function setup_client_group() {
+		client_group_uid=$(weka_rest nfs/clientGroups | jq -r --arg name "$client_group_name" '.data[] | select(.name == $name).uid')
+		if [ -z "$client_group_uid" ]; then
+			echo "$(date -u): creating client group $client_group_name"
+			weka_rest nfs/clientGroups "$(json_object name "$client_group_name")" || return 1
+			client_group_uid=$(weka_rest nfs/clientGroups | jq -r --arg name "$client_group_name" '.data[] | select(.name == $name).uid')
+		fi
+		rules=$(weka_rest nfs/clientGroups | jq -r --arg name "$client_group_name" '.data[] | select(.name == $name).rules[].rule')
+
+		for ip_rule in "${client_group_ips[@]}"; do
+			if ! echo "$rules" | grep -qxF -- "$ip_rule"; then
+				weka_rest "nfs/clientGroups/$client_group_uid/rules" "$(json_object ip "$ip_rule")" || return 1
+			fi
+		done
+		for dns_rule in "${client_group_dns[@]}"; do
+			if ! echo "$rules" | grep -qxF -- "$dns_rule"; then
+				weka_rest "nfs/clientGroups/$client_group_uid/rules" "$(json_object dns "$dns_rule")" || return 1
+			fi
+		done
+
+		permissions=$(weka_rest nfs/permissions | jq -r --arg name "$client_group_name" '.data[] | select(.group == $name) | .filesystem + ":" + .path')
+		for index in "${!permission_filesystems[@]}"; do
+			filesystem=${permission_filesystems[$index]}
+			path=${permission_paths[$index]}
+			if echo "$permissions" | grep -qxF -- "$filesystem:$path"; then
+				echo "$(date -u): $filesystem:$path is already exported to client group $client_group_name"
+				continue
+			fi
+			permission=$(jq -nc --arg filesystem "$filesystem" --arg group "$client_group_name" --arg path "$path" \
+				--arg permission_type "${permission_types[$index]}" --arg squash_mode "${permission_squash_modes[$index]}" \
+				--argjson anon_uid "${permission_anon_uids[$index]}" --argjson anon_gid "${permission_anon_gids[$index]}" \
+				'{filesystem: $filesystem, group: $group, path: $path, permission_type: $permission_type, squash_mode: $squash_mode, anon_uid: $anon_uid, anon_gid: $anon_gid}')
+			weka_rest nfs/permissions "$permission" || return 1
+		done
+		report "$(json_object hostname "$HOSTNAME" protocol "nfs" type "progress" message "NFS client group $client_group_name is configured")"
+	}
+	`).Requires("report", "json_object", "weka_rest")
+
+	for _, clientGroup := range clientGroups {
+		var filesystems, paths, types, squashModes []string
+		var anonUids, anonGids []int
+		for _, permission := range clientGroup.Permissions {
+			permission = permission.WithDefaults()
+			filesystems = append(filesystems, permission.Filesystem)
+			paths = append(paths, permission.Path)
+			types = append(types, string(permission.AccessType))
+			squashModes = append(squashModes, string(permission.SquashMode))
+			anonUids = append(anonUids, permission.AnonUid)
+			anonGids = append(anonGids, permission.AnonGid)
+		}
+		s.Var("client_group_name", clientGroup.Name).
+			Var("client_group_ips", clientGroup.Ips).
+			Var("client_group_dns", clientGroup.Dns).
+			Var("permission_filesystems", filesystems).
+			Var("permission_paths", paths).
+			Var("permission_types", types).
+			Var("permission_squash_modes", squashModes).
+			Var("permission_anon_uids", anonUids).
+			Var("permission_anon_gids", anonGids).
+			Section("", `
+			if ! setup_client_group; then
+				report "$(json_object hostname "$HOSTNAME" protocol "nfs" type "error" message "Failed to configure NFS client group $client_group_name")"
+				exit 1
+			fi
+			`).Requires("setup_client_group", "report", "json_object", "WEKA_USERNAME", "WEKA_PASSWORD")
+	}
 }
@@ -0,0 +1,196 @@
+package clusterize
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/weka/go-cloud-lib/bash_functions"
+	"github.com/weka/go-cloud-lib/common"
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
+)
+
+const (
+	defaultS3Port = 9000
+	// s3CredentialsDir keeps the generated secret keys on the gateway, the report refers to them by path
+	s3CredentialsDir = "/opt/weka/s3"
+)
+
+type ConfigureS3ScriptGenerator struct {
+	Params         protocol.S3Params
+	FuncDef        functions_def.FunctionDef
+	LoadBalancerIP string // the endpoint is registered on it, see DeploymentParams.LoadBalancerIP
+	Name           string // for aws it will be the instance id
+}
+
+func (c *ConfigureS3ScriptGenerator) GetS3SetupScript() string {
+	s3SetupScript, err := c.s3SetupScript().Build()
+	if err != nil {
+		return common.GetErrorScript(err, c.FuncDef.GetFunctionCmdDefinition(functions_def.Report), protocol.S3)
+	}
+	return s3SetupScript
+}
+
+func (c *ConfigureS3ScriptGenerator) validateParams() error {
+	var errs []error
+	if len(c.Params.ContainersUid) == 0 {
+		errs = append(errs, fmt.Errorf("containers uid list is empty"))
+	}
+	if c.Params.Port < 0 || c.Params.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid s3 port %d", c.Params.Port))
+	}
+	if c.Params.TLSCertificate != "" && !strings.Contains(c.Params.TLSCertificate, "-----BEGIN CERTIFICATE-----") {
+		errs = append(errs, fmt.Errorf("tls certificate is not a PEM certificate"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+func (c *ConfigureS3ScriptGenerator) s3SetupScript() *script.Builder {
+	if err := c.validateParams(); err != nil {
+		return script.New().Fail(err)
+	}
+
+	port := c.Params.Port
+	if port == 0 {
+		port = defaultS3Port
+	}
+	filesystem := c.Params.DefaultFilesystem
+	if filesystem == "" {
+		filesystem = defaultFilesystemName
+	}
+
+	s := script.New().Shebang().Raw("set -ex\n").
+		Var("instance_name", c.Name).
+		Var("PROTOCOL", string(protocol.S3)).
+		Var("containersUid", c.Params.ContainersUid).
+		Var("s3_port", port).
+		Var("s3_filesystem", filesystem).
+		Var("bucket_name", c.Params.BucketName).
+		Var("access_key_user", c.Params.AccessKeyUser).
+		Var("LOAD_BALANCER_IP", c.LoadBalancerIP).
+		Var("tls_certificate", c.Params.TLSCertificate).
+		CloudFunctions(c.FuncDef, functions_def.Fetch, functions_def.Report, functions_def.ClusterizeFinalization).
+		Function("json_object", bash_functions.JsonObjectFunction())
+
+	s.Section("", `
+	s3_count=${#containersUid[@]}
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "This ($instance_name) is s3 instance $s3_count/$s3_count that is ready for joining the S3 cluster")"
+	`).Requires("report", "json_object", "instance_name", "PROTOCOL", "containersUid")
+	addProtocolGWSetup(s)
+
+	s.Function("wait_for_s3_cluster", `
+	function wait_for_s3_cluster(){
+		max_retries=60 # 60 * 10 = 10 minutes
+		for ((i=0; i<max_retries; i++)); do
+			if status=$(weka s3 cluster status 2>&1) && ! echo "$status" | grep -qi "not ready"; then
+				echo "$(date -u): s3 cluster is ready"
+				return
+			fi
+			echo "$(date -u): waiting for s3 cluster to be ready, current status: $status"
+			sleep 10
+		done
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "S3 cluster is not ready after 10 minutes")"
+		return 1
+	}
+	`).Requires("report", "json_object", "PROTOCOL")
+
+	s.Section("tls certificate", `
+	if [ -n "$tls_certificate" ]; then
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "Setting TLS certificate")"
+		tls_dir=$(mktemp -d)
+		echo "$tls_certificate" > "$tls_dir/certificate.pem"
+		set +x
+		tls_credentials=$(fetch "{\"fetch_s3_tls_private_key\": true}")
+		(umask 077 && echo "$tls_credentials" | jq -r .private_key > "$tls_dir/private_key.pem")
+		unset tls_credentials
+		set -x
+		if [ ! -s "$tls_dir/private_key.pem" ] || grep -qx null "$tls_dir/private_key.pem"; then
+			rm -rf "$tls_dir"
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed fetching the TLS private key")"
+			exit 1
+		fi
+		output=$(weka security tls set --private-key "$tls_dir/private_key.pem" --certificate "$tls_dir/certificate.pem" 2>&1) || tls_failed=true
+		rm -rf "$tls_dir"
+		if [[ $tls_failed == true ]]; then
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed to set TLS certificate: $output")"
+			exit 1
+		fi
+	fi
+	`).Requires("fetch", "report", "json_object", "PROTOCOL", "tls_certificate")
+
+	s.Section("create s3 cluster", `
+	wait_for_weka_fs .config_fs || exit 1
+	wait_for_weka_fs "$s3_filesystem" || exit 1
+
+	if weka s3 cluster | grep -qi "not configured" || ! weka s3 cluster >/dev/null 2>&1; then
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "Creating S3 cluster on $s3_filesystem")"
+		if ! output=$(weka s3 cluster create "$s3_filesystem" .config_fs --container "$(IFS=, ;echo "${container_ids[*]}")" --port "$s3_port" 2>&1); then
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed to create S3 cluster: $output")"
+			exit 1
+		fi
+	else
+		echo "$(date -u): s3 cluster already exists"
+	fi
+
+	wait_for_s3_cluster || exit 1
+	`).Requires("report", "json_object", "wait_for_weka_fs", "wait_for_s3_cluster", "PROTOCOL", "s3_filesystem", "s3_port", "container_ids")
+
+	s.Section("initial bucket", `
+	if [ -n "$bucket_name" ]; then
+		if weka s3 bucket list | grep -qwF -- "$bucket_name"; then
+			echo "$(date -u): s3 bucket $bucket_name already exists"
+		elif ! output=$(weka s3 bucket create "$bucket_name" 2>&1); then
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed to create S3 bucket $bucket_name: $output")"
+			exit 1
+		fi
+	fi
+	`).Requires("report", "json_object", "PROTOCOL", "bucket_name")
+
+	s.Section("access key", fmt.Sprintf(`
+	credentials_file=""
+	if [ -n "$access_key_user" ]; then
+		credentials_file=%s/$access_key_user.credentials
+		if weka user | grep -qwF -- "$access_key_user"; then
+			echo "$(date -u): s3 user $access_key_user already exists"
+		else
+			mkdir -p %s
+			chmod 700 %s
+			set +x
+			secret_key=$(openssl rand -hex 20)
+			(umask 077 && printf 'aws_access_key_id = %%s\naws_secret_access_key = %%s\n' "$access_key_user" "$secret_key" > "$credentials_file")
+			if ! output=$(weka user add "$access_key_user" s3 "$secret_key" 2>&1); then
+				set -x
+				report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed to create S3 user $access_key_user: $output")"
+				exit 1
+			fi
+			set -x
+			weka s3 policy attach readwrite "$access_key_user"
+		fi
+	fi
+	`, s3CredentialsDir, s3CredentialsDir, s3CredentialsDir)).
+		Requires("report", "json_object", "PROTOCOL", "access_key_user").Provides("credentials_file")
+
+	s.Section("", `
+	if [ -n "$LOAD_BALANCER_IP" ]; then
+		endpoint_ip=$LOAD_BALANCER_IP
+	else
+		endpoint_ip=$(hostname -I | awk '{print $1}')
+	fi
+	endpoint="https://$endpoint_ip:$s3_port"
+
+	weka s3 cluster
+
+	echo "$(date -u): S3 setup complete"
+
+	echo "completed successfully" > /tmp/weka_clusterization_completion_validation
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "S3 configuration completed successfully" endpoint "$endpoint" bucket "$bucket_name" access_key_id "$access_key_user" credentials "$credentials_file")"
+
+	clusterize_finalization "$(json_object protocol "$PROTOCOL" endpoint "$endpoint")"
+	`).Requires("report", "json_object", "clusterize_finalization", "PROTOCOL", "LOAD_BALANCER_IP", "s3_port", "bucket_name", "access_key_user", "credentials_file")
+
+	return s
+}
@@ -0,0 +1,190 @@
+package clusterize
+
+import (
+	"fmt"
+
+	"github.com/weka/go-cloud-lib/bash_functions"
+	"github.com/weka/go-cloud-lib/common"
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
+)
+
+type ConfigureSmbScriptGenerator struct {
+	Params         protocol.SMBParams
+	Protocol       protocol.ProtocolGW // protocol.SMB or protocol.SMBW
+	FuncDef        functions_def.FunctionDef
+	LoadBalancerIP string
+	Name           string // for aws it will be the instance id
+}
+
+func (c *ConfigureSmbScriptGenerator) GetSMBSetupScript() string {
+	smbSetupScript, err := c.smbSetupScript().Build()
+	if err != nil {
+		return common.GetErrorScript(err, c.FuncDef.GetFunctionCmdDefinition(functions_def.Report), c.Protocol)
+	}
+	return smbSetupScript
+}
+
+func (c *ConfigureSmbScriptGenerator) validateParams() error {
+	var errs []error
+	if c.Protocol != protocol.SMB && c.Protocol != protocol.SMBW {
+		errs = append(errs, fmt.Errorf("invalid smb protocol %q", c.Protocol))
+	}
+	if c.Params.ClusterName == "" {
+		errs = append(errs, fmt.Errorf("smb cluster name is empty"))
+	}
+	if c.Params.DomainName == "" {
+		errs = append(errs, fmt.Errorf("domain name is empty"))
+	}
+	if len(c.Params.ContainersUid) == 0 {
+		errs = append(errs, fmt.Errorf("containers uid list is empty"))
+	}
+	for _, share := range c.Params.Shares {
+		if share.Name == "" {
+			errs = append(errs, fmt.Errorf("smb share name is empty"))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+func (c *ConfigureSmbScriptGenerator) smbSetupScript() *script.Builder {
+	if err := c.validateParams(); err != nil {
+		return script.New().Fail(err)
+	}
+
+	var shareNames, shareFilesystems, sharePaths []string
+	for _, share := range c.Params.Shares {
+		filesystem := share.Filesystem
+		if filesystem == "" {
+			filesystem = defaultFilesystemName
+		}
+		shareNames = append(shareNames, share.Name)
+		shareFilesystems = append(shareFilesystems, filesystem)
+		sharePaths = append(sharePaths, share.InternalPath)
+	}
+
+	s := script.New().Shebang().Raw("set -ex\n").
+		Var("instance_name", c.Name).
+		Var("PROTOCOL", string(c.Protocol)).
+		Var("cluster_name", c.Params.ClusterName).
+		Var("domain_name", c.Params.DomainName).
+		Var("domain_netbios_name", c.Params.DomainNetbiosName).
+		Var("containersUid", c.Params.ContainersUid).
+		Var("floating_ips", c.Params.FloatingIps).
+		Var("share_names", shareNames).
+		Var("share_filesystems", shareFilesystems).
+		Var("share_paths", sharePaths).
+		Var("LOAD_BALANCER_IP", c.LoadBalancerIP).
+		Var("domain_join_username", c.Params.DomainJoinUsername).
+		CloudFunctions(c.FuncDef, functions_def.Fetch, functions_def.Report, functions_def.ClusterizeFinalization).
+		Function("json_object", bash_functions.JsonObjectFunction())
+
+	s.Section("", `
+	smb_count=${#containersUid[@]}
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "This ($instance_name) is $PROTOCOL instance $smb_count/$smb_count that is ready for joining the SMB cluster")"
+	`).Requires("report", "json_object", "instance_name", "PROTOCOL", "containersUid")
+	addProtocolGWSetup(s)
+
+	s.Function("wait_for_smb_cluster", `
+	function wait_for_smb_cluster(){
+		max_retries=60 # 60 * 10 = 10 minutes
+		for ((i=0; i<max_retries; i++)); do
+			if status=$(weka smb cluster status 2>&1) && ! echo "$status" | grep -qi "not ready"; then
+				echo "$(date -u): smb cluster is ready"
+				return
+			fi
+			echo "$(date -u): waiting for smb cluster to be ready, current status: $status"
+			sleep 10
+		done
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "SMB cluster is not ready after 10 minutes")"
+		return 1
+	}
+	`).Requires("report", "json_object", "PROTOCOL")
+
+	s.Section("create smb cluster", `
+	if [[ $PROTOCOL == smbw ]]; then
+		wait_for_weka_fs .config_fs || exit 1
+	fi
+
+	if weka smb cluster | grep -qF -- "$cluster_name"; then
+		echo "$(date -u): smb cluster $cluster_name already exists"
+	else
+		create_options=(--container-ids "$(IFS=, ;echo "${container_ids[*]}")")
+		if [ ${#floating_ips[@]} -gt 0 ]; then
+			create_options+=(--smb-ips-pool "$(IFS=, ;echo "${floating_ips[*]}")")
+		fi
+		if [ -n "$domain_netbios_name" ]; then
+			create_options+=(--domain-netbios-name "$domain_netbios_name")
+		fi
+		if [[ $PROTOCOL == smbw ]]; then
+			create_options+=(--smbw --config-fs-name .config_fs)
+		fi
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "Creating SMB cluster $cluster_name")"
+		if ! output=$(weka smb cluster create "$cluster_name" "$domain_name" "${create_options[@]}" 2>&1); then
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed to create SMB cluster: $output")"
+			exit 1
+		fi
+	fi
+
+	wait_for_smb_cluster || exit 1
+	`).Requires("report", "json_object", "wait_for_weka_fs", "wait_for_smb_cluster", "PROTOCOL", "cluster_name", "domain_name", "domain_netbios_name", "floating_ips", "container_ids")
+
+	s.Section("join the domain", `
+	if [ -n "$domain_join_username" ]; then
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "Joining SMB cluster to domain $domain_name")"
+		set +x
+		domain_join_credentials=$(fetch "{\"fetch_smb_domain_join_password\": true}")
+		domain_join_password=$(echo "$domain_join_credentials" | jq -r .password)
+		if [ -z "$domain_join_password" ] || [ "$domain_join_password" == "null" ]; then
+			set -x
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed fetching the domain join password")"
+			exit 1
+		fi
+		output=$(weka smb domain join "$domain_join_username" "$domain_join_password" 2>&1) || join_failed=true
+		unset domain_join_credentials domain_join_password
+		set -x
+		if [[ $join_failed == true ]]; then
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed to join domain $domain_name: $output")"
+			exit 1
+		fi
+	fi
+	`).Requires("fetch", "report", "json_object", "PROTOCOL", "domain_name", "domain_join_username")
+
+	s.Section("add shares", `
+	for index in "${!share_names[@]}"; do
+		share_name=${share_names[$index]}
+		share_filesystem=${share_filesystems[$index]}
+		share_path=${share_paths[$index]}
+		if weka smb share | grep -qwF -- "$share_name"; then
+			echo "$(date -u): smb share $share_name already exists"
+			continue
+		fi
+		wait_for_weka_fs "$share_filesystem" || exit 1
+		share_options=()
+		if [ -n "$share_path" ]; then
+			share_options+=(--internal-path "$share_path")
+		fi
+		if ! output=$(weka smb share add "$share_name" "$share_filesystem" "${share_options[@]}" 2>&1); then
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed to add SMB share $share_name: $output")"
+			exit 1
+		fi
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "SMB share $share_name was added on filesystem $share_filesystem")"
+	done
+
+	weka smb cluster
+	weka smb share
+
+	echo "$(date -u): SMB setup complete"
+
+	echo "completed successfully" > /tmp/weka_clusterization_completion_validation
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "SMB configuration completed successfully")"
+
+	clusterize_finalization "$(json_object protocol "$PROTOCOL")"
+	`).Requires("report", "json_object", "clusterize_finalization", "wait_for_weka_fs", "PROTOCOL", "share_names", "share_filesystems", "share_paths")
+
+	return s
+}
@@ -0,0 +1,160 @@
+package clusterize
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultFilesystemGroupName = "default"
+
+// FilesystemGroup is a weka filesystem group, its tiering settings apply to the tiered filesystems in it
+type FilesystemGroup struct {
+	Name               string
+	TargetSSDRetention int // seconds
+	StartDemote        int // seconds
+}
+
+// Filesystem is a weka filesystem created at clusterization, after the filesystem groups and before the default
+// filesystem, which takes the capacity left
+type Filesystem struct {
+	Name            string
+	Group           string // defaults to the default group
+	Capacity        string // bytes with an optional unit, e.g. 10TB, or a percent of the unprovisioned capacity, e.g. 25%
+	Tiered          bool   // the filesystem is tiered to the OBS of SetObs, Capacity is its SSD capacity
+	Encrypted       bool
+	AuthRequired    bool // mounting requires an authenticated weka user
+	ThinProvisioned bool // Capacity is the maximal SSD capacity, the filesystem reserves none
+}
+
+var (
+	capacityBytes   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([KMGTP]i?)?B?$`)
+	capacityPercent = regexp.MustCompile(`^([0-9]+)%$`)
+	filesystemName  = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// percent returns the percent of a percent capacity, and false for a bytes capacity
+func (f Filesystem) percent() (int, bool) {
+	match := capacityPercent.FindStringSubmatch(f.Capacity)
+	if match == nil {
+		return 0, false
+	}
+	percent, _ := strconv.Atoi(match[1])
+	return percent, true
+}
+
+// options returns the weka fs create options of the filesystem
+func (f Filesystem) options() string {
+	var options []string
+	if f.Encrypted {
+		options = append(options, "--encrypted")
+	}
+	if f.AuthRequired {
+		options = append(options, "--auth-required yes")
+	}
+	return strings.Join(options, " ")
+}
+
+var capacityUnits = map[string]float64{
+	"": 1, "K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12, "P": 1e15,
+	"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30, "Ti": 1 << 40, "Pi": 1 << 50,
+}
+
+// bytes returns the capacity of the filesystem in bytes, a percent capacity is of unprovisionedBytes
+func (f Filesystem) bytes(unprovisionedBytes int64) int64 {
+	if percent, ok := f.percent(); ok {
+		return unprovisionedBytes * int64(percent) / 100
+	}
+	match := capacityBytes.FindStringSubmatch(f.Capacity)
+	if match == nil {
+		return 0
+	}
+	number, _ := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSuffix(f.Capacity, "B"), match[2]), 64)
+	return int64(number * capacityUnits[match[2]])
+}
+
+func (f Filesystem) group() string {
+	if f.Group == "" {
+		return defaultFilesystemGroupName
+	}
+	return f.Group
+}
+
+// filesystemGroups returns the groups to create, the default group always comes first, as .config_fs is created
+// in it, with the tiering settings of ClusterParams unless it's listed in FilesystemGroups
+func (c *ClusterizeScriptGenerator) filesystemGroups() []FilesystemGroup {
+	groups := []FilesystemGroup{{
+		Name:               defaultFilesystemGroupName,
+		TargetSSDRetention: c.Params.TieringTargetSSDRetention,
+		StartDemote:        c.Params.TieringStartDemote,
+	}}
+	for _, group := range c.Params.FilesystemGroups {
+		if group.Name == defaultFilesystemGroupName {
+			groups[0] = group
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func (c *ClusterizeScriptGenerator) validateFilesystems() error {
+	var errs []error
+	groups := make(map[string]bool)
+	for _, group := range c.Params.FilesystemGroups {
+		if !filesystemName.MatchString(group.Name) {
+			errs = append(errs, fmt.Errorf("invalid filesystem group name %q", group.Name))
+		}
+		if groups[group.Name] {
+			errs = append(errs, fmt.Errorf("duplicate filesystem group %s", group.Name))
+		}
+		groups[group.Name] = true
+		if group.TargetSSDRetention < 0 || group.StartDemote < 0 {
+			errs = append(errs, fmt.Errorf("filesystem group %s has negative tiering settings", group.Name))
+		}
+	}
+	groups[defaultFilesystemGroupName] = true
+
+	names := map[string]bool{".config_fs": true}
+	if c.Params.SetDefaultFs {
+		names[defaultFilesystemName] = true
+	}
+	totalPercent := 0
+	for _, fs := range c.Params.Filesystems {
+		if !filesystemName.MatchString(fs.Name) {
+			errs = append(errs, fmt.Errorf("invalid filesystem name %q", fs.Name))
+		}
+		if names[fs.Name] {
+			errs = append(errs, fmt.Errorf("duplicate filesystem %s", fs.Name))
+		}
+		names[fs.Name] = true
+		if !groups[fs.group()] {
+			errs = append(errs, fmt.Errorf("filesystem %s: unknown filesystem group %s", fs.Name, fs.group()))
+		}
+		if percent, ok := fs.percent(); ok {
+			if percent <= 0 || percent > 100 {
+				errs = append(errs, fmt.Errorf("filesystem %s: capacity %s is out of range", fs.Name, fs.Capacity))
+			}
+			totalPercent += percent
+		} else if !capacityBytes.MatchString(fs.Capacity) {
+			errs = append(errs, fmt.Errorf("filesystem %s: invalid capacity %q", fs.Name, fs.Capacity))
+		}
+		if fs.Encrypted && c.Params.Kms == nil {
+			errs = append(errs, fmt.Errorf("filesystem %s is encrypted without a KMS", fs.Name))
+		}
+		if fs.Tiered && !c.Params.SetObs {
+			errs = append(errs, fmt.Errorf("filesystem %s is tiered without an OBS", fs.Name))
+		}
+	}
+	if totalPercent > 100 {
+		errs = append(errs, fmt.Errorf("filesystems take %d%% of the capacity", totalPercent))
+	} else if totalPercent == 100 && c.Params.SetDefaultFs {
+		errs = append(errs, fmt.Errorf("filesystems take all the capacity, leaving none for the default filesystem"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package clusterize
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/weka/go-cloud-lib/script"
+)
+
+type KmsType string
+
+const (
+	VaultKms KmsType = "vault"
+	KmipKms  KmsType = "kmip"
+)
+
+// KmsParams configures the weka KMS, which encrypts the filesystem keys. Its credentials are fetched by the script
+// with fetch_kms_credentials: a token for vault, or a client certificate and key for kmip.
+type KmsParams struct {
+	Type          KmsType
+	Address       string // e.g. https://vault.example.com:8200 or kmip.example.com:5696
+	KeyIdentifier string // the vault transit key name, or the kmip key uid
+	Namespace     string // vault only
+	CaBundle      string // PEM, to verify the KMS certificate
+}
+
+func (k KmsParams) Validate() error {
+	var errs []error
+	switch k.Type {
+	case VaultKms:
+		if u, err := url.Parse(k.Address); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("vault address %q is not a url", k.Address))
+		}
+	case KmipKms:
+		if k.Address == "" || strings.Contains(k.Address, "://") {
+			errs = append(errs, fmt.Errorf("kmip address %q must be a host and port", k.Address))
+		}
+		if k.Namespace != "" {
+			errs = append(errs, fmt.Errorf("namespace is supported by vault only"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid kms type %q", k.Type))
+	}
+	if k.KeyIdentifier == "" {
+		errs = append(errs, fmt.Errorf("kms key identifier is empty"))
+	}
+	if k.CaBundle != "" && !strings.Contains(k.CaBundle, "-----BEGIN CERTIFICATE-----") {
+		errs = append(errs, fmt.Errorf("kms ca bundle is not a PEM certificate"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+// addKmsSetup configures the KMS and checks it's usable, so a misconfiguration fails the clusterization before start-io
+func addKmsSetup(s *script.Builder, kms KmsParams) {
+	s.Var("KMS_TYPE", string(kms.Type)).
+		Var("KMS_ADDRESS", kms.Address).
+		Var("KMS_KEY_IDENTIFIER", kms.KeyIdentifier).
+		Var("KMS_NAMESPACE", kms.Namespace).
+		Var("KMS_CA_BUNDLE", kms.CaBundle)
+
+	s.Section("configure kms", `
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Configuring $KMS_TYPE KMS $KMS_ADDRESS")"
+	kms_dir=$(mktemp -d)
+	chmod 700 "$kms_dir"
+	kms_options=()
+	if [ -n "$KMS_CA_BUNDLE" ]; then
+		echo "$KMS_CA_BUNDLE" > "$kms_dir/ca.pem"
+		kms_options+=(--ca-cert-pem "$kms_dir/ca.pem")
+	fi
+	if [ -n "$KMS_NAMESPACE" ]; then
+		kms_options+=(--namespace "$KMS_NAMESPACE")
+	fi
+
+	set +x
+	kms_credentials=$(fetch "{\"fetch_kms_credentials\": true}")
+	if [[ $KMS_TYPE == vault ]]; then
+		kms_token=$(echo "$kms_credentials" | jq -r .token)
+		if [ -z "$kms_token" ] || [ "$kms_token" == "null" ]; then
+			report "$(json_object hostname "$HOSTNAME" type "error" message "Failed fetching KMS token")"
+			exit 1
+		fi
+		kms_options+=(--token "$kms_token")
+	else
+		(umask 077 && echo "$kms_credentials" | jq -r .client_cert > "$kms_dir/client.pem" && echo "$kms_credentials" | jq -r .client_key > "$kms_dir/client.key")
+		if grep -qx null "$kms_dir/client.pem" "$kms_dir/client.key"; then
+			report "$(json_object hostname "$HOSTNAME" type "error" message "Failed fetching KMS client certificate")"
+			exit 1
+		fi
+		kms_options+=(--client-cert-pem "$kms_dir/client.pem" --client-key-pem "$kms_dir/client.key")
+	fi
+	kms_output=$(weka security kms set "$KMS_TYPE" "$KMS_ADDRESS" "$KMS_KEY_IDENTIFIER" "${kms_options[@]}" 2>&1) || kms_failed=true
+	unset kms_credentials kms_token kms_options
+	set -x
+	rm -rf "$kms_dir"
+	if [[ $kms_failed == true ]]; then
+		report "$(json_object hostname "$HOSTNAME" type "error" message "Failed configuring KMS: $kms_output")"
+		exit 1
+	fi
+
+	# weka checks the KMS when it's set, make sure it took effect before any encrypted filesystem is created
+	if ! weka security kms -J | jq -e --arg address "$KMS_ADDRESS" '.. | strings | select(. == $address)' >/dev/null; then
+		report "$(json_object hostname "$HOSTNAME" type "error" message "KMS $KMS_ADDRESS is not configured")"
+		exit 1
+	fi
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "KMS was configured successfully")"
+	`).Requires("fetch", "report", "json_object", "KMS_TYPE", "KMS_ADDRESS", "KMS_KEY_IDENTIFIER", "KMS_NAMESPACE", "KMS_CA_BUNDLE")
+}
@@ -0,0 +1,480 @@
+package clusterize
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/lib/types"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/preflight"
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/report"
+)
+
+// configFsCapacity is the capacity of .config_fs, 22GB as the clusterize script creates it
+const configFsCapacity = 22_000_000_000
+
+type StepStatus string
+
+const (
+	StepPending StepStatus = "pending"
+	StepRunning StepStatus = "running"
+	StepDone    StepStatus = "done"
+	StepFailed  StepStatus = "failed"
+)
+
+// OrchestratorStep is the status of a clusterization step, kept in the OrchestratorState
+type OrchestratorStep struct {
+	Name       string     `json:"name"`
+	Status     StepStatus `json:"status"`
+	Attempts   int        `json:"attempts"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// OrchestratorState is persisted by the caller between runs of the Orchestrator, a run resumes from the first step
+// which is not done
+type OrchestratorState struct {
+	Steps []OrchestratorStep `json:"steps"`
+	// the capacity unprovisioned before creating any of the Filesystems, their percent capacities are of it
+	FilesystemsUnprovisionedBytes int64 `json:"filesystems_unprovisioned_bytes,omitempty"`
+}
+
+// ApiCaller is the weka management API, implemented by jrpc.Pool
+type ApiCaller interface {
+	Call(method weka.JrpcMethod, params, result interface{}) error
+}
+
+type OrchestratorCredentials struct {
+	AdminPassword      string
+	DeploymentUsername string
+	DeploymentPassword string
+}
+
+// Orchestrator runs the clusterization steps of the clusterize script through the management API, from the cloud
+// function rather than from the last backend. The backends must already run their containers, as deployed by
+// the deploy scripts. The bash hooks of ClusterParams (OBS, pre start-io and post setup scripts) and the KMS are
+// supported by the script only.
+type Orchestrator struct {
+	Params      ClusterParams
+	Devices     []string // the drives of each backend, as found by the find drives script
+	Credentials OrchestratorCredentials
+	Api         ApiCaller
+	State       *OrchestratorState                                        // resumed if set, Run creates it otherwise
+	Persist     func(ctx context.Context, state *OrchestratorState) error // called on every step status change
+	Hostname    string                                                    // of the ClusterState reports, defaults to the last VM
+	Preflight   *preflight.Params                                         // if set, the clusterization starts once the inventories pass the preflight
+
+	clusterState *protocol.ClusterState
+	currentStep  string // the step id of the reports
+}
+
+type orchestratorStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func (o *Orchestrator) steps() []orchestratorStep {
+	return []orchestratorStep{
+		{"cluster creation", o.createCluster},
+		{"deployment user", o.addDeploymentUser},
+		{"drives", o.addDrives},
+		{"cluster configuration", o.configureCluster},
+		{"start-io", o.startIo},
+		{"filesystems", o.createFilesystems},
+		{"alerts", o.muteAlerts},
+	}
+}
+
+// Validate checks the params are supported by the orchestrator
+func (o *Orchestrator) Validate() error {
+	var errs []error
+	if len(o.Params.VMNames) == 0 || len(o.Params.VMNames) != len(o.Params.IPs) {
+		errs = append(errs, fmt.Errorf("expected a vm name per ip"))
+	}
+	if o.Params.SetObs || o.Params.PreStartIoScript != "" || o.Params.PostClusterCreationScript != "" || o.Params.PostClusterSetupScript != "" {
+		errs = append(errs, fmt.Errorf("bash hooks are supported by the clusterize script only"))
+	}
+	if o.Params.Kms != nil {
+		errs = append(errs, fmt.Errorf("kms is supported by the clusterize script only"))
+	}
+	if len(o.Devices) == 0 {
+		errs = append(errs, fmt.Errorf("devices are empty"))
+	}
+	if o.Credentials.AdminPassword == "" || o.Credentials.DeploymentUsername == "" || o.Credentials.DeploymentPassword == "" {
+		errs = append(errs, fmt.Errorf("credentials are missing"))
+	}
+	layout := (&ClusterizeScriptGenerator{Params: o.Params}).containerLayout()
+	if err := layout.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("container layout: %w", err))
+	}
+	c := ClusterizeScriptGenerator{Params: o.Params}
+	if err := c.validateFilesystems(); err != nil {
+		errs = append(errs, fmt.Errorf("filesystems: %w", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+// Steps returns the status of the clusterization steps
+func (o *Orchestrator) Steps() []OrchestratorStep {
+	if o.State == nil {
+		var steps []OrchestratorStep
+		for _, step := range o.steps() {
+			steps = append(steps, OrchestratorStep{Name: step.name, Status: StepPending})
+		}
+		return steps
+	}
+	return slices.Clone(o.State.Steps)
+}
+
+func (o *Orchestrator) hostname() string {
+	if o.Hostname != "" {
+		return o.Hostname
+	}
+	return o.Params.VMNames[len(o.Params.VMNames)-1]
+}
+
+// Run runs the steps which are not done yet, reporting their progress and errors into clusterState as the clusterize
+// script does. It stops at the first failing step, a later Run retries it.
+func (o *Orchestrator) Run(ctx context.Context, clusterState *protocol.ClusterState) error {
+	logger := logging.LoggerFromCtx(ctx)
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if o.State == nil {
+		o.State = &OrchestratorState{Steps: o.Steps()}
+	}
+	for i, step := range o.steps() {
+		if len(o.State.Steps) != len(o.steps()) || o.State.Steps[i].Name != step.name {
+			return fmt.Errorf("orchestrator state steps don't match the clusterization steps")
+		}
+	}
+
+	o.clusterState = clusterState
+
+	// a resumed clusterization already passed the preflight
+	if o.Preflight != nil && o.State.Steps[0].Status != StepDone {
+		if err := preflight.Check(clusterState, *o.Preflight, nil); err != nil {
+			o.reportf("error", "%s", err)
+			return err
+		}
+	}
+
+	for i, step := range o.steps() {
+		state := &o.State.Steps[i]
+		if state.Status == StepDone {
+			continue
+		}
+		now := time.Now().UTC()
+		state.Status = StepRunning
+		state.Attempts++
+		state.StartedAt = &now
+		state.Error = ""
+		if err := o.persist(ctx); err != nil {
+			return err
+		}
+		o.currentStep = step.name
+		o.reportf("progress", "Running %s (%d/%d)", step.name, i+1, len(o.State.Steps))
+
+		err := step.run(ctx)
+		finished := time.Now().UTC()
+		state.FinishedAt = &finished
+		if err != nil {
+			logger.Error().Err(err).Msgf("clusterization step %s failed", step.name)
+			state.Status = StepFailed
+			state.Error = err.Error()
+			o.reportf("error", "Clusterization step %s failed: %s", step.name, err)
+			if persistErr := o.persist(ctx); persistErr != nil {
+				return persistErr
+			}
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+		state.Status = StepDone
+		if err = o.persist(ctx); err != nil {
+			return err
+		}
+	}
+
+	clusterState.Clusterized = true
+	o.reportf("progress", "Clusterization completed successfully")
+	return nil
+}
+
+func (o *Orchestrator) persist(ctx context.Context) error {
+	if o.Persist == nil {
+		return nil
+	}
+	return o.Persist(ctx, o.State)
+}
+
+// reportf adds a report of the orchestrator host to the ClusterState of the run
+func (o *Orchestrator) reportf(reportType, format string, args ...interface{}) {
+	o.hostReportf(o.hostname(), reportType, format, args...)
+}
+
+func (o *Orchestrator) hostReportf(hostname, reportType, format string, args ...interface{}) {
+	_ = report.UpdateReport(protocol.Report{
+		Type:     reportType,
+		Hostname: hostname,
+		Message:  fmt.Sprintf(format, args...),
+		Phase:    "clusterization",
+		Step:     o.currentStep,
+	}, o.clusterState)
+}
+
+func (o *Orchestrator) status() (status weka.StatusResponse, err error) {
+	err = o.Api.Call(weka.JrpcStatus, struct{}{}, &status)
+	return
+}
+
+func (o *Orchestrator) createCluster(ctx context.Context) error {
+	status, err := o.status()
+	if err == nil && status.IsCluster {
+		logging.LoggerFromCtx(ctx).Info().Msg("cluster already exists")
+		return nil
+	}
+
+	layout := (&ClusterizeScriptGenerator{Params: o.Params}).containerLayout()
+	var hostNames, hostIps []string
+	for i, ip := range o.Params.IPs {
+		for _, container := range layout.Containers {
+			hostNames = append(hostNames, fmt.Sprintf("%s-%s", o.Params.VMNames[i], container.Name))
+			hostIps = append(hostIps, fmt.Sprintf("%s:%d", ip, container.BasePort))
+		}
+	}
+	return o.Api.Call(weka.JrpcClusterCreate, types.JsonDict{
+		"host_names":     hostNames,
+		"host_ips":       hostIps,
+		"admin_password": o.Credentials.AdminPassword,
+	}, nil)
+}
+
+func (o *Orchestrator) addDeploymentUser(ctx context.Context) error {
+	var users weka.UserListResponse
+	if err := o.Api.Call(weka.JrpcUserList, struct{}{}, &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Username == o.Credentials.DeploymentUsername {
+			return nil
+		}
+	}
+	err := o.Api.Call(weka.JrpcUserAdd, types.JsonDict{
+		"username": o.Credentials.DeploymentUsername,
+		"password": o.Credentials.DeploymentPassword,
+		"role":     "clusteradmin",
+	}, nil)
+	if err == nil {
+		o.reportf("progress", "Deployment user was created successfully")
+	}
+	return err
+}
+
+// addDrives adds the devices of every backend to its drive containers, split between them as the clusterize
+// script does. Containers which already have drives are skipped.
+func (o *Orchestrator) addDrives(ctx context.Context) error {
+	layout := (&ClusterizeScriptGenerator{Params: o.Params}).containerLayout()
+	var driveContainers []string
+	for _, container := range layout.ByRole(protocol.DriveContainer) {
+		driveContainers = append(driveContainers, container.Name)
+	}
+
+	hosts := weka.HostListResponse{}
+	if err := o.Api.Call(weka.JrpcHostList, struct{}{}, &hosts); err != nil {
+		return err
+	}
+	drives := weka.DriveListResponse{}
+	if err := o.Api.Call(weka.JrpcDrivesList, struct{}{}, &drives); err != nil {
+		return err
+	}
+	withDrives := make(map[weka.HostId]bool)
+	for _, drive := range drives {
+		withDrives[drive.HostId] = true
+	}
+
+	failed := 0
+	for hostId, host := range hosts {
+		index := slices.Index(driveContainers, host.ContainerName)
+		if index < 0 || withDrives[hostId] {
+			continue
+		}
+		var devices []string
+		for k, device := range o.Devices {
+			if k%len(driveContainers) == index {
+				devices = append(devices, device)
+			}
+		}
+		err := o.Api.Call(weka.JrpcAddDrives, types.JsonDict{
+			"host_id":      hostId.String(),
+			"device_paths": devices,
+		}, nil)
+		if err != nil {
+			failed++
+			o.hostReportf(host.Hostname, "error", "Failed adding drives for drive container %s: %s Error: %s", hostId, strings.Join(devices, " "), err)
+			continue
+		}
+		o.reportf("progress", "Drives added successfully for %s", host.Hostname)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed adding drives for %d drive containers", failed)
+	}
+	return nil
+}
+
+func (o *Orchestrator) configureCluster(ctx context.Context) error {
+	params := types.JsonDict{"cluster_name": o.Params.ClusterName}
+	protection := o.Params.DataProtection
+	if protection.StripeWidth > 0 && protection.ProtectionLevel > 0 {
+		params["data_drives"] = protection.StripeWidth
+		params["parity_drives"] = protection.ProtectionLevel
+	}
+	// the raft council must keep quorum after losing ProtectionLevel leaders, see the clusterize script
+	if raftSize := 2*protection.ProtectionLevel + 1; raftSize > 5 {
+		params["bucket_raft_size"] = raftSize
+	}
+	if err := o.Api.Call(weka.JrpcClusterUpdate, params, nil); err != nil {
+		return err
+	}
+
+	if o.Params.ProxyUrl != "" {
+		if err := o.Api.Call(weka.JrpcCloudProxySet, types.JsonDict{"proxy": o.Params.ProxyUrl}, nil); err != nil {
+			return fmt.Errorf("failed to set the cloud proxy: %w", err)
+		}
+	}
+	cloudParams := types.JsonDict{}
+	if o.Params.WekaHomeUrl != "" {
+		cloudParams["cloud_url"] = o.Params.WekaHomeUrl
+	}
+	// weka home may be unreachable from a private network, as the clusterize script the failure is skipped
+	if err := o.Api.Call(weka.JrpcCloudEnable, cloudParams, nil); err != nil {
+		o.reportf("debug", "Failed to enable weka home: %s", err)
+	}
+
+	return o.Api.Call(weka.JrpcSetHotSpare, types.JsonDict{"hot_spare": protection.Hotspare}, nil)
+}
+
+func (o *Orchestrator) startIo(ctx context.Context) error {
+	status, err := o.status()
+	if err == nil && status.IoStatus == "STARTED" {
+		return nil
+	}
+	return o.Api.Call(weka.JrpcStartIo, struct{}{}, nil)
+}
+
+// createFilesystems creates the filesystem groups, .config_fs, Filesystems and the default filesystem, skipping
+// the existing ones
+func (o *Orchestrator) createFilesystems(ctx context.Context) error {
+	c := ClusterizeScriptGenerator{Params: o.Params}
+
+	groups := weka.FilesystemGroupListResponse{}
+	if err := o.Api.Call(weka.JrpcFilesystemGroupList, struct{}{}, &groups); err != nil {
+		return err
+	}
+	existingGroups := make(map[string]bool)
+	for _, group := range groups {
+		existingGroups[group.Name] = true
+	}
+	for _, group := range c.filesystemGroups() {
+		if existingGroups[group.Name] {
+			continue
+		}
+		err := o.Api.Call(weka.JrpcFilesystemGroupCreate, types.JsonDict{
+			"name":                 group.Name,
+			"target_ssd_retention": group.TargetSSDRetention,
+			"start_demote":         group.StartDemote,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create fs group %s: %w", group.Name, err)
+		}
+	}
+
+	filesystems := weka.FilesystemListResponse{}
+	if err := o.Api.Call(weka.JrpcFilesystemList, struct{}{}, &filesystems); err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, fs := range filesystems {
+		existing[fs.Name] = true
+	}
+	create := func(fs Filesystem, capacity int64) error {
+		if existing[fs.Name] {
+			return nil
+		}
+		params := types.JsonDict{
+			"name":           fs.Name,
+			"group_name":     fs.group(),
+			"total_capacity": capacity,
+			"encrypted":      fs.Encrypted,
+			"auth_required":  fs.AuthRequired,
+		}
+		if fs.ThinProvisioned {
+			params["ssd_capacity"] = 0
+			params["max_ssd_capacity"] = capacity
+		}
+		if err := o.Api.Call(weka.JrpcFilesystemCreate, params, nil); err != nil {
+			return fmt.Errorf("failed to create FS '%s': %w", fs.Name, err)
+		}
+		o.reportf("progress", "FS '%s' was created successfully", fs.Name)
+		return nil
+	}
+
+	if err := create(Filesystem{Name: ".config_fs"}, configFsCapacity); err != nil {
+		return err
+	}
+	if err := o.Api.Call(weka.JrpcNfsGlobalConfigSet, types.JsonDict{"config_fs": ".config_fs"}, nil); err != nil {
+		o.reportf("debug", "Failed to set NFS global config fs: %s", err)
+	}
+	if err := o.Api.Call(weka.JrpcDataServiceConfigSet, types.JsonDict{"config_fs": ".config_fs"}, nil); err != nil {
+		o.reportf("debug", "Failed to set data service global config fs: %s", err)
+	}
+
+	// percent capacities are of the capacity unprovisioned before creating any of the filesystems, a retry of the
+	// step must not take it again after some of them were created
+	if o.State.FilesystemsUnprovisionedBytes == 0 {
+		status, err := o.status()
+		if err != nil {
+			return err
+		}
+		o.State.FilesystemsUnprovisionedBytes = status.Capacity.UnprovisionedBytes
+		if err = o.persist(ctx); err != nil {
+			return err
+		}
+	}
+	for _, fs := range o.Params.Filesystems {
+		if err := create(fs, fs.bytes(o.State.FilesystemsUnprovisionedBytes)); err != nil {
+			return err
+		}
+	}
+
+	if o.Params.SetDefaultFs && !existing[defaultFilesystemName] {
+		status, err := o.status()
+		if err != nil {
+			return err
+		}
+		return create(Filesystem{Name: defaultFilesystemName}, status.Capacity.UnprovisionedBytes)
+	}
+	return nil
+}
+
+// muteAlerts mutes for a year the alerts expected of the network mode, as the clusterize script
+func (o *Orchestrator) muteAlerts(ctx context.Context) error {
+	alerts := []string{"JumboConnectivity", "UdpModePerformanceWarning"}
+	if o.Params.InstallDpdk {
+		alerts = []string{"NodeRDMANotActive"}
+	}
+	for _, alert := range alerts {
+		err := o.Api.Call(weka.JrpcAlertsMute, types.JsonDict{"alert_type": alert, "duration_secs": int64((365 * 24 * time.Hour).Seconds())}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to mute alert %s: %w", alert, err)
+		}
+	}
+	return nil
+}
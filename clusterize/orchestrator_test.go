@@ -0,0 +1,253 @@
+package clusterize
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/lib/types"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/preflight"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+type fakeApi struct {
+	responses map[weka.JrpcMethod]string
+	failures  map[weka.JrpcMethod]error // returned once
+	calls     []weka.JrpcMethod
+	params    map[weka.JrpcMethod][]interface{}
+}
+
+func (f *fakeApi) Call(method weka.JrpcMethod, params, result interface{}) error {
+	f.calls = append(f.calls, method)
+	f.params[method] = append(f.params[method], params)
+	if err, ok := f.failures[method]; ok {
+		delete(f.failures, method)
+		return err
+	}
+	if response, ok := f.responses[method]; ok && result != nil {
+		return json.Unmarshal([]byte(response), result)
+	}
+	return nil
+}
+
+func TestOrchestrator(t *testing.T) {
+	api := &fakeApi{
+		responses: map[weka.JrpcMethod]string{
+			weka.JrpcStatus:   `{"is_cluster": false, "io_status": "STOPPED", "capacity": {"unprovisioned_bytes": 1000000000000}}`,
+			weka.JrpcUserList: `[{"username": "admin", "role": "clusteradmin"}]`,
+			weka.JrpcHostList: `{
+				"HostId<0>": {"container_name": "drives0", "hostname": "weka-1"},
+				"HostId<1>": {"container_name": "compute0", "hostname": "weka-1"},
+				"HostId<3>": {"container_name": "drives0", "hostname": "weka-2"}
+			}`,
+			weka.JrpcDrivesList:          `{}`,
+			weka.JrpcFilesystemGroupList: `{}`,
+			weka.JrpcFilesystemList:      `{}`,
+		},
+		failures: map[weka.JrpcMethod]error{weka.JrpcStartIo: errors.New("not enough drives")},
+		params:   make(map[weka.JrpcMethod][]interface{}),
+	}
+	params := testParams()
+	params.Filesystems = []Filesystem{{Name: "home", Capacity: "25%"}, {Name: "scratch", Capacity: "10TB"}}
+	params.ProxyUrl = "http://proxy:8080"
+	params.InstallDpdk = true
+	// the running step attempts persisted, a step may persist its progress too
+	persisted := make(map[string]bool)
+	o := Orchestrator{
+		Params:      params,
+		Devices:     []string{"/dev/nvme0n1", "/dev/nvme1n1"},
+		Credentials: OrchestratorCredentials{AdminPassword: "admin", DeploymentUsername: "weka-deployment", DeploymentPassword: "secret"},
+		Api:         api,
+		Persist: func(ctx context.Context, state *OrchestratorState) error {
+			for _, step := range state.Steps {
+				if step.Status == StepRunning {
+					persisted[fmt.Sprintf("%s %d", step.Name, step.Attempts)] = true
+				}
+			}
+			return nil
+		},
+	}
+	state := &protocol.ClusterState{}
+
+	err := o.Run(context.Background(), state)
+	if err == nil || !strings.Contains(err.Error(), "not enough drives") {
+		t.Fatalf("expected start-io to fail, got %v", err)
+	}
+	steps := o.Steps()
+	if steps[3].Status != StepDone || steps[4].Status != StepFailed || steps[5].Status != StepPending {
+		t.Fatalf("unexpected steps %+v", steps)
+	}
+	if len(state.Errors["weka-3"]) != 1 || state.Clusterized {
+		t.Fatalf("expected a reported error, got %v", state.Errors)
+	}
+
+	// resumes from start-io
+	calls := len(api.calls)
+	if err = o.Run(context.Background(), state); err != nil {
+		t.Fatal(err)
+	}
+	if api.calls[calls] != weka.JrpcStatus || api.calls[calls+1] != weka.JrpcStartIo {
+		t.Errorf("expected to resume from start-io, got %v", api.calls[calls:])
+	}
+	if !state.Clusterized || o.State.Steps[4].Attempts != 2 {
+		t.Errorf("expected a clusterized state after 2 start-io attempts, got %+v", o.State.Steps)
+	}
+	if len(persisted) != 8 {
+		t.Errorf("expected a persisted running status per step attempt, got %d", len(persisted))
+	}
+
+	create := api.params[weka.JrpcClusterCreate][0].(types.JsonDict)
+	if names := create["host_names"].([]string); len(names) != 9 || names[8] != "weka-3-frontend0" {
+		t.Errorf("unexpected host names %v", names)
+	}
+	if len(api.params[weka.JrpcAddDrives]) != 2 || len(api.params[weka.JrpcUserAdd]) != 1 {
+		t.Errorf("expected drives added to 2 drive containers and a deployment user, got %v", api.calls)
+	}
+	var filesystems []string
+	for _, fsParams := range api.params[weka.JrpcFilesystemCreate] {
+		fs := fsParams.(types.JsonDict)
+		filesystems = append(filesystems, fs["name"].(string))
+		if fs["name"] == "home" && fs["total_capacity"] != int64(250000000000) {
+			t.Errorf("expected 25%% of the unprovisioned capacity, got %v", fs["total_capacity"])
+		}
+		if fs["name"] == "scratch" && fs["total_capacity"] != int64(10000000000000) {
+			t.Errorf("expected 10TB, got %v", fs["total_capacity"])
+		}
+	}
+	if strings.Join(filesystems, " ") != ".config_fs home scratch default" {
+		t.Errorf("unexpected filesystems %v", filesystems)
+	}
+	if proxy := api.params[weka.JrpcCloudProxySet]; len(proxy) != 1 || proxy[0].(types.JsonDict)["proxy"] != "http://proxy:8080" {
+		t.Errorf("expected the cloud proxy set, got %v", proxy)
+	}
+	if len(api.params[weka.JrpcCloudEnable]) != 1 || len(api.params[weka.JrpcDataServiceConfigSet]) != 1 {
+		t.Errorf("expected weka home enabled and the data service config fs set, got %v", api.calls)
+	}
+	if mutes := api.params[weka.JrpcAlertsMute]; len(mutes) != 1 || mutes[0].(types.JsonDict)["alert_type"] != "NodeRDMANotActive" {
+		t.Errorf("expected the RDMA alert muted with dpdk, got %v", mutes)
+	}
+}
+
+// capacityApi is a fakeApi whose unprovisioned capacity shrinks by the capacity of the created filesystems, and which
+// fails creating the failing filesystem once
+type capacityApi struct {
+	*fakeApi
+	unprovisionedBytes int64
+	filesystems        []string
+	failing            string
+}
+
+func (c *capacityApi) Call(method weka.JrpcMethod, params, result interface{}) error {
+	switch method {
+	case weka.JrpcStatus:
+		c.responses[method] = fmt.Sprintf(`{"is_cluster": true, "io_status": "STARTED", "capacity": {"unprovisioned_bytes": %d}}`, c.unprovisionedBytes)
+	case weka.JrpcFilesystemList:
+		var filesystems []string
+		for _, name := range c.filesystems {
+			filesystems = append(filesystems, fmt.Sprintf(`"%s": {"name": "%s"}`, name, name))
+		}
+		c.responses[method] = "{" + strings.Join(filesystems, ",") + "}"
+	case weka.JrpcFilesystemCreate:
+		fs := params.(types.JsonDict)
+		if fs["name"] == c.failing {
+			c.failing = ""
+			c.fakeApi.calls = append(c.fakeApi.calls, method)
+			return errors.New("fs create failed")
+		}
+		c.filesystems = append(c.filesystems, fs["name"].(string))
+		c.unprovisionedBytes -= fs["total_capacity"].(int64)
+	}
+	return c.fakeApi.Call(method, params, result)
+}
+
+func TestOrchestratorFilesystemsRetry(t *testing.T) {
+	api := &capacityApi{
+		fakeApi: &fakeApi{
+			responses: map[weka.JrpcMethod]string{
+				weka.JrpcUserList:            `[{"username": "weka-deployment", "role": "clusteradmin"}]`,
+				weka.JrpcHostList:            `{}`,
+				weka.JrpcDrivesList:          `{}`,
+				weka.JrpcFilesystemGroupList: `{"FsGroupId<0>": {"name": "default"}}`,
+			},
+			params: make(map[weka.JrpcMethod][]interface{}),
+		},
+		unprovisionedBytes: 1_022_000_000_000,
+		failing:            "data",
+	}
+	params := testParams()
+	params.SetDefaultFs = false
+	params.Filesystems = []Filesystem{{Name: "home", Capacity: "25%"}, {Name: "data", Capacity: "50%"}}
+	var persisted []int64
+	o := Orchestrator{
+		Params:      params,
+		Devices:     []string{"/dev/nvme0n1"},
+		Credentials: OrchestratorCredentials{AdminPassword: "admin", DeploymentUsername: "weka-deployment", DeploymentPassword: "secret"},
+		Api:         api,
+		Persist: func(ctx context.Context, state *OrchestratorState) error {
+			persisted = append(persisted, state.FilesystemsUnprovisionedBytes)
+			return nil
+		},
+	}
+	state := &protocol.ClusterState{}
+
+	// fails in the middle of the filesystems step, after creating home
+	err := o.Run(context.Background(), state)
+	if err == nil || !strings.Contains(err.Error(), "fs create failed") {
+		t.Fatalf("expected the filesystems step to fail, got %v", err)
+	}
+	if o.State.Steps[5].Status != StepFailed || strings.Join(api.filesystems, " ") != ".config_fs home" {
+		t.Fatalf("expected home to be created before the failure, got %+v %v", o.State.Steps[5], api.filesystems)
+	}
+	if o.State.FilesystemsUnprovisionedBytes != 1_000_000_000_000 || persisted[len(persisted)-1] != 1_000_000_000_000 {
+		t.Fatalf("expected the unprovisioned capacity after .config_fs to be persisted, got %d", o.State.FilesystemsUnprovisionedBytes)
+	}
+
+	// the retry takes data's percent of the capacity before home was created
+	if err = o.Run(context.Background(), state); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(api.filesystems, " ") != ".config_fs home data" {
+		t.Errorf("unexpected filesystems %v", api.filesystems)
+	}
+	for _, fsParams := range api.params[weka.JrpcFilesystemCreate] {
+		fs := fsParams.(types.JsonDict)
+		expected := map[string]int64{".config_fs": configFsCapacity, "home": 250_000_000_000, "data": 500_000_000_000}[fs["name"].(string)]
+		if fs["total_capacity"] != expected {
+			t.Errorf("expected %s of %d bytes, got %v", fs["name"], expected, fs["total_capacity"])
+		}
+	}
+}
+
+func TestOrchestratorPreflight(t *testing.T) {
+	api := &fakeApi{params: make(map[weka.JrpcMethod][]interface{})}
+	params := testParams()
+	o := Orchestrator{
+		Params:      params,
+		Devices:     []string{"/dev/nvme0n1"},
+		Credentials: OrchestratorCredentials{AdminPassword: "admin", DeploymentUsername: "weka-deployment", DeploymentPassword: "secret"},
+		Api:         api,
+		Preflight:   &preflight.Params{Hostnames: params.VMNames},
+	}
+	now := time.Now()
+	inventory := protocol.Inventory{Drives: []string{"/dev/nvme0n1"}, ClockUnixMs: now.UnixMilli(), ReceivedAt: now}
+	state := &protocol.ClusterState{Inventories: map[string]protocol.Inventory{"weka-1": inventory, "weka-2": inventory}}
+
+	err := o.Run(context.Background(), state)
+	if err == nil || !strings.Contains(err.Error(), "missing inventories of weka-3") {
+		t.Fatalf("expected the preflight to block the clusterization, got %v", err)
+	}
+	if len(api.calls) != 0 || o.State.Steps[0].Status != StepPending || len(state.Errors["weka-3"]) != 1 {
+		t.Errorf("expected a reported error and no step to run, got %v %+v", api.calls, o.State.Steps)
+	}
+
+	state.Inventories["weka-3"] = inventory
+	err = o.Run(context.Background(), state)
+	if len(api.calls) == 0 || o.State.Steps[0].Attempts != 1 {
+		t.Errorf("expected the clusterization to start once the preflight passes, got %v %v", err, api.calls)
+	}
+}
@@ -0,0 +1,54 @@
+package clusterize
+
+import (
+	"github.com/weka/go-cloud-lib/bash_functions"
+	"github.com/weka/go-cloud-lib/script"
+)
+
+const defaultFilesystemName = "default"
+
+// addProtocolGWSetup logs in to weka and resolves the weka container ids of the gateways (containersUid) into
+// container_ids, for the protocol cluster commands. It also defines wait_for_weka_fs, which waits for the filesystem
+// named by its argument.
+func addProtocolGWSetup(s *script.Builder) {
+	s.Function("set_backend_ip", bash_functions.SetBackendIpFunction()).Requires("fetch").
+		Section("", "set_backend_ip").Requires("set_backend_ip", "LOAD_BALANCER_IP").Provides("backend_ip").
+		Function("weka_rest", bash_functions.WekaRestFunction()).Requires("json_object")
+
+	s.Function("wait_for_weka_fs", `
+	function wait_for_weka_fs(){
+		filesystem_name="$1"
+		max_retries=30 # 30 * 10 = 5 minutes
+		for (( i=0; i < max_retries; i++ )); do
+			if [ "$(weka fs | grep -c -- "$filesystem_name")" -ge 1 ]; then
+				echo "$(date -u): weka filesystem $filesystem_name is up"
+				return
+			fi
+			echo "$(date -u): waiting for weka filesystem $filesystem_name to be up"
+			sleep 10
+		done
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Weka filesystem $filesystem_name is not up after 5 minutes")"
+		return 1
+	}
+	`).Requires("report", "json_object", "PROTOCOL")
+
+	s.Section("", `
+	set +x
+	fetch_result=$(fetch "{\"fetch_weka_credentials\": true}")
+	export WEKA_USERNAME="$(echo $fetch_result | jq -r .username)"
+	export WEKA_PASSWORD="$(echo $fetch_result | jq -r .password)"
+	weka user login $WEKA_USERNAME $WEKA_PASSWORD
+	set -x
+
+	container_ids=()
+	for container_uid in "${containersUid[@]}"; do
+		container_id=$(weka_rest containers | jq -r --arg uid "$container_uid" '.data[] | select(.uid == $uid) | .id' | grep -oP '\d+')
+		if [ -z "$container_id" ]; then
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Failed to find the container of uid $container_uid")"
+			exit 1
+		fi
+		container_ids+=("$container_id")
+	done
+	`).Requires("report", "json_object", "fetch", "weka_rest", "PROTOCOL", "containersUid", "backend_ip").
+		Provides("WEKA_USERNAME", "WEKA_PASSWORD", "container_ids")
+}
@@ -4,10 +4,13 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/bash_functions"
 	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
 )
 
 func ShuffleSlice(slice []string) {
@@ -26,12 +29,16 @@ func GetScriptWithReport(message, reportFunctionDef string, protocol protocol.Pr
 	# report function definition
 	%s
 
-	PROTOCOL="%s"
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"%s\"}"
+	# json_object bash function definition
+	%s
+
+	PROTOCOL=%s
+	MESSAGE=%s
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "$MESSAGE")"
 
-	echo "%s"
+	echo "$MESSAGE"
 	`
-	return fmt.Sprintf(dedent.Dedent(s), reportFunctionDef, protocol, message, message)
+	return fmt.Sprintf(dedent.Dedent(s), reportFunctionDef, bash_functions.JsonObjectFunction(), quote(string(protocol)), quote(message))
 }
 
 func GetErrorScript(err error, reportFunctionDef string, protocol protocol.ProtocolGW) string {
@@ -41,15 +48,22 @@ func GetErrorScript(err error, reportFunctionDef string, protocol protocol.Proto
 	# report function definition
 	%s
 
-	PROTOCOL="%s"
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"error\", \"message\": \"%s\"}"
-
-	<<'###ERROR'
+	# json_object bash function definition
 	%s
-	###ERROR
+
+	PROTOCOL=%s
+	ERROR=%s
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "$ERROR")"
+
 	exit 1
 	`
-	return fmt.Sprintf(dedent.Dedent(s), reportFunctionDef, protocol, err.Error(), err.Error())
+	return fmt.Sprintf(dedent.Dedent(s), reportFunctionDef, bash_functions.JsonObjectFunction(), quote(string(protocol)), quote(err.Error()))
+}
+
+// quote makes any message representable in the script, these scripts are the fallback for invalid input
+func quote(message string) string {
+	message = strings.ToValidUTF8(strings.ReplaceAll(message, "\x00", ""), "?")
+	return script.Quote(message)
 }
 
 func IsItemInList(item string, list []string) bool {
@@ -1,12 +1,28 @@
 package deploy
 
-import "github.com/weka/go-cloud-lib/protocol"
+import (
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
+)
 
 func (d *DeployScriptGenerator) GetDeployScript() string {
+	return d.build(d.deployScript())
+}
+
+func (d *DeployScriptGenerator) deployScript() *script.Builder {
 	if d.Params.Protocol == "" {
-		return d.GetBackendDeployScript()
+		return d.backendDeployScript()
 	} else if d.Params.Protocol == protocol.DATA {
-		return d.GetDataServiceDeployScript()
+		return d.dataServiceDeployScript()
+	}
+	return d.protocolGWDeployScript()
+}
+
+// Validate renders the deploy script and checks it statically, see script.Validate
+func (d *DeployScriptGenerator) Validate() error {
+	deployScript, err := d.deployScript().Build()
+	if err != nil {
+		return err
 	}
-	return d.GetProtocolGWDeployScript()
+	return script.Validate(deployScript)
 }
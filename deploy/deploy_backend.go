@@ -6,93 +6,57 @@ import (
 
 	"github.com/weka/go-cloud-lib/bash_functions"
 	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
 
 	"github.com/lithammer/dedent"
 )
 
 func (d *DeployScriptGenerator) GetBackendDeployScript() string {
-	wekaInstallScript := d.GetWekaInstallScript()
-	protectFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Protect)
-	clusterizeFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Clusterize)
-	reportFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Report)
+	return d.build(d.backendDeployScript())
+}
 
-	getCoreIdsFunc := bash_functions.GetCoreIds()
+func (d *DeployScriptGenerator) backendDeployScript() *script.Builder {
 	gateways := strings.Join(d.Params.Gateways, " ")
-	getNetStrForDpdkFunc := bash_functions.GetNetStrForDpdk(d.Params.IsBM, gateways)
-	getAllInterfaces := bash_functions.GetAllInterfaces()
-	failureDomainCmd := bash_functions.GetHashedPrivateIpBashCmd()
-
-	template := `
-	#!/bin/bash
-	set -ex
-	VM=%s
-	FAILURE_DOMAIN=$(%s)
-	COMPUTE_MEMORY=%s
-	COMPUTE_CONTAINER_CORES_NUM=%d
-	FRONTEND_CONTAINER_CORES_NUM=%d
-	DRIVE_CONTAINER_CORES_NUM=%d
-	NICS_NUM=%s
-	INSTALL_DPDK=%t
-
-	# clusterize function definition
-	%s
-
-	# protect function definition (if any)
-	%s
-
-	# report function definition
-	%s
-
-	# get_core_ids bash function definition
-	%s
-
-	# getNetStrForDpdk bash function definition
-	%s
-
-	# getAllInterfaces bash function definition
-	%s
-
-	# deviceNameCmd
-	wekaiosw_device="%s"
-	# wekio partition setup
-	%s
-
-	# install script
-	%s
-
+	layout := d.Params.InstanceParams.ContainerLayout()
+	if err := layout.Validate(); err != nil {
+		return script.New().Fail(fmt.Errorf("container layout: %w", err))
+	}
+
+	s := script.New().Shebang().Raw("set -ex\n").
+		Var("VM", d.Params.VMName).
+		Expr("FAILURE_DOMAIN", "$("+bash_functions.GetHashedPrivateIpBashCmd()+")").
+		Var("INSTALL_DPDK", d.Params.InstallDpdk).
+		Var("PROTOCOL", string(d.Params.Protocol)).
+		CloudFunctions(d.FuncDef, functions_def.Clusterize, functions_def.Protect, functions_def.Report).
+		Function("json_object", bash_functions.JsonObjectFunction()).
+		Function("get_core_ids", bash_functions.GetCoreIds()).
+		Function("getNetStrForDpdk", bash_functions.GetNetStrForDpdk(d.Params.IsBM, gateways)).Requires("getAllInterfaces").
+		Function("getAllInterfaces", bash_functions.GetAllInterfaces()).
+		Expr("wekaiosw_device", `"`+d.DeviceNameCmd+`"`).
+		Step("partition setup", "mountpoint -q /opt/weka").
+		Section("wekio partition setup", d.partitionSetup()).Requires("report", "json_object", "PROTOCOL", "wekaiosw_device").
+		EndStep().
+		Step("weka installation", "weka version current >/dev/null 2>&1").
+		Append(d.wekaInstallScript()).
+		EndStep()
+
+	s.Var("total_containers", len(layout.Containers))
+
+	containersRegex := strings.Join(layout.Names(), "|")
+	s.Step("weka containers setup", `[ "$(weka local ps | grep -cE '^(`+containersRegex+`)\s')" -eq "$total_containers" ]`).Requires("total_containers")
+	s.Section("", `
 	weka local stop
-	weka local rm default --force
-
-	# weka containers setup
-	get_core_ids $DRIVE_CONTAINER_CORES_NUM drive_core_ids
-	get_core_ids $COMPUTE_CONTAINER_CORES_NUM compute_core_ids
-
-	total_containers=2
+	weka local rm --all -f
 
 	getAllInterfaces
+	`).Requires("getAllInterfaces")
+	s.Section("", bash_functions.WekaContainersSetup(layout, "--failure-domain $FAILURE_DOMAIN", d.Params.NicsNum)).
+		Requires("get_core_ids", "getNetStrForDpdk", "INSTALL_DPDK", "FAILURE_DOMAIN")
+	s.EndStep()
 
-	if [[ $INSTALL_DPDK == true ]]; then
-		getNetStrForDpdk 1 $((1+$DRIVE_CONTAINER_CORES_NUM))
-		sudo weka local setup container --name drives0 --base-port 14000 --cores $DRIVE_CONTAINER_CORES_NUM --no-frontends --drives-dedicated-cores $DRIVE_CONTAINER_CORES_NUM --failure-domain $FAILURE_DOMAIN --core-ids $drive_core_ids --dedicate $net
-		getNetStrForDpdk $((1+$DRIVE_CONTAINER_CORES_NUM)) $((1+$DRIVE_CONTAINER_CORES_NUM+$COMPUTE_CONTAINER_CORES_NUM))
-		sudo weka local setup container --name compute0 --base-port 15000 --cores $COMPUTE_CONTAINER_CORES_NUM --no-frontends --compute-dedicated-cores $COMPUTE_CONTAINER_CORES_NUM  --memory $COMPUTE_MEMORY --failure-domain $FAILURE_DOMAIN --core-ids $compute_core_ids --dedicate $net
-	else
-		sudo weka local setup container --name drives0 --base-port 14000 --cores $DRIVE_CONTAINER_CORES_NUM --no-frontends --drives-dedicated-cores $DRIVE_CONTAINER_CORES_NUM --failure-domain $FAILURE_DOMAIN --core-ids $drive_core_ids --dedicate --net udp
-		sudo weka local setup container --name compute0 --base-port 15000 --cores $COMPUTE_CONTAINER_CORES_NUM --no-frontends --compute-dedicated-cores $COMPUTE_CONTAINER_CORES_NUM  --memory $COMPUTE_MEMORY --failure-domain $FAILURE_DOMAIN --core-ids $compute_core_ids --dedicate --net udp
-	fi
-
-	if [[ $FRONTEND_CONTAINER_CORES_NUM -gt 0 ]]; then
-		total_containers=3
-		get_core_ids $FRONTEND_CONTAINER_CORES_NUM frontend_core_ids
-		if [[ $INSTALL_DPDK == true ]]; then
-			getNetStrForDpdk $((1+$DRIVE_CONTAINER_CORES_NUM+$COMPUTE_CONTAINER_CORES_NUM)) $NICS_NUM
-			sudo weka local setup container --name frontend0 --base-port 16000 --cores $FRONTEND_CONTAINER_CORES_NUM --frontend-dedicated-cores $FRONTEND_CONTAINER_CORES_NUM --allow-protocols true --failure-domain $FAILURE_DOMAIN --core-ids $frontend_core_ids --dedicate $net
-		else
-			sudo weka local setup container --name frontend0 --base-port 16000 --cores $FRONTEND_CONTAINER_CORES_NUM --frontend-dedicated-cores $FRONTEND_CONTAINER_CORES_NUM --allow-protocols true --failure-domain $FAILURE_DOMAIN --core-ids $frontend_core_ids --dedicate --net udp
-		fi
-	fi
-
-	# should not call 'clusterize' until all 2/3 containers are up
+	s.Step("weka containers start", "")
+	s.Section("should not call 'clusterize' until all containers are up", `
 	ready_containers=0
 	while [[ $ready_containers -ne $total_containers ]];
 	do
@@ -101,30 +65,48 @@ func (d *DeployScriptGenerator) GetBackendDeployScript() string {
 		echo "Running containers: $ready_containers"
 	done
 
-	protect "{\"vm\": \"$VM\"}"
-	
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"Weka containers are ready\"}"
+	protect "$(json_object vm "$VM")"
+
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "Weka containers are ready")"
+	`).Requires("total_containers", "protect", "report", "json_object", "VM", "PROTOCOL")
+	s.EndStep()
 
-	mkdir -p /opt/weka/tmp
-	cat >/opt/weka/tmp/find_drives.py <<EOL%sEOL
-	devices=$(weka local run --container compute0 bash -ce 'wapi machine-query-info --info-types=DISKS -J | python3 /opt/weka/tmp/find_drives.py')
+	s.Var("compute_container", layout.ByRole(protocol.ComputeContainer)[0].Name)
+	// devices are found on every run, the following steps use them even when this one is already done
+	s.Section("find drives", d.writeFindDrivesScript()+dedent.Dedent(`	devices=$(weka local run --container $compute_container bash -ce 'wapi machine-query-info --info-types=DISKS -J | python3 /opt/weka/tmp/find_drives.py')
 	devices=($devices)
+	`)).Requires("compute_container").Provides("devices")
+	s.Step("drives discovery", "")
+	s.Section("wait for drives", `
 	for device in "${devices[@]}"; do
 		while ! lsblk "$device" >/dev/null 2>&1; do
 			echo "waiting for nvme to be ready"
 			sleep 5
 		done
 	done
-
-	clusterize "{\"name\": \"$VM\"}" > /tmp/clusterize.sh
+	`).Requires("devices")
+	s.EndStep()
+
+	s.Var("DPDK_DRIVERS", bash_functions.DpdkDrivers)
+	s.Function("report_inventory", bash_functions.ReportInventoryFunction()).Requires("report", "getAllInterfaces", "DPDK_DRIVERS", "PROTOCOL")
+	s.Step("preflight inventory", "")
+	s.Section("reported inventories are validated across the VMs before clusterization", `
+	report_inventory
+	`).Requires("report_inventory", "devices")
+	s.EndStep()
+
+	s.Step("clusterization", "")
+	s.Section("", `
+	clusterize "$(json_object name "$VM")" > /tmp/clusterize.sh
 	chmod +x /tmp/clusterize.sh
 	/tmp/clusterize.sh 2>&1 | tee /tmp/weka_clusterization.log
-	`
-	script := fmt.Sprintf(
-		template, d.Params.VMName, failureDomainCmd, d.Params.InstanceParams.ComputeMemory, d.Params.InstanceParams.Compute,
-		d.Params.InstanceParams.Frontend, d.Params.InstanceParams.Drive, d.Params.NicsNum, d.Params.InstallDpdk,
-		clusterizeFunc, protectFunc, reportFunc, getCoreIdsFunc, getNetStrForDpdkFunc, getAllInterfaces, d.DeviceNameCmd,
-		bash_functions.GetWekaPartitionScript(), wekaInstallScript, d.Params.FindDrivesScript,
-	)
-	return dedent.Dedent(script)
+	# tee succeeds anyway, a failed clusterization must fail the script
+	if [ "${PIPESTATUS[0]}" -ne 0 ]; then
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Clusterization failed, see /tmp/weka_clusterization.log")"
+		exit 1
+	fi
+	`).Requires("clusterize", "report", "json_object", "VM", "PROTOCOL")
+	s.EndStep()
+
+	return s
 }
@@ -0,0 +1,244 @@
+package deploy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/weka/go-cloud-lib/bash_functions"
+	"github.com/weka/go-cloud-lib/common"
+	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/script"
+)
+
+const DefaultClientMountPoint = "/mnt/weka"
+
+type ClientParams struct {
+	VMName           string
+	BackendIps       []string
+	FilesystemName   string
+	MountPoint       string // defaults to DefaultClientMountPoint
+	MountOptions     []string
+	FrontendCoresNum int // defaults to 1, with DPDK the client uses a NIC per core
+	InstallDpdk      bool
+	IsBM             bool
+	Gateways         []string
+	ProxyUrl         string
+	CgroupsMode      string
+}
+
+// ClientDeployScriptGenerator renders the scripts of weka clients: stateless frontends which install the agent from
+// a backend and mount a filesystem
+type ClientDeployScriptGenerator struct {
+	Params  ClientParams
+	FuncDef functions_def.FunctionDef
+}
+
+func (c *ClientDeployScriptGenerator) GetClientDeployScript() string {
+	return c.build(c.clientDeployScript())
+}
+
+func (c *ClientDeployScriptGenerator) GetClientTeardownScript() string {
+	return c.build(c.clientTeardownScript())
+}
+
+// Validate renders the client scripts and checks them statically, see script.Validate
+func (c *ClientDeployScriptGenerator) Validate() error {
+	for _, s := range []*script.Builder{c.clientDeployScript(), c.clientTeardownScript()} {
+		clientScript, err := s.Build()
+		if err != nil {
+			return err
+		}
+		if err = script.Validate(clientScript); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build renders the script, or a script reporting the error if it can't be rendered
+func (c *ClientDeployScriptGenerator) build(s *script.Builder) string {
+	clientScript, err := s.Build()
+	if err != nil {
+		return common.GetErrorScript(err, c.FuncDef.GetFunctionCmdDefinition(functions_def.Report), "")
+	}
+	return clientScript
+}
+
+func (c *ClientDeployScriptGenerator) mountPoint() string {
+	if c.Params.MountPoint == "" {
+		return DefaultClientMountPoint
+	}
+	return c.Params.MountPoint
+}
+
+func (c *ClientDeployScriptGenerator) checkParams() error {
+	var errs []error
+	if len(c.Params.BackendIps) == 0 {
+		errs = append(errs, fmt.Errorf("backend ips are empty"))
+	}
+	if c.Params.FilesystemName == "" {
+		errs = append(errs, fmt.Errorf("filesystem name is empty"))
+	}
+	if !strings.HasPrefix(c.mountPoint(), "/") {
+		errs = append(errs, fmt.Errorf("mount point %s is not an absolute path", c.mountPoint()))
+	}
+	if c.Params.FrontendCoresNum < 0 {
+		errs = append(errs, fmt.Errorf("frontend cores number is negative"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+func (c *ClientDeployScriptGenerator) clientDeployScript() *script.Builder {
+	if err := c.checkParams(); err != nil {
+		return script.New().Fail(err)
+	}
+
+	gateways := strings.Join(c.Params.Gateways, " ")
+	frontendCores := c.Params.FrontendCoresNum
+	if frontendCores == 0 {
+		frontendCores = 1
+	}
+	cgroupsMode := "auto"
+	if c.Params.CgroupsMode != "" {
+		cgroupsMode = c.Params.CgroupsMode
+	}
+
+	s := script.New().Shebang().Raw("set -ex\n").
+		Var("VM", c.Params.VMName).
+		Var("IPS", c.Params.BackendIps).
+		Var("FILESYSTEM_NAME", c.Params.FilesystemName).
+		Var("MOUNT_POINT", c.mountPoint()).
+		Var("MOUNT_OPTIONS", c.Params.MountOptions).
+		Var("FRONTEND_CORES_NUM", frontendCores).
+		Var("INSTALL_DPDK", c.Params.InstallDpdk).
+		Var("PROXY_URL", c.Params.ProxyUrl).
+		Var("WEKA_CGROUPS_MODE", cgroupsMode).
+		CloudFunctions(c.FuncDef, functions_def.Report, functions_def.Fetch).
+		Function("json_object", bash_functions.JsonObjectFunction()).
+		Function("get_core_ids", bash_functions.GetCoreIds()).
+		Function("getNetStrForDpdk", bash_functions.GetNetStrForDpdk(c.Params.IsBM, gateways)).Requires("getAllInterfaces").
+		Function("getAllInterfaces", bash_functions.GetAllInterfaces())
+
+	s.Section("", `
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Deploying weka client")"
+	`).Requires("report", "json_object")
+
+	s.Step("weka agent installation", "weka version current >/dev/null 2>&1")
+	s.Section("install the agent from a backend", `
+	installed=false
+	for backend_ip in "${IPS[@]}"; do
+		if curl --fail --insecure "https://$backend_ip:14000/dist/v1/install" -o install.sh; then
+			installed=true
+			break
+		fi
+	done
+	if [[ $installed != true ]]; then
+		report "$(json_object hostname "$HOSTNAME" type "error" message "Failed downloading weka agent from the backends")"
+		exit 1
+	fi
+	chmod +x install.sh
+	PROXY="$PROXY_URL" WEKA_CGROUPS_MODE="$WEKA_CGROUPS_MODE" ./install.sh
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Weka agent installation completed")"
+	`).Requires("report", "json_object", "IPS", "PROXY_URL", "WEKA_CGROUPS_MODE")
+	s.EndStep()
+
+	s.Step("filesystem mount", `mountpoint -q "$MOUNT_POINT"`).Requires("MOUNT_POINT")
+	s.Section("fetch weka credentials", `
+	set +x
+	fetch_result=$(fetch "{\"fetch_weka_credentials\": true}")
+	export WEKA_USERNAME="$(echo $fetch_result | jq -r .username)"
+	export WEKA_PASSWORD="$(echo $fetch_result | jq -r .password)"
+	set -x
+	`).Requires("fetch").Provides("WEKA_USERNAME", "WEKA_PASSWORD")
+
+	s.Section("mount options", `
+	options=()
+	get_core_ids $FRONTEND_CORES_NUM client_core_ids
+	for core_id in ${client_core_ids//,/ }; do
+		options+=("core=$core_id")
+	done
+
+	getAllInterfaces
+	if [[ $INSTALL_DPDK == true ]]; then
+		getNetStrForDpdk 1 $((1+$FRONTEND_CORES_NUM))
+		for nic in ${net//--net/}; do
+			options+=("net=$nic")
+		done
+	else
+		options+=(net=udp)
+	fi
+	options+=("${MOUNT_OPTIONS[@]}")
+	`).Requires("get_core_ids", "getNetStrForDpdk", "getAllInterfaces", "FRONTEND_CORES_NUM", "INSTALL_DPDK", "MOUNT_OPTIONS").
+		Provides("options")
+
+	s.Section("mount the filesystem", `
+	backends=$(IFS=, ;echo "${IPS[*]}")
+	set +x
+	weka user login "$WEKA_USERNAME" "$WEKA_PASSWORD" -H "${IPS[0]}"
+	set -x
+
+	mkdir -p "$MOUNT_POINT"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Mounting filesystem $FILESYSTEM_NAME on $MOUNT_POINT")"
+	if ! output=$(mount -t wekafs -o "$(IFS=, ;echo "${options[*]}")" "$backends/$FILESYSTEM_NAME" "$MOUNT_POINT" 2>&1); then
+		report "$(json_object hostname "$HOSTNAME" type "error" message "Failed mounting filesystem $FILESYSTEM_NAME: $output")"
+		exit 1
+	fi
+
+	# the mount is restored by fstab after a reboot, fstab fields escape spaces
+	fstab_mount_point=${MOUNT_POINT// /\\040}
+	if ! grep -qF " $fstab_mount_point wekafs " /etc/fstab; then
+		echo "$backends/$FILESYSTEM_NAME $fstab_mount_point wekafs $(IFS=, ;echo "${options[*]}"),_netdev,x-systemd.requires=weka-agent.service 0 0" >> /etc/fstab
+	fi
+	`).Requires("report", "json_object", "IPS", "FILESYSTEM_NAME", "MOUNT_POINT", "WEKA_USERNAME", "WEKA_PASSWORD", "options")
+	s.EndStep()
+
+	s.Section("", `
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Weka client $VM is ready, filesystem $FILESYSTEM_NAME is mounted on $MOUNT_POINT")"
+	`).Requires("report", "json_object", "VM", "FILESYSTEM_NAME", "MOUNT_POINT")
+
+	return s
+}
+
+// clientTeardownScript unmounts the filesystem, which removes the stateless client from the cluster
+func (c *ClientDeployScriptGenerator) clientTeardownScript() *script.Builder {
+	if err := c.checkParams(); err != nil {
+		return script.New().Fail(err)
+	}
+
+	s := script.New().Shebang().Raw("set -ex\n").
+		Var("VM", c.Params.VMName).
+		Var("MOUNT_POINT", c.mountPoint()).
+		CloudFunctions(c.FuncDef, functions_def.Report).
+		Function("json_object", bash_functions.JsonObjectFunction())
+
+	s.Section("", fmt.Sprintf(`
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Removing weka client $VM")"
+
+	if mountpoint -q "$MOUNT_POINT"; then
+		if ! umount "$MOUNT_POINT"; then
+			report "$(json_object hostname "$HOSTNAME" type "debug" message "Filesystem is busy, unmounting $MOUNT_POINT lazily")"
+			umount -l "$MOUNT_POINT"
+		fi
+	fi
+	fstab_mount_point=${MOUNT_POINT// /\\040}
+	fstab_status=0
+	grep -vF " $fstab_mount_point wekafs " /etc/fstab > /etc/fstab.weka || fstab_status=$?
+	# grep exits with 1 if no line is left, other failures must not replace /etc/fstab
+	if [ "$fstab_status" -le 1 ]; then
+		mv /etc/fstab.weka /etc/fstab
+	else
+		rm -f /etc/fstab.weka
+		report "$(json_object hostname "$HOSTNAME" type "error" message "Failed to remove $MOUNT_POINT from /etc/fstab")"
+	fi
+	weka local stop || true
+	weka local rm --all -f || true
+	rm -rf %s
+
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Weka client $VM was removed")"
+	`, script.StepsDir)).Requires("report", "json_object", "VM", "MOUNT_POINT")
+
+	return s
+}
@@ -1,48 +1,33 @@
 package deploy
 
 import (
-	"fmt"
-	"github.com/lithammer/dedent"
 	"github.com/weka/go-cloud-lib/bash_functions"
 	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/script"
 )
 
 func (d *DeployScriptGenerator) GetDataServiceDeployScript() string {
-	wekaInstallScript := d.GetWekaInstallScript()
-	protectFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Protect)
-	statusFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Status)
-	reportFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Report)
-	fetchFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Fetch)
-	setBackendIpFunc := bash_functions.SetBackendIpFunction()
-
-	template := `
-	#!/bin/bash
-	VM=%s
-	LOAD_BALANCER_IP="%s"
-
-	# protect function definition (if any)
-	%s
-
-	# fetch function definition
-	%s
-
-	# status function definition
-	%s
-
-	# report function definition
-	%s
-
-	# deviceNameCmd
-	wekaiosw_device="%s"
-	# wekio partition setup
-	%s
-
-	# install script
-	%s
-
-	# set_backend_ip bash function definition
-	%s
+	return d.build(d.dataServiceDeployScript())
+}
 
+func (d *DeployScriptGenerator) dataServiceDeployScript() *script.Builder {
+	s := script.New().Shebang().
+		Var("VM", d.Params.VMName).
+		Var("LOAD_BALANCER_IP", d.Params.LoadBalancerIP).
+		Var("PROTOCOL", string(d.Params.Protocol)).
+		CloudFunctions(d.FuncDef, functions_def.Protect, functions_def.Fetch, functions_def.Status, functions_def.Report).
+		Function("json_object", bash_functions.JsonObjectFunction()).
+		Expr("wekaiosw_device", `"`+d.DeviceNameCmd+`"`).
+		Step("partition setup", "mountpoint -q /opt/weka").
+		Section("wekio partition setup", d.partitionSetup()).Requires("report", "json_object", "PROTOCOL", "wekaiosw_device").
+		EndStep().
+		Step("weka installation", "weka version current >/dev/null 2>&1").
+		Append(d.wekaInstallScript()).
+		EndStep().
+		Function("set_backend_ip", bash_functions.SetBackendIpFunction()).Requires("fetch")
+
+	s.Step("weka data services container setup", `weka local ps | grep -E '^dataserv\s' | grep -qi running`)
+	s.Section("", `
 	weka local stop
 	weka local rm default --force
 
@@ -70,22 +55,11 @@ func (d *DeployScriptGenerator) GetDataServiceDeployScript() string {
 	weka local setup container --name dataserv --base-port 14000 --join-ips $join_ips  --only-dataserv-cores --memory 3.5GB --allow-mix-setting
 	echo "$(date -u): success to run weka data services container"
 
-	protect "{\"vm\": \"$VM\", \"protocol\": \"data\"}"
+	protect "$(json_object vm "$VM" protocol "data")"
 
 	echo "$(date -u): finished preparation for data services container"
-	`
-	script := fmt.Sprintf(
-		template,
-		d.Params.VMName,
-		d.Params.LoadBalancerIP,
-		protectFunc,
-		fetchFunc,
-		statusFunc,
-		reportFunc,
-		d.DeviceNameCmd,
-		bash_functions.GetWekaPartitionScript(),
-		wekaInstallScript,
-		setBackendIpFunc,
-	)
-	return dedent.Dedent(script)
+	`).Requires("protect", "status", "fetch", "json_object", "set_backend_ip", "VM", "LOAD_BALANCER_IP")
+	s.EndStep()
+
+	return s
 }
@@ -1,84 +1,47 @@
 package deploy
 
 import (
-	"fmt"
 	"strings"
 
-	"github.com/lithammer/dedent"
 	"github.com/weka/go-cloud-lib/bash_functions"
 	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/script"
 )
 
 func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
-	wekaInstallScript := d.GetWekaInstallScript()
-	protectFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Protect)
-	statusFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Status)
-	reportFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Report)
-	fetchFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Fetch)
+	return d.build(d.BaseProtocolGWDeployScriptBuilder())
+}
 
-	getCoreIdsFunc := bash_functions.GetCoreIds()
+// BaseProtocolGWDeployScriptBuilder returns the protocol gateway deployment script, for the caller to extend
+func (d *DeployScriptGenerator) BaseProtocolGWDeployScriptBuilder() *script.Builder {
 	gateways := strings.Join(d.Params.Gateways, " ")
-	getNetStrForDpdkFunc := bash_functions.GetNetStrForDpdk(d.Params.IsBM, gateways)
-	getAllInterfaces := bash_functions.GetAllInterfaces()
-
-	wekaRestFunc := bash_functions.WekaRestFunction()
-	setBackendIpFunc := bash_functions.SetBackendIpFunction()
-
-	template := `
-	#!/bin/bash
-	VM=%s
-	FRONTEND_CONTAINER_CORES_NUM=%d
-	INSTALL_DPDK=%t
-	LOAD_BALANCER_IP="%s"
-	SECONDARY_IPS_NUM=%d
-	PROTOCOL="%s"
-
-	# protect function definition (if any)
-	%s
-
-	# fetch function definition
-	%s
-
-	# status function definition
-	%s
-
-	# report function definition
-	%s
-
-	# get_core_ids bash function definition
-	%s
-
-	# getNetStrForDpdk bash function definition
-	%s
-
-	# getAllInterfaces bash function definition
-	%s
-
-	# deviceNameCmd
-	wekaiosw_device="%s"
-	# wekio partition setup
-	%s
-
-	# install script
-	%s
-
-	# weka rest function definition
-	%s
-
-	# set_backend_ip bash function definition
-	%s
-
-	getAllInterfaces
-	# set current management ip
-	%s
-
-	weka local stop
-	weka local rm default --force
-
-	# weka frontend setup
-	get_core_ids $FRONTEND_CONTAINER_CORES_NUM frontend_core_ids
 
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"waiting for WEKA cluster clusterization completion\"}"
+	s := script.New().Shebang().Raw("set -ex\n").
+		Var("VM", d.Params.VMName).
+		Var("FRONTEND_CONTAINER_CORES_NUM", d.Params.ProtocolGatewayFeCoresNum).
+		Var("INSTALL_DPDK", d.Params.InstallDpdk).
+		Var("LOAD_BALANCER_IP", d.Params.LoadBalancerIP).
+		Var("SECONDARY_IPS_NUM", d.Params.NFSSecondaryIpsNum).
+		Var("PROTOCOL", string(d.Params.Protocol)).
+		CloudFunctions(d.FuncDef, functions_def.Protect, functions_def.Fetch, functions_def.Status, functions_def.Report).
+		Function("json_object", bash_functions.JsonObjectFunction()).
+		Function("get_core_ids", bash_functions.GetCoreIds()).
+		Function("getNetStrForDpdk", bash_functions.GetNetStrForDpdk(d.Params.IsBM, gateways)).Requires("getAllInterfaces").
+		Function("getAllInterfaces", bash_functions.GetAllInterfaces()).
+		Expr("wekaiosw_device", `"`+d.DeviceNameCmd+`"`).
+		Step("partition setup", "mountpoint -q /opt/weka").
+		Section("wekio partition setup", d.partitionSetup()).Requires("report", "json_object", "PROTOCOL", "wekaiosw_device").
+		EndStep().
+		Step("weka installation", "weka version current >/dev/null 2>&1").
+		Append(d.wekaInstallScript()).
+		EndStep().
+		Function("weka_rest", bash_functions.WekaRestFunction()).Requires("json_object").
+		Function("set_backend_ip", bash_functions.SetBackendIpFunction()).Requires("fetch").
+		Section("set current management ip", "getAllInterfaces\n"+bash_functions.SetCurrentManagementIp()).
+		Requires("getAllInterfaces").Provides("current_mngmnt_ip")
+
+	s.Section("waiting for the weka cluster", `
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "waiting for WEKA cluster clusterization completion")"
 	clusterized=$(status "{\"type\": \"status\"}" | jq .clusterized)
 	while [ "$clusterized" != "true" ];
 	do
@@ -96,6 +59,15 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 	# set value for backend_ip variable
 	set_backend_ip
 	echo "(date -u): backend_ip: $backend_ip"
+	`).Requires("report", "json_object", "status", "fetch", "set_backend_ip", "LOAD_BALANCER_IP", "PROTOCOL").
+		Provides("WEKA_USERNAME", "WEKA_PASSWORD", "backend_ip", "ips_str")
+
+	s.Step("weka frontend setup", `weka local ps | grep -E '^frontend0\s' | grep -qi running`)
+	s.Section("", `
+	weka local stop
+	weka local rm --all -f
+
+	get_core_ids $FRONTEND_CONTAINER_CORES_NUM frontend_core_ids
 
 	if [[ $INSTALL_DPDK == true ]]; then
 		getNetStrForDpdk 1 $((1+$FRONTEND_CONTAINER_CORES_NUM))
@@ -111,7 +83,7 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 		join_ips=$LOAD_BALANCER_IP
 	fi
 
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"setting frontend0 container\"}"
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "setting frontend0 container")"
 	weka local setup container --name frontend0 --base-port 14000 --cores $FRONTEND_CONTAINER_CORES_NUM --frontend-dedicated-cores $FRONTEND_CONTAINER_CORES_NUM --allow-protocols true --core-ids $frontend_core_ids $net --dedicate --join-ips $join_ips
 	
 	echo "$(date -u): success to run weka frontend container"
@@ -127,17 +99,23 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 			break
 		fi
 		if [[ $elapsed -ge $timeout ]]; then
-			report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"error\", \"message\": \"frontend0 container did not become ready within ${timeout} seconds\"}"
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "frontend0 container did not become ready within ${timeout} seconds")"
 			exit 1
 		fi
-		report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"frontend0 container is not ready, going to sleep for 10 seconds\"}"
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "frontend0 container is not ready, going to sleep for 10 seconds")"
 		sleep 10
 		elapsed=$((elapsed + 10))
 	done
 
 	echo "$(date -u): frontend is up"
+	`).Requires(
+		"get_core_ids", "report", "json_object", "getNetStrForDpdk",
+		"FRONTEND_CONTAINER_CORES_NUM", "INSTALL_DPDK", "LOAD_BALANCER_IP", "PROTOCOL", "ips_str",
+	)
+	s.EndStep()
 
-	protect "{\"vm\": \"$VM\", \"protocol\": \"$PROTOCOL\"}"
+	s.Section("frontend0 container registration", `
+	protect "$(json_object vm "$VM" protocol "$PROTOCOL")"
 	set +x
 	echo "$(date -u): try to run weka login command"
 	weka user login $WEKA_USERNAME $WEKA_PASSWORD
@@ -155,7 +133,7 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 	max_retries=30 # 30 * 10 = 5 minutes
 	for ((i=0; i<max_retries; i++)); do
 		container_uid=$(weka_rest containers | jq .data | jq -r --arg HOSTNAME "$HOSTNAME" '.[] | select ( .container_name == "frontend0" and .status == "UP" and .hostname == $HOSTNAME )' | jq -r '.uid')
-		container_id=$(weka_rest containers | jq .data | jq -r --arg HOSTNAME "$HOSTNAME" '.[] | select ( .container_name == "frontend0" and .status == "UP" and .hostname == $HOSTNAME )' | jq -r .id | grep -oP '\d+')
+		container_id=$(weka_rest containers | jq .data | jq -r --arg HOSTNAME "$HOSTNAME" '.[] | select ( .container_name == "frontend0" and .status == "UP" and .hostname == $HOSTNAME )' | jq -r .id | grep -oP '\d+' || true)
 		if [ -n "$container_uid" ]; then
 			echo "$(date -u): frontend0 container uid: $container_uid (container id: $container_id)"
 			break
@@ -166,19 +144,22 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 	if [ -z "$container_uid" ]; then
 		msg="Failed to get the frontend0 container UID."
 		echo "$(date -u): $msg"
-		report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"error\", \"message\": \"$msg\"}"
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "$msg")"
 		exit 1
 	fi
+	`).Requires("protect", "report", "json_object", "weka_rest", "VM", "PROTOCOL", "WEKA_USERNAME", "WEKA_PASSWORD", "current_mngmnt_ip").
+		Provides("nic_name", "container_uid", "container_id")
 
+	s.Var("primary_ip_cmd", d.Params.GetPrimaryIpCmd)
+	s.Section("", `
 	# get real primary ip from cloud metadata
 	# NOTE: in Azure there are situations where the primary ip is not shown as primary in ip addr
-	primary_ip_cmd="%s"
 	if [ -n "$primary_ip_cmd" ]; then
 		primary_ip=$(eval $primary_ip_cmd)
 
 		# make primary ip the management ip for the weka container
 		if [ "$current_mngmnt_ip" != "$primary_ip" ]; then
-			report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"updating frontend0 container (id:$container_id) management IP $current_mngmnt_ip --> $primary_ip\"}"
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "updating frontend0 container (id:$container_id) management IP $current_mngmnt_ip --> $primary_ip")"
 			weka cluster container management-ips $container_id $primary_ip
 			weka cluster container apply $container_id -f
 
@@ -196,19 +177,21 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 			if [ "$status" != "UP" ]; then
 				msg="Failed to wait for the frontend0 container status to be UP"
 				echo "$(date -u): $msg"
-				report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"error\", \"message\": \"$msg\"}"
+				report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "$msg")"
 				exit 1
 			fi
 		fi
 	fi
 
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"frontend0 container $container_id is up\"}"
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "frontend0 container $container_id is up")"
 	echo "$(date -u): finished preparation for protocol setup"
+	`).Requires("report", "json_object", "primary_ip_cmd", "current_mngmnt_ip", "container_id")
 
+	s.Section("protocol setup validation", `
 	echo "$(date -u): running validation for setting protocol script"
 	config_filesystem_name=".config_fs"
 	function wait_for_config_fs(){
-	  report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"validating $config_filesystem_name fs is set\"}"
+	  report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "validating $config_filesystem_name fs is set")"
 	  max_retries=30 # 30 * 10 = 5 minutes
 	  for (( i=0; i < max_retries; i++ )); do
 		if [ "$(weka fs | grep -c $config_filesystem_name)" -ge 1 ]; then
@@ -221,13 +204,13 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 	  if (( i > max_retries )); then
 		  err_msg="timeout: weka filesystem $config_filesystem_name is not up after $max_retries attempts."
 		  echo "$(date -u): $err_msg"
-		  report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"error\", \"message\": \"$err_msg\"}"
+		  report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "$err_msg")"
 		  return 1
 	  fi
 	}
 
 	# make sure weka cluster is already up
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"validating weka cluster status is OK\"}"
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "validating weka cluster status is OK")"
 	max_retries=60
 	for (( i=0; i < max_retries; i++ )); do
 	  if [ "$(weka status -J 2>/dev/null | jq -r .status)" == "OK" ]; then
@@ -240,7 +223,7 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 	if (( i > max_retries )); then
 		err_msg="timeout: weka cluster is not up after $max_retries attempts."
 		echo "$(date -u): $err_msg"
-		report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"error\", \"message\": \"$err_msg\"}"
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "$err_msg")"
 		exit 1
 	fi
 
@@ -248,46 +231,29 @@ func (d *DeployScriptGenerator) GetBaseProtocolGWDeployScript() string {
 	if [ "$PROTOCOL" != "nfs" ]; then
 		wait_for_config_fs
 	fi
-	`
-	script := fmt.Sprintf(
-		template,
-		d.Params.VMName,
-		d.Params.ProtocolGatewayFeCoresNum,
-		d.Params.InstallDpdk,
-		d.Params.LoadBalancerIP,
-		d.Params.NFSSecondaryIpsNum,
-		d.Params.Protocol,
-		protectFunc,
-		fetchFunc,
-		statusFunc,
-		reportFunc,
-		getCoreIdsFunc,
-		getNetStrForDpdkFunc,
-		getAllInterfaces,
-		d.DeviceNameCmd,
-		bash_functions.GetWekaPartitionScript(),
-		wekaInstallScript,
-		wekaRestFunc,
-		setBackendIpFunc,
-		bash_functions.SetCurrentManagementIp(),
-		d.Params.GetPrimaryIpCmd,
-	)
-	return dedent.Dedent(script)
-}
 
-func (d *DeployScriptGenerator) GetProtocolGWDeployScript() string {
-	baseDeploymentScript := d.GetBaseProtocolGWDeployScript()
-	clusterizeFunc := d.FuncDef.GetFunctionCmdDefinition(functions_def.Clusterize)
+	`).Requires("report", "json_object", "PROTOCOL")
 
-	template := `
-	# clusterize function definition
-	%s
+	return s
+}
 
-	clusterize "{\"name\": \"$VM\", \"protocol\": \"$PROTOCOL\", \"container_uid\": \"$container_uid\", \"nic_name\": \"$nic_name\"}" > /tmp/clusterize.sh
-	chmod +x /tmp/clusterize.sh
-	/tmp/clusterize.sh 2>&1 | tee /tmp/weka_clusterization.log
-	`
-	script := fmt.Sprintf(template, clusterizeFunc)
+func (d *DeployScriptGenerator) GetProtocolGWDeployScript() string {
+	return d.build(d.protocolGWDeployScript())
+}
 
-	return baseDeploymentScript + dedent.Dedent(script)
+func (d *DeployScriptGenerator) protocolGWDeployScript() *script.Builder {
+	return d.BaseProtocolGWDeployScriptBuilder().
+		CloudFunctions(d.FuncDef, functions_def.Clusterize).
+		Step("clusterization", "").
+		Section("", `
+		clusterize "$(json_object name "$VM" protocol "$PROTOCOL" container_uid "$container_uid" nic_name "$nic_name")" > /tmp/clusterize.sh
+		chmod +x /tmp/clusterize.sh
+		/tmp/clusterize.sh 2>&1 | tee /tmp/weka_clusterization.log
+		# tee succeeds anyway, a failed clusterization must fail the script
+		if [ "${PIPESTATUS[0]}" -ne 0 ]; then
+			report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "error" message "Clusterization failed, see /tmp/weka_clusterization.log")"
+			exit 1
+		fi
+		`).Requires("clusterize", "report", "json_object", "VM", "PROTOCOL", "container_uid", "nic_name").
+		EndStep()
 }
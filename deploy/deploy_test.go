@@ -0,0 +1,217 @@
+package deploy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
+	"github.com/weka/go-cloud-lib/script/scripttest"
+)
+
+func testParams() DeploymentParams {
+	return DeploymentParams{
+		VMName:                    "weka-backend-1",
+		InstanceParams:            protocol.BackendCoreCount{Compute: 2, Frontend: 1, Drive: 1, ComputeMemory: "10GB"},
+		WekaInstallUrl:            "https://get.weka.io/dist/v1/install/4.2.0/4.2.0",
+		WekaToken:                 "token",
+		InstallDpdk:               true,
+		NicsNum:                   "4",
+		FindDrivesScript:          "\nimport json\n",
+		Gateways:                  []string{"10.0.0.1", "10.0.1.1"},
+		GetPrimaryIpCmd:           "hostname -I | awk '{print $1}'",
+		ProtocolGatewayFeCoresNum: 1,
+		NFSSecondaryIpsNum:        2,
+	}
+}
+
+func TestDeployScripts(t *testing.T) {
+	tests := map[string]func(*DeploymentParams){
+		"backend":            func(p *DeploymentParams) {},
+		"backend_udp":        func(p *DeploymentParams) { p.InstallDpdk = false },
+		"backend_no_fe":      func(p *DeploymentParams) { p.InstanceParams.Frontend = 0 },
+		"backend_tar":        func(p *DeploymentParams) { p.WekaInstallUrl = "s3://bucket/weka-4.2.0.tar" },
+		"backend_proxy":      func(p *DeploymentParams) { p.ProxyUrl = "http://proxy:8080"; p.CgroupsMode = "none" },
+		"backend_bm":         func(p *DeploymentParams) { p.IsBM = true },
+		"backend_many_nics":  func(p *DeploymentParams) { p.NicsNum = "8" },
+		"nfs":                func(p *DeploymentParams) { p.Protocol = protocol.NFS },
+		"nfs_load_balancer":  func(p *DeploymentParams) { p.Protocol = protocol.NFS; p.LoadBalancerIP = "10.0.0.100" },
+		"smb":                func(p *DeploymentParams) { p.Protocol = protocol.SMB },
+		"smbw":               func(p *DeploymentParams) { p.Protocol = protocol.SMBW },
+		"s3":                 func(p *DeploymentParams) { p.Protocol = protocol.S3 },
+		"data":               func(p *DeploymentParams) { p.Protocol = protocol.DATA },
+		"backend_name_quote": func(p *DeploymentParams) { p.VMName = `weka "$(reboot)"'` },
+		"backend_converged":  func(p *DeploymentParams) { p.InstanceParams.Converged = true; p.InstanceParams.ComputeMemory = "" },
+		"backend_layout": func(p *DeploymentParams) {
+			p.NicsNum = "12"
+			p.InstanceParams.Layout = (&protocol.ContainerLayout{}).
+				Add(protocol.DriveContainer, 2, 2, "").
+				Add(protocol.ComputeContainer, 2, 3, "20GB").
+				Add(protocol.FrontendContainer, 1, 1, "")
+		},
+	}
+
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			params := testParams()
+			modify(&params)
+			d := DeployScriptGenerator{DeviceNameCmd: "/dev/sdb", Params: params, FuncDef: scripttest.FunctionDef{}}
+
+			if err := d.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			deployScript := d.GetDeployScript()
+			checkPipelines(t, deployScript)
+			scripttest.CheckGolden(t, name, deployScript)
+		})
+	}
+}
+
+// checkPipelines checks the exit status of the logged commands is checked, as the scripts don't set pipefail
+func checkPipelines(t *testing.T, deployScript string) {
+	lines := strings.Split(deployScript, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "| tee ") && (i+2 >= len(lines) || !strings.Contains(lines[i+2], "PIPESTATUS[0]")) {
+			t.Errorf("exit status of %q isn't checked", strings.TrimSpace(line))
+		}
+	}
+}
+
+// a resumed run skips the done steps, what a step uses must be set outside of the done ones
+func TestBackendDevicesOutsideSteps(t *testing.T) {
+	d := DeployScriptGenerator{DeviceNameCmd: "/dev/sdb", Params: testParams(), FuncDef: scripttest.FunctionDef{}}
+	inStep := false
+	found := false
+	for _, line := range strings.Split(d.GetBackendDeployScript(), "\n") {
+		switch {
+		case strings.HasPrefix(line, "if [ -f "+script.StepsDir+"/"):
+			inStep = true
+		case strings.HasPrefix(line, "mkdir -p "+script.StepsDir):
+			inStep = false
+		case strings.HasPrefix(line, "devices=("):
+			found = true
+			if inStep {
+				t.Errorf("devices are set inside a step")
+			}
+		}
+	}
+	if !found {
+		t.Error("devices aren't set")
+	}
+}
+
+func TestClientScripts(t *testing.T) {
+	tests := map[string]func(*ClientParams){
+		"client":     func(p *ClientParams) {},
+		"client_udp": func(p *ClientParams) { p.InstallDpdk = false; p.MountPoint = "/mnt/data dir" },
+		"client_options": func(p *ClientParams) {
+			p.FrontendCoresNum = 2
+			p.MountOptions = []string{"readcache", "acl"}
+		},
+	}
+
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			params := ClientParams{
+				VMName:         "weka-client-1",
+				BackendIps:     []string{"10.0.0.2", "10.0.0.3"},
+				FilesystemName: "default",
+				InstallDpdk:    true,
+				Gateways:       []string{"10.0.0.1"},
+			}
+			modify(&params)
+			c := ClientDeployScriptGenerator{Params: params, FuncDef: scripttest.FunctionDef{}}
+
+			if err := c.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			scripttest.CheckGolden(t, name, c.GetClientDeployScript())
+			scripttest.CheckGolden(t, name+"_teardown", c.GetClientTeardownScript())
+		})
+	}
+
+	c := ClientDeployScriptGenerator{Params: ClientParams{BackendIps: []string{"10.0.0.2"}}, FuncDef: scripttest.FunctionDef{}}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "filesystem name is empty") {
+		t.Errorf("expected validation error, got %v", err)
+	}
+}
+
+func TestDeployInvalidLayout(t *testing.T) {
+	params := testParams()
+	params.InstanceParams.Layout = (&protocol.ContainerLayout{}).Add(protocol.ComputeContainer, 1, 2, "")
+	d := DeployScriptGenerator{DeviceNameCmd: "/dev/sdb", Params: params, FuncDef: scripttest.FunctionDef{}}
+
+	if err := d.Validate(); err == nil || !strings.Contains(err.Error(), "no drive container") {
+		t.Errorf("expected layout error, got %v", err)
+	}
+}
+
+func TestDeployCloudConfig(t *testing.T) {
+	for _, p := range []protocol.ProtocolGW{"", protocol.NFS, protocol.DATA} {
+		params := testParams()
+		params.Protocol = p
+		d := DeployScriptGenerator{DeviceNameCmd: "/dev/sdb", Params: params, FuncDef: scripttest.FunctionDef{}}
+
+		cloudConfig, err := d.GetDeployCloudConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(cloudConfig, "#cloud-config\n") || !strings.Contains(cloudConfig, deployUnitName) {
+			t.Fatalf("unexpected cloud-config:\n%s", cloudConfig)
+		}
+
+		if !strings.Contains(cloudConfig, "path: "+deployScriptPath+"\n    permissions: '0700'\n    owner: root:root\n") {
+			t.Errorf("protocol %q: the deploy script is readable by other users than root", p)
+		}
+		deployScript := decodeFile(t, cloudConfig, deployScriptPath)
+		if strings.Contains(deployScript, "handle_error()") || strings.Contains(deployScript, "cat >/opt/weka/tmp/find_drives.py") {
+			t.Errorf("protocol %q: static helpers are inlined in the deploy script", p)
+		}
+		if err = script.Validate(deployScript); err != nil {
+			t.Errorf("protocol %q: %v", p, err)
+		}
+		if partitionScript := decodeFile(t, cloudConfig, partitionScriptPath); !strings.Contains(partitionScript, "mkfs.ext4") {
+			t.Errorf("protocol %q: unexpected partition script:\n%s", p, partitionScript)
+		}
+	}
+}
+
+func TestDeployMultipartUserData(t *testing.T) {
+	d := DeployScriptGenerator{DeviceNameCmd: "/dev/sdb", Params: testParams(), FuncDef: scripttest.FunctionDef{}}
+	userData, err := d.GetDeployMultipartUserData(UserDataPart{ContentType: "text/x-shellscript", Filename: "extra.sh", Content: "#!/bin/bash\necho extra\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Content-Type: multipart/mixed", "Content-Type: text/cloud-config", "#cloud-config", "echo extra", "--" + multipartBoundary + "--"} {
+		if !strings.Contains(userData, expected) {
+			t.Errorf("user data does not contain %q", expected)
+		}
+	}
+}
+
+// decodeFile returns the content of a gz+b64 encoded file of write_files
+func decodeFile(t *testing.T, cloudConfig, path string) string {
+	t.Helper()
+	match := regexp.MustCompile(`path: ` + regexp.QuoteMeta(path) + `\n(?:    .*\n)*?    content: (\S+)`).FindStringSubmatch(cloudConfig)
+	if match == nil {
+		t.Fatalf("%s is not written by the cloud-config", path)
+	}
+	compressed, err := base64.StdEncoding.DecodeString(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
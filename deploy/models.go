@@ -1,12 +1,13 @@
 package deploy
 
 import (
-	"fmt"
 	"strings"
 
-	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/bash_functions"
+	"github.com/weka/go-cloud-lib/common"
 	"github.com/weka/go-cloud-lib/functions_def"
 	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
 )
 
 type DeploymentParams struct {
@@ -33,54 +34,55 @@ type DeployScriptGenerator struct {
 	DeviceNameCmd string
 	Params        DeploymentParams
 	FuncDef       functions_def.FunctionDef
+	// helperFiles is set when rendering user data, the static helpers are then written as files by cloud-init
+	helperFiles bool
 }
 
 func (d *DeployScriptGenerator) GetWekaInstallScript() string {
-	installUrl := d.Params.WekaInstallUrl
-	reportFuncDef := d.FuncDef.GetFunctionCmdDefinition(functions_def.Report)
+	return d.build(d.wekaInstallScript())
+}
+
+// build renders the script, or a script reporting the error if it can't be rendered
+func (d *DeployScriptGenerator) build(s *script.Builder) string {
+	deployScript, err := s.Build()
+	if err != nil {
+		return common.GetErrorScript(err, d.FuncDef.GetFunctionCmdDefinition(functions_def.Report), d.Params.Protocol)
+	}
+	return deployScript
+}
 
-	installScriptTemplate := `
-	# report function definition
-	%s
-	TOKEN="%s"
-	INSTALL_URL="%s"
-	PROXY_URL="%s"
-	PROTOCOL="%s"
-	WEKA_CGROUPS_MODE="%s"
-	`
+func (d *DeployScriptGenerator) wekaInstallScript() *script.Builder {
+	installUrl := d.Params.WekaInstallUrl
 
 	cgroupsMode := "auto"
 	if d.Params.CgroupsMode != "" {
 		cgroupsMode = d.Params.CgroupsMode
 	}
 
-	installScript := fmt.Sprintf(
-		installScriptTemplate,
-		reportFuncDef,
-		d.Params.WekaToken,
-		installUrl,
-		d.Params.ProxyUrl,
-		d.Params.Protocol,
-		cgroupsMode,
-	)
+	s := script.New().
+		CloudFunctions(d.FuncDef, functions_def.Report).
+		Function("json_object", bash_functions.JsonObjectFunction()).
+		Var("TOKEN", d.Params.WekaToken).
+		Var("INSTALL_URL", installUrl).
+		Var("PROXY_URL", d.Params.ProxyUrl).
+		Var("PROTOCOL", string(d.Params.Protocol)).
+		Var("WEKA_CGROUPS_MODE", cgroupsMode)
 
 	if strings.HasSuffix(installUrl, ".tar") || strings.Contains(installUrl, ".tar?") {
 		split := strings.Split(installUrl, "?")
 		split = strings.Split(split[0], "/")
 		tarName := split[len(split)-1]
 		packageName := strings.TrimSuffix(tarName, ".tar")
-		installTemplate := `
-		TAR_NAME=%s
-		PACKAGE_NAME=%s
-
-		gsutil cp "$INSTALL_URL" /tmp || aws s3 cp "$INSTALL_URL" /tmp || wget "$INSTALL_URL" -O /tmp/$TAR_NAME
-		cd /tmp
-		tar -xvf $TAR_NAME
-		cd $PACKAGE_NAME
-		`
-		installScript += fmt.Sprintf(installTemplate, tarName, packageName)
+		s.Var("TAR_NAME", tarName).
+			Var("PACKAGE_NAME", packageName).
+			Section("download weka package", `
+			gsutil cp "$INSTALL_URL" /tmp || aws s3 cp "$INSTALL_URL" /tmp || wget "$INSTALL_URL" -O /tmp/$TAR_NAME
+			cd /tmp
+			tar -xvf $TAR_NAME
+			cd $PACKAGE_NAME
+			`).Requires("INSTALL_URL", "TAR_NAME", "PACKAGE_NAME")
 	} else {
-		installScript += `
+		s.Function("retry", `
 		# https://gist.github.com/fungusakafungus/1026804
 		function retry {
 			local retry_max=$1
@@ -99,15 +101,15 @@ func (d *DeployScriptGenerator) GetWekaInstallScript() string {
 			}
 			return 0
 		}
-
-		report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"Downloading weka install script\"}"
+		`).Section("download weka install script", `
+		report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "Downloading weka install script")"
 		retry 300 2 curl --fail --proxy "$PROXY_URL" --max-time 10 "$INSTALL_URL" -o install.sh
-		`
+		`).Requires("retry", "report", "json_object", "PROTOCOL", "PROXY_URL", "INSTALL_URL")
 	}
 
-	installScript += `
+	s.Section("install weka", `
 	chmod +x install.sh
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"Installing weka\"}"
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "Installing weka")"
 	status_code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT http://169.254.169.254/latest/api/token -H 'X-aws-ec2-metadata-token-ttl-seconds: 21600')
 	if [[ "$status_code" -eq 200 ]] ; then
 		echo "Succeeded to get aws token"
@@ -117,8 +119,8 @@ func (d *DeployScriptGenerator) GetWekaInstallScript() string {
 		sed -i '/no_proxy/d' install.sh
 	fi
 	PROXY="$PROXY_URL" WEKA_CGROUPS_MODE="$WEKA_CGROUPS_MODE" ./install.sh
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"$PROTOCOL\", \"type\": \"progress\", \"message\": \"Weka software installation completed\"}"
-	`
+	report "$(json_object hostname "$HOSTNAME" protocol "$PROTOCOL" type "progress" message "Weka software installation completed")"
+	`).Requires("report", "json_object", "PROTOCOL", "PROXY_URL", "WEKA_CGROUPS_MODE")
 
-	return dedent.Dedent(installScript)
+	return s
 }
@@ -0,0 +1,168 @@
+package deploy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/bash_functions"
+)
+
+// static helpers are written out of /opt/weka, which the deploy script mounts over
+const (
+	userDataDir          = "/usr/local/lib/weka-deploy"
+	findDrivesScriptPath = userDataDir + "/find_drives.py"
+	partitionScriptPath  = userDataDir + "/partition.sh"
+	deployScriptPath     = userDataDir + "/deploy.sh"
+	deployCompletedPath  = userDataDir + "/completed"
+	deployUnitName       = "weka-deploy.service"
+	deployUnitPath       = "/etc/systemd/system/" + deployUnitName
+	multipartBoundary    = "WEKA-DEPLOY-USER-DATA"
+)
+
+// UserDataPart is an additional part of multi-part user data, e.g. a provider specific boothook
+type UserDataPart struct {
+	ContentType string
+	Filename    string
+	Content     string
+}
+
+type cloudConfigFile struct {
+	path        string
+	permissions string
+	content     string
+}
+
+// deployUnit runs the deploy script until it completes once, on reboot in the middle of the
+// deployment it runs again
+var deployUnit = fmt.Sprintf(`
+[Unit]
+Description=Weka deployment
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!%s
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+TimeoutStartSec=0
+ExecStart=/bin/bash %s
+ExecStartPost=/bin/touch %s
+StandardOutput=journal+console
+StandardError=journal+console
+
+[Install]
+WantedBy=multi-user.target
+`, deployCompletedPath, deployScriptPath, deployCompletedPath)
+
+func (d *DeployScriptGenerator) partitionSetup() string {
+	if d.helperFiles {
+		// after a reboot /opt/weka is mounted from fstab
+		return fmt.Sprintf("if ! mountpoint -q /opt/weka; then\n\tsource %s\nfi\n", partitionScriptPath)
+	}
+	return bash_functions.GetWekaPartitionScript()
+}
+
+func (d *DeployScriptGenerator) writeFindDrivesScript() string {
+	if d.helperFiles {
+		return fmt.Sprintf("mkdir -p /opt/weka/tmp\ncp %s /opt/weka/tmp/find_drives.py\n", findDrivesScriptPath)
+	}
+	s := `
+	mkdir -p /opt/weka/tmp
+	cat >/opt/weka/tmp/find_drives.py <<EOL%sEOL
+	`
+	return fmt.Sprintf(dedent.Dedent(s), d.Params.FindDrivesScript)
+}
+
+// GetDeployCloudConfig renders the deployment as cloud-init #cloud-config: the static helpers and the deploy script
+// are written as files, and the deploy script runs as a systemd unit which survives reboots
+func (d *DeployScriptGenerator) GetDeployCloudConfig() (string, error) {
+	generator := *d
+	generator.helperFiles = true
+	deployScript, err := generator.deployScript().Build()
+	if err != nil {
+		return "", err
+	}
+
+	files := []cloudConfigFile{
+		{partitionScriptPath, "0644", bash_functions.GetWekaPartitionScript()},
+		// the deploy script has the weka token, only root may read it
+		{deployScriptPath, "0700", deployScript},
+		{deployUnitPath, "0644", deployUnit},
+	}
+	if d.Params.Protocol == "" {
+		files = append([]cloudConfigFile{{findDrivesScriptPath, "0644", d.Params.FindDrivesScript}}, files...)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("#cloud-config\n")
+	sb.WriteString("write_files:\n")
+	for _, file := range files {
+		content, err := gzipBase64(file.content)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(fmt.Sprintf("  - path: %s\n", file.path))
+		sb.WriteString(fmt.Sprintf("    permissions: '%s'\n", file.permissions))
+		sb.WriteString("    owner: root:root\n")
+		sb.WriteString("    encoding: gz+b64\n")
+		sb.WriteString(fmt.Sprintf("    content: %s\n", content))
+	}
+	sb.WriteString("runcmd:\n")
+	sb.WriteString("  - [systemctl, daemon-reload]\n")
+	sb.WriteString(fmt.Sprintf("  - [systemctl, enable, --now, --no-block, %s]\n", deployUnitName))
+	return sb.String(), nil
+}
+
+// GetDeployMultipartUserData renders the cloud-config of GetDeployCloudConfig as MIME multi-part user data,
+// followed by extraParts
+func (d *DeployScriptGenerator) GetDeployMultipartUserData(extraParts ...UserDataPart) (string, error) {
+	cloudConfig, err := d.GetDeployCloudConfig()
+	if err != nil {
+		return "", err
+	}
+	parts := append([]UserDataPart{{ContentType: "text/cloud-config", Filename: "cloud-config.txt", Content: cloudConfig}}, extraParts...)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err = writer.SetBoundary(multipartBoundary); err != nil {
+		return "", err
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", fmt.Sprintf("%s; charset=\"utf-8\"", part.ContentType))
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Transfer-Encoding", "7bit")
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", part.Filename))
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err = w.Write([]byte(part.Content)); err != nil {
+			return "", err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+
+	header := fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", multipartBoundary)
+	return header + body.String(), nil
+}
+
+func gzipBase64(content string) (string, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(content)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
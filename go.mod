@@ -8,11 +8,12 @@ require (
 	github.com/lithammer/dedent v1.1.0
 	github.com/rs/zerolog v1.29.0
 	golang.org/x/oauth2 v0.27.0
+	mvdan.cc/sh/v3 v3.12.0
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/rs/xid v1.4.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 )
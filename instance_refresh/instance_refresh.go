@@ -2,9 +2,11 @@ package instance_refresh
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/schedule"
 )
 
 // CalculateTargetContainers calculates the total expected backend containers.
@@ -119,6 +121,11 @@ func CalculateProgress(state *protocol.InstanceRefreshState, currentInstanceIds
 		progress.InstancesReplaced = &replacedCount
 	}
 
+	if state.DeferredUntil != nil {
+		progress.DeferredUntil = state.DeferredUntil.UTC().Truncate(time.Second).Format(time.RFC3339)
+		progress.DeferredReason = state.DeferredReason
+	}
+
 	// Show average iteration duration if we have completed iterations
 	if len(state.IterationDurations) > 0 {
 		avgDuration := calculateAverageDuration(state.IterationDurations)
@@ -147,6 +154,72 @@ func InitializeState(originalSize, scaleUpInterval int, originalInstanceIds []st
 	}
 }
 
+// PlanBatches splits the original instances into batches of up to batchSize instances, no two instances of a batch
+// share a failure domain or a zone, an empty one is shared with no instance. The largest zones and failure domains
+// are spread first, so the batches stay as large as possible.
+func PlanBatches(instances []protocol.InstanceRefreshInstance, batchSize int) [][]string {
+	if batchSize <= 0 {
+		return nil
+	}
+	remaining := append([]protocol.InstanceRefreshInstance(nil), instances...)
+	var batches [][]string
+	for len(remaining) > 0 {
+		zoneCounts := make(map[string]int)
+		failureDomainCounts := make(map[string]int)
+		for _, instance := range remaining {
+			zoneCounts[instance.Zone]++
+			failureDomainCounts[instance.FailureDomain]++
+		}
+		sort.SliceStable(remaining, func(i, j int) bool {
+			a, b := remaining[i], remaining[j]
+			if zoneCounts[a.Zone] != zoneCounts[b.Zone] {
+				return zoneCounts[a.Zone] > zoneCounts[b.Zone]
+			}
+			return failureDomainCounts[a.FailureDomain] > failureDomainCounts[b.FailureDomain]
+		})
+
+		var batch []string
+		var left []protocol.InstanceRefreshInstance
+		zones := make(map[string]bool)
+		failureDomains := make(map[string]bool)
+		for _, instance := range remaining {
+			if len(batch) == batchSize || (instance.Zone != "" && zones[instance.Zone]) ||
+				(instance.FailureDomain != "" && failureDomains[instance.FailureDomain]) {
+				left = append(left, instance)
+				continue
+			}
+			batch = append(batch, instance.Id)
+			zones[instance.Zone] = true
+			failureDomains[instance.FailureDomain] = true
+		}
+		batches = append(batches, batch)
+		remaining = left
+	}
+	return batches
+}
+
+// InitializeBatchedState creates a new InstanceRefreshState retiring the original instances in the batches of
+// PlanBatches, an iteration per batch
+func InitializeBatchedState(originalSize, scaleUpInterval int, originalInstances []protocol.InstanceRefreshInstance) *protocol.InstanceRefreshState {
+	originalInstanceIds := make([]string, 0, len(originalInstances))
+	for _, instance := range originalInstances {
+		originalInstanceIds = append(originalInstanceIds, instance.Id)
+	}
+	state := InitializeState(originalSize, scaleUpInterval, originalInstanceIds)
+	state.IterationTargetIds = PlanBatches(originalInstances, scaleUpInterval)
+	state.TotalIterations = len(state.IterationTargetIds)
+	return state
+}
+
+// GetIterationTargetIds returns the original instances the current iteration retires, nil if scale down picks them.
+// The cloud function marks them as protocol.HgInstance.RefreshTarget, so scale down deactivates them first.
+func GetIterationTargetIds(state *protocol.InstanceRefreshState) []string {
+	if state.CurrentIteration < 1 || state.CurrentIteration > len(state.IterationTargetIds) {
+		return nil
+	}
+	return state.IterationTargetIds[state.CurrentIteration-1]
+}
+
 // IsInProgress returns true if an instance refresh is currently in progress
 func IsInProgress(state *protocol.InstanceRefreshState) bool {
 	if state == nil {
@@ -262,6 +335,13 @@ func ShouldContinue(state *protocol.InstanceRefreshState) bool {
 
 // GetExpectedReplaced returns how many instances should be replaced by the current iteration
 func GetExpectedReplaced(state *protocol.InstanceRefreshState) int {
+	if len(state.IterationTargetIds) > 0 {
+		expectedReplaced := 0
+		for _, targets := range state.IterationTargetIds[:min(state.CurrentIteration, len(state.IterationTargetIds))] {
+			expectedReplaced += len(targets)
+		}
+		return expectedReplaced
+	}
 	expectedReplaced := state.CurrentIteration * state.ScaleUpInterval
 	if expectedReplaced > len(state.OriginalInstanceIds) {
 		expectedReplaced = len(state.OriginalInstanceIds)
@@ -269,6 +349,36 @@ func GetExpectedReplaced(state *protocol.InstanceRefreshState) int {
 	return expectedReplaced
 }
 
+// getScaledUpSize returns the target size during the scale up phase of the current iteration
+func getScaledUpSize(state *protocol.InstanceRefreshState) int {
+	if targets := GetIterationTargetIds(state); targets != nil {
+		return state.OriginalSize + len(targets)
+	}
+	return GetScaledUpSize(state.OriginalSize, state.ScaleUpInterval, state.CurrentIteration, state.TotalIterations)
+}
+
+// checkReplaced returns how many original instances were replaced, and an error if more than expected were, or if
+// they aren't the targets of the iterations so far
+func checkReplaced(state *protocol.InstanceRefreshState, currentInstanceIds []string) (actualReplaced, expectedReplaced int, err error) {
+	expectedReplaced = GetExpectedReplaced(state)
+	actualReplaced = CountReplacedInstances(state.OriginalInstanceIds, currentInstanceIds)
+	if actualReplaced > expectedReplaced {
+		return actualReplaced, expectedReplaced, fmt.Errorf("unexpected state: more instances replaced (%d) than expected (%d)",
+			actualReplaced, expectedReplaced)
+	}
+	if len(state.IterationTargetIds) > 0 {
+		var targets []string
+		for _, iterationTargets := range state.IterationTargetIds[:min(state.CurrentIteration, len(state.IterationTargetIds))] {
+			targets = append(targets, iterationTargets...)
+		}
+		if replacedTargets := CountReplacedInstances(targets, currentInstanceIds); replacedTargets != actualReplaced {
+			return actualReplaced, expectedReplaced, fmt.Errorf("unexpected state: %d of the %d replaced instances aren't targets",
+				actualReplaced-replacedTargets, actualReplaced)
+		}
+	}
+	return actualReplaced, expectedReplaced, nil
+}
+
 // completeIterationAndProceed handles the common logic when an iteration is complete:
 // marks the iteration complete, then either starts the next iteration or marks the refresh as completed.
 // Returns the new desired size if scaling up for next iteration, nil otherwise.
@@ -277,8 +387,7 @@ func completeIterationAndProceed(state *protocol.InstanceRefreshState) *int {
 
 	if ShouldContinue(state) {
 		StartNextIteration(state)
-		scaledUpSize := GetScaledUpSize(state.OriginalSize, state.ScaleUpInterval,
-			state.CurrentIteration, state.TotalIterations)
+		scaledUpSize := getScaledUpSize(state)
 		return &scaledUpSize
 	}
 
@@ -292,8 +401,7 @@ func GetExpectedDesiredSize(state *protocol.InstanceRefreshState) int {
 	switch state.Phase {
 	case protocol.InstanceRefreshPhaseProvisioning,
 		protocol.InstanceRefreshPhaseWaitingWekaAfterScaleUp:
-		return GetScaledUpSize(state.OriginalSize, state.ScaleUpInterval,
-			state.CurrentIteration, state.TotalIterations)
+		return getScaledUpSize(state)
 	case protocol.InstanceRefreshPhaseWaitingWekaAfterScaleDown,
 		protocol.InstanceRefreshPhaseTerminating:
 		return state.OriginalSize
@@ -302,6 +410,45 @@ func GetExpectedDesiredSize(state *protocol.InstanceRefreshState) int {
 	}
 }
 
+// ApplyScalePolicy evaluates the scale policy (maintenance windows, freeze periods, max machines per hour) for an in
+// progress refresh and records the decision in the state.
+// recentDeactivations are the times machines were deactivated, as kept in the HostGroupInfoResponse; the refresh is
+// deferred while they exhaust the max machines per hour.
+// Returns deferred=true if scale operations are not allowed now, in which case the caller should not call
+// AdvanceStateMachine and should leave DesiredSize unchanged.
+func ApplyScalePolicy(state *protocol.InstanceRefreshState, policy *protocol.ScalePolicy, now time.Time, recentDeactivations []time.Time) (stateChanged bool, deferred bool, err error) {
+	if !IsInProgress(state) {
+		return false, false, nil
+	}
+	decision, err := schedule.Evaluate(policy, now, recentDeactivations)
+	if err != nil {
+		return false, false, err
+	}
+	if !decision.Deferred && decision.Budget == 0 {
+		decision.Deferred = true
+		decision.DeferredUntil = decision.BudgetResetAt
+		decision.Reason = "max machines per hour"
+	}
+
+	if !decision.Deferred {
+		if state.DeferredUntil == nil {
+			return false, false, nil
+		}
+		state.DeferredUntil = nil
+		state.DeferredReason = ""
+		state.UpdatedAt = now
+		return true, false, nil
+	}
+
+	if state.DeferredUntil != nil && state.DeferredUntil.Equal(decision.DeferredUntil) && state.DeferredReason == decision.Reason {
+		return false, true, nil
+	}
+	state.DeferredUntil = &decision.DeferredUntil
+	state.DeferredReason = decision.Reason
+	state.UpdatedAt = now
+	return true, true, nil
+}
+
 // AdvanceStateMachine advances the instance refresh state machine.
 // This is a pure function - it modifies state in place and returns what actions the caller should take.
 // Returns:
@@ -327,8 +474,7 @@ func AdvanceStateMachine(
 		protocol.InstanceRefreshPhaseWaitingWekaAfterScaleUp:
 
 		// Calculate expected scaled up size
-		scaledUpSize := GetScaledUpSize(state.OriginalSize, state.ScaleUpInterval,
-			state.CurrentIteration, state.TotalIterations)
+		scaledUpSize := getScaledUpSize(state)
 
 		// First, verify the instance count has reached the scaled up size
 		if len(currentInstanceIds) < scaledUpSize {
@@ -368,12 +514,9 @@ func AdvanceStateMachine(
 		}
 
 		// Weka is ready, now verify instances are terminated
-		expectedReplaced := GetExpectedReplaced(state)
-		actualReplaced := CountReplacedInstances(state.OriginalInstanceIds, currentInstanceIds)
-
-		if actualReplaced > expectedReplaced {
-			return true, &state.OriginalSize, fmt.Errorf("unexpected state: more instances replaced (%d) than expected (%d)",
-				actualReplaced, expectedReplaced)
+		actualReplaced, expectedReplaced, err := checkReplaced(state, currentInstanceIds)
+		if err != nil {
+			return true, &state.OriginalSize, err
 		}
 
 		// Check if termination is already complete (often happens by the time scale down is done)
@@ -389,12 +532,9 @@ func AdvanceStateMachine(
 
 	case protocol.InstanceRefreshPhaseTerminating:
 
-		expectedReplaced := GetExpectedReplaced(state)
-		actualReplaced := CountReplacedInstances(state.OriginalInstanceIds, currentInstanceIds)
-
-		if actualReplaced > expectedReplaced {
-			return true, &state.OriginalSize, fmt.Errorf("unexpected state: more instances replaced (%d) than expected (%d)",
-				actualReplaced, expectedReplaced)
+		actualReplaced, expectedReplaced, err := checkReplaced(state, currentInstanceIds)
+		if err != nil {
+			return true, &state.OriginalSize, err
 		}
 
 		// Verify the expected number of old instances have been replaced and instance count is correct
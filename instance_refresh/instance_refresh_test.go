@@ -0,0 +1,184 @@
+package instance_refresh
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestPlanBatches(t *testing.T) {
+	instances := []protocol.InstanceRefreshInstance{
+		{Id: "i-1", Zone: "a", FailureDomain: "fd1"},
+		{Id: "i-2", Zone: "a", FailureDomain: "fd2"},
+		{Id: "i-3", Zone: "a", FailureDomain: "fd3"},
+		{Id: "i-4", Zone: "b", FailureDomain: "fd1"},
+		{Id: "i-5", Zone: "b", FailureDomain: "fd2"},
+		{Id: "i-6", Zone: "c", FailureDomain: "fd3"},
+	}
+	zones := make(map[string]string)
+	failureDomains := make(map[string]string)
+	for _, instance := range instances {
+		zones[instance.Id] = instance.Zone
+		failureDomains[instance.Id] = instance.FailureDomain
+	}
+
+	batches := PlanBatches(instances, 3)
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got %v", batches)
+	}
+	retired := make(map[string]bool)
+	for _, batch := range batches {
+		batchZones := make(map[string]bool)
+		batchFailureDomains := make(map[string]bool)
+		for _, id := range batch {
+			if retired[id] || batchZones[zones[id]] || batchFailureDomains[failureDomains[id]] {
+				t.Errorf("batch %v retires %s twice or shares its zone or failure domain", batch, id)
+			}
+			retired[id] = true
+			batchZones[zones[id]] = true
+			batchFailureDomains[failureDomains[id]] = true
+		}
+	}
+	if len(retired) != len(instances) {
+		t.Errorf("expected all the instances to be retired, got %v", batches)
+	}
+
+	// without zones and failure domains, batches are of the batch size
+	batches = PlanBatches([]protocol.InstanceRefreshInstance{{Id: "i-1"}, {Id: "i-2"}, {Id: "i-3"}}, 2)
+	if fmt.Sprint(batches) != "[[i-1 i-2] [i-3]]" {
+		t.Errorf("unexpected batches %v", batches)
+	}
+}
+
+func TestAdvanceStateMachineBatches(t *testing.T) {
+	instances := []protocol.InstanceRefreshInstance{
+		{Id: "i-1", Zone: "a"}, {Id: "i-2", Zone: "a"}, {Id: "i-3", Zone: "b"},
+	}
+	state := InitializeBatchedState(3, 2, instances)
+	if state.TotalIterations != 2 || fmt.Sprint(state.IterationTargetIds) != "[[i-1 i-3] [i-2]]" {
+		t.Fatalf("unexpected iterations %d %v", state.TotalIterations, state.IterationTargetIds)
+	}
+	if targets := GetIterationTargetIds(state); strings.Join(targets, " ") != "i-1 i-3" {
+		t.Errorf("unexpected targets %v", targets)
+	}
+
+	status := protocol.WekaStatus{IoStatus: "STARTED", Status: "OK"}
+	setHealthy := func(size int) {
+		status.Hosts.Backends.Active, status.Hosts.Backends.Total = size, size
+		status.Drives.Active, status.Drives.Total = size, size
+	}
+
+	scaledUp := []string{"i-1", "i-2", "i-3", "i-4", "i-5"}
+	if _, size, _ := AdvanceStateMachine(state, status, scaledUp, 1, 1, 0); *size != 5 {
+		t.Fatalf("expected to scale up to 5, got %d", *size)
+	}
+	setHealthy(5)
+	if _, size, _ := AdvanceStateMachine(state, status, scaledUp, 1, 1, 0); *size != 3 {
+		t.Fatalf("expected to scale down to 3, got %d", *size)
+	}
+	setHealthy(3)
+
+	// scale down retired a non-target instance
+	if _, _, err := AdvanceStateMachine(state, status, []string{"i-1", "i-3", "i-4"}, 1, 1, 0); err == nil {
+		t.Error("expected an error for a non-target replaced instance")
+	}
+
+	if _, size, err := AdvanceStateMachine(state, status, []string{"i-2", "i-4", "i-5"}, 1, 1, 0); err != nil || *size != 4 {
+		t.Fatalf("expected the next iteration scaling up to 4, got %v %v", size, err)
+	}
+	if state.CurrentIteration != 2 || strings.Join(GetIterationTargetIds(state), " ") != "i-2" {
+		t.Errorf("unexpected iteration %d targets %v", state.CurrentIteration, GetIterationTargetIds(state))
+	}
+}
+
+func TestApplyScalePolicy(t *testing.T) {
+	// Monday
+	now := time.Date(2024, 1, 8, 10, 30, 0, 0, time.UTC)
+	freezeEnd := time.Date(2024, 1, 8, 18, 0, 0, 0, time.UTC)
+	earlier := now.Add(-time.Hour)
+	freeze := &protocol.ScalePolicy{FreezePeriods: []protocol.ScheduleWindow{{Cron: "0 9 * * 1-5", Duration: 9 * time.Hour}}}
+	rateLimit := &protocol.ScalePolicy{MaxMachinesPerHour: 2}
+	recentDeactivations := []time.Time{now.Add(-50 * time.Minute), now.Add(-20 * time.Minute)}
+	budgetReset := now.Add(10 * time.Minute)
+
+	tests := []struct {
+		name          string
+		state         *protocol.InstanceRefreshState
+		policy        *protocol.ScalePolicy
+		deactivations []time.Time
+		stateChanged  bool
+		deferred      bool
+		deferredUntil *time.Time
+		reason        string
+		invalid       bool
+	}{
+		{"no refresh", nil, freeze, nil, false, false, nil, "", false},
+		{"completed refresh", &protocol.InstanceRefreshState{Phase: protocol.InstanceRefreshPhaseCompleted}, freeze, nil, false, false, nil, "", false},
+		{"no policy", &protocol.InstanceRefreshState{Phase: protocol.InstanceRefreshPhaseProvisioning}, nil, nil, false, false, nil, "", false},
+		{
+			"freeze period",
+			&protocol.InstanceRefreshState{Phase: protocol.InstanceRefreshPhaseProvisioning},
+			freeze, nil, true, true, &freezeEnd, "freeze period", false,
+		},
+		{
+			"already deferred",
+			&protocol.InstanceRefreshState{Phase: protocol.InstanceRefreshPhaseTerminating, DeferredUntil: &freezeEnd, DeferredReason: "freeze period", UpdatedAt: earlier},
+			freeze, nil, false, true, &freezeEnd, "freeze period", false,
+		},
+		{
+			"deferral over",
+			&protocol.InstanceRefreshState{Phase: protocol.InstanceRefreshPhaseTerminating, DeferredUntil: &earlier, DeferredReason: "freeze period", UpdatedAt: earlier},
+			nil, nil, true, false, nil, "", false,
+		},
+		{
+			"max machines per hour",
+			&protocol.InstanceRefreshState{Phase: protocol.InstanceRefreshPhaseTerminating},
+			rateLimit, recentDeactivations, true, true, &budgetReset, "max machines per hour", false,
+		},
+		{
+			"max machines per hour not reached",
+			&protocol.InstanceRefreshState{Phase: protocol.InstanceRefreshPhaseTerminating},
+			rateLimit, recentDeactivations[1:], false, false, nil, "", false,
+		},
+		{
+			"invalid policy",
+			&protocol.InstanceRefreshState{Phase: protocol.InstanceRefreshPhaseProvisioning},
+			&protocol.ScalePolicy{FreezePeriods: []protocol.ScheduleWindow{{Cron: "0 9 * *", Duration: time.Hour}}},
+			nil, false, false, nil, "", true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateChanged, deferred, err := ApplyScalePolicy(tt.state, tt.policy, now, tt.deactivations)
+			if tt.invalid {
+				if err == nil {
+					t.Error("expected an error for an invalid policy")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stateChanged != tt.stateChanged || deferred != tt.deferred {
+				t.Fatalf("stateChanged, deferred = %t, %t; want %t, %t", stateChanged, deferred, tt.stateChanged, tt.deferred)
+			}
+			if tt.state == nil {
+				return
+			}
+			if (tt.state.DeferredUntil == nil) != (tt.deferredUntil == nil) ||
+				(tt.deferredUntil != nil && !tt.state.DeferredUntil.Equal(*tt.deferredUntil)) {
+				t.Errorf("deferred until = %v; want %v", tt.state.DeferredUntil, tt.deferredUntil)
+			}
+			if tt.state.DeferredReason != tt.reason {
+				t.Errorf("reason = %q; want %q", tt.state.DeferredReason, tt.reason)
+			}
+			if stateChanged && !tt.state.UpdatedAt.Equal(now) {
+				t.Errorf("updated at = %s; want %s", tt.state.UpdatedAt, now)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/weka/go-cloud-lib/bash_functions"
 	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/script"
 
 	"github.com/lithammer/dedent"
 	"github.com/weka/go-cloud-lib/common"
@@ -33,13 +34,29 @@ type JoinScriptGenerator struct {
 }
 
 func (j *JoinScriptGenerator) GetJoinScript(ctx context.Context) string {
-	reportFunc := j.FuncDef.GetFunctionCmdDefinition(functions_def.Report)
-	joinFinalizationFunc := j.FuncDef.GetFunctionCmdDefinition(functions_def.JoinFinalization)
-	getCoreIdsFunc := bash_functions.GetCoreIds()
+	return j.build(j.joinScript())
+}
+
+// Validate renders the join script and checks it statically, see script.Validate
+func (j *JoinScriptGenerator) Validate() error {
+	joinScript, err := j.joinScript().Build()
+	if err != nil {
+		return err
+	}
+	return script.Validate(joinScript)
+}
+
+// build renders the script, or a script reporting the error if it can't be rendered
+func (j *JoinScriptGenerator) build(s *script.Builder) string {
+	joinScript, err := s.Build()
+	if err != nil {
+		return common.GetErrorScript(err, j.FuncDef.GetFunctionCmdDefinition(functions_def.Report), "")
+	}
+	return joinScript
+}
+
+func (j *JoinScriptGenerator) joinScript() *script.Builder {
 	gateways := strings.Join(j.Params.Gateways, " ")
-	getNetStrForDpdkFunc := bash_functions.GetNetStrForDpdk(j.Params.IsBM, gateways)
-	getAllInterfaces := bash_functions.GetAllInterfaces()
-	failureDomainCmd := bash_functions.GetHashedPrivateIpBashCmd()
 
 	ips := j.Params.IPs
 	common.ShuffleSlice(ips)
@@ -49,39 +66,29 @@ func (j *JoinScriptGenerator) GetJoinScript(ctx context.Context) string {
 		cgroupsMode = j.Params.CgroupsMode
 	}
 
-	bashScriptTemplate := `
-	IPS=(%s)
-	HASHED_IP=$(%s)
-	COMPUTE=%d
-	FRONTEND=%d
-	DRIVES=%d
-	COMPUTE_MEMORY=%s
-	INSTALL_DPDK=%t
-	host_ips=$(IFS=, ;echo "${IPS[*]}")
-	PROXY_URL="%s"
-	WEKA_CGROUPS_MODE="%s"
-
-	# report function definition
-	%s
-
-	# join_finalization function definition
-	%s
-
-	# get_core_ids bash function definition
-	%s
-
-	# getNetStrForDpdk bash function definitiion
-	%s
-
-	# getAllInterfaces bash function definition
-	%s
-
-	# deviceNameCmd
-	wekaiosw_device="%s"
-	# wekio partition setup
-	%s
+	layout := j.Params.InstanceParams.ContainerLayout()
+	if err := layout.Validate(); err != nil {
+		return script.New().Fail(fmt.Errorf("container layout: %w", err))
+	}
 
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Joining new instance started\"}"
+	s := script.New().Raw(j.ScriptBase).
+		Var("IPS", ips).
+		Expr("HASHED_IP", "$("+bash_functions.GetHashedPrivateIpBashCmd()+")").
+		Var("INSTALL_DPDK", j.Params.InstallDpdk).
+		Var("PROTOCOL", "").
+		Expr("host_ips", `$(IFS=, ;echo "${IPS[*]}")`).Requires("IPS").
+		Var("PROXY_URL", j.Params.ProxyUrl).
+		Var("WEKA_CGROUPS_MODE", cgroupsMode).
+		CloudFunctions(j.FuncDef, functions_def.Report, functions_def.JoinFinalization).
+		Function("json_object", bash_functions.JsonObjectFunction()).
+		Function("get_core_ids", bash_functions.GetCoreIds()).
+		Function("getNetStrForDpdk", bash_functions.GetNetStrForDpdk(j.Params.IsBM, gateways)).Requires("getAllInterfaces").
+		Function("getAllInterfaces", bash_functions.GetAllInterfaces()).
+		Expr("wekaiosw_device", `"`+j.DeviceNameCmd+`"`).
+		Section("wekio partition setup", bash_functions.GetWekaPartitionScript()).Requires("report", "json_object", "PROTOCOL", "wekaiosw_device")
+
+	s.Section("", `
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Joining new instance started")"
 
 	random=$$
 	echo $random
@@ -102,100 +109,48 @@ func (j *JoinScriptGenerator) GetJoinScript(ctx context.Context) string {
 		sleep 1
 	done
 
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Installing weka\"}"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Installing weka")"
 	curl --insecure https://$backend_ip:14000/dist/v1/install -o install.sh
 	chmod +x install.sh
 	PROXY="$PROXY_URL" WEKA_CGROUPS_MODE="$WEKA_CGROUPS_MODE" ./install.sh
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"WEKA software installation completed\"}"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "WEKA software installation completed")"
 
 	weka version get --from $backend_ip:14000 $VERSION --set-current
 	weka version prepare $VERSION
 	weka local stop && weka local rm --all -f
+	`).Requires("report", "json_object", "getAllInterfaces", "IPS", "PROXY_URL", "WEKA_CGROUPS_MODE").Provides("backend_ip", "VERSION")
 
-	# weka containers setup
-
-	get_core_ids $DRIVES drive_core_ids
-	get_core_ids $COMPUTE compute_core_ids
-
+	s.Section("weka containers setup", `
 	mgmt_ip=$(hostname -I | awk '{print $1}')
-	if [[ $INSTALL_DPDK == true ]]; then
-		getNetStrForDpdk 1 $((1+$DRIVES))
-		sudo weka local setup container --name drives0 --base-port 14000 --cores $DRIVES --no-frontends --drives-dedicated-cores $DRIVES --join-ips $host_ips --failure-domain "$HASHED_IP" --core-ids $drive_core_ids --management-ips $mgmt_ip --dedicate $net
-		getNetStrForDpdk $((1+$DRIVES)) $((1+$DRIVES+$COMPUTE))
-		sudo weka local setup container --name compute0 --base-port 15000 --cores $COMPUTE --memory "$COMPUTE_MEMORY" --no-frontends --compute-dedicated-cores $COMPUTE --join-ips $host_ips --failure-domain "$HASHED_IP" --core-ids $compute_core_ids --management-ips $mgmt_ip --dedicate $net
-	else
-		sudo weka local setup container --name drives0 --base-port 14000 --cores $DRIVES --no-frontends --drives-dedicated-cores $DRIVES --join-ips $host_ips --failure-domain "$HASHED_IP" --core-ids $drive_core_ids --management-ips $mgmt_ip --dedicate --net udp
-		sudo weka local setup container --name compute0 --base-port 15000 --cores $COMPUTE --memory "$COMPUTE_MEMORY" --no-frontends --compute-dedicated-cores $COMPUTE --join-ips $host_ips --failure-domain "$HASHED_IP" --core-ids $compute_core_ids --management-ips $mgmt_ip --dedicate --net udp
-	fi
-
-	if [[ $FRONTEND -gt 0 ]]; then
-		get_core_ids $FRONTEND frontend_core_ids
-		if [[ $INSTALL_DPDK == true ]]; then
-			getNetStrForDpdk $((1+$DRIVES+$COMPUTE)) $((1+$DRIVES+$COMPUTE+1))
-			sudo weka local setup container --name frontend0 --base-port 16000 --cores $FRONTEND --allow-protocols true --frontend-dedicated-cores $FRONTEND --join-ips $host_ips --failure-domain "$HASHED_IP" --core-ids $frontend_core_ids --management-ips $mgmt_ip --dedicate $net
-		else
-			sudo weka local setup container --name frontend0 --base-port 16000 --cores $FRONTEND --allow-protocols true --frontend-dedicated-cores $FRONTEND --join-ips $host_ips --failure-domain "$HASHED_IP" --core-ids $frontend_core_ids --management-ips $mgmt_ip --dedicate --net udp
-		fi
-	fi
-	`
+	`).Provides("mgmt_ip")
+	s.Section("", bash_functions.WekaContainersSetup(layout, `--join-ips $host_ips --failure-domain "$HASHED_IP" --management-ips $mgmt_ip`, "")).
+		Requires("get_core_ids", "getNetStrForDpdk", "INSTALL_DPDK", "HASHED_IP", "host_ips", "mgmt_ip")
 
-	frontend := j.Params.InstanceParams.Frontend
-	drive := j.Params.InstanceParams.Drive
-	compute := j.Params.InstanceParams.Compute
-	mem := j.Params.InstanceParams.ComputeMemory
-
-	bashScriptTemplate = j.ScriptBase + dedent.Dedent(bashScriptTemplate)
-	bashScript := fmt.Sprintf(
-		bashScriptTemplate,
-		strings.Join(ips, " "),
-		failureDomainCmd,
-		compute,
-		frontend,
-		drive,
-		mem,
-		j.Params.InstallDpdk,
-		j.Params.ProxyUrl,
-		cgroupsMode,
-		reportFunc,
-		joinFinalizationFunc,
-		getCoreIdsFunc,
-		getNetStrForDpdkFunc,
-		getAllInterfaces,
-		j.DeviceNameCmd,
-		bash_functions.GetWekaPartitionScript(),
-	)
-
-	setWekaCredentials := j.getWekaCredentialsEnvVarsSetup()
-	isReady := j.getIsReadyScript()
-	addDrives := j.getAddDrivesScript()
-	bashScript += setWekaCredentials + isReady + addDrives
-
-	return dedent.Dedent(bashScript)
+	j.addWekaCredentialsEnvVarsSetup(s)
+	j.addIsReadyScript(s)
+	j.addAddDrivesScript(s)
+
+	return s
 }
 
 func (j *JoinScriptGenerator) GetExistingContainersJoinScript(ctx context.Context) string {
-	reportFunc := j.FuncDef.GetFunctionCmdDefinition(functions_def.Report)
-	joinFinalizationFunc := j.FuncDef.GetFunctionCmdDefinition(functions_def.JoinFinalization)
-	statusFunc := j.FuncDef.GetFunctionCmdDefinition(functions_def.Status)
-
 	ips := j.Params.IPs
 	common.ShuffleSlice(ips)
 
-	bashScriptTemplate := `
-	set -ex
-
-	host_ips="%s"
+	// containers which don't exist on the instance are skipped, so frontend0 is looked for even without frontend cores
+	layout := j.Params.InstanceParams.ContainerLayout()
+	if j.Params.InstanceParams.Layout == nil {
+		layout = protocol.DefaultContainerLayout(1, 1, 1, "")
+	}
 
-	# report function definition
-	%s
+	s := script.New().Raw(j.ScriptBase).Raw("set -ex\n").
+		Var("host_ips", strings.Join(ips, " ")).
+		Var("CONTAINER_NAMES", layout.Names()).
+		CloudFunctions(j.FuncDef, functions_def.Report, functions_def.JoinFinalization, functions_def.Status).
+		Function("json_object", bash_functions.JsonObjectFunction())
 
-	# join_finalization function definition
-	%s
-	
-	# status function definition
-	%s
-	
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Joining instance (Initial setup)\"}"
+	s.Section("", `
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Joining instance (Initial setup)")"
 
 	clusterized=$(status | jq .clusterized)
 	while [ $clusterized != true ]; do
@@ -206,88 +161,91 @@ func (j *JoinScriptGenerator) GetExistingContainersJoinScript(ctx context.Contex
 
 	mgmt_ip=$(hostname -I | awk '{print $1}')
 
-	sudo weka local resources management-ips $mgmt_ip -C drives0
-	weka local resources join-ips --container drives0 $host_ips
-	weka local resources apply -f --container drives0
-
-	sudo weka local resources management-ips $mgmt_ip -C compute0
-	weka local resources join-ips --container compute0 $host_ips
-	weka local resources apply -f --container compute0
-
-	if [[ $(weka local ps | grep frontend0) ]]; then
-		sudo weka local resources management-ips $mgmt_ip -C frontend0
-		weka local resources join-ips --container frontend0 $host_ips
-		weka local resources apply -f --container frontend0
-	fi
-	`
-	bashScriptTemplate = j.ScriptBase + dedent.Dedent(bashScriptTemplate)
-	bashScript := fmt.Sprintf(
-		bashScriptTemplate, strings.Join(ips, " "), reportFunc,
-		joinFinalizationFunc, statusFunc,
-	)
-
-	setWekaCredentials := j.getWekaCredentialsEnvVarsSetup()
-	isReady := j.getIsReadyScript()
-	addDrives := j.getAddDrivesScript()
+	for container in "${CONTAINER_NAMES[@]}"; do
+		if [[ $(weka local ps | grep -E "^$container\s") ]]; then
+			sudo weka local resources management-ips $mgmt_ip -C $container
+			weka local resources join-ips --container $container $host_ips
+			weka local resources apply -f --container $container
+		fi
+	done
+	`).Requires("report", "json_object", "status", "host_ips", "CONTAINER_NAMES")
 
-	bashScript += setWekaCredentials + isReady + addDrives
+	j.addWekaCredentialsEnvVarsSetup(s)
+	j.addIsReadyScript(s)
+	j.addAddDrivesScript(s)
 
-	return dedent.Dedent(bashScript)
+	return j.build(s)
 }
 
-func (j *JoinScriptGenerator) getWekaCredentialsEnvVarsSetup() string {
-	fetchFunc := j.FuncDef.GetFunctionCmdDefinition(functions_def.Fetch)
-	s := `
-	# fetch function definition
-	%s
-	
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Fetching WEKA credentials\"}"
+func (j *JoinScriptGenerator) addWekaCredentialsEnvVarsSetup(s *script.Builder) {
+	s.CloudFunctions(j.FuncDef, functions_def.Fetch)
+	s.Section("", `
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Fetching WEKA credentials")"
 
 	set +x
 	fetch_result=$(fetch "{\"fetch_weka_credentials\": true}")
 	export WEKA_USERNAME="$(echo $fetch_result | jq -r .username)"
 	export WEKA_PASSWORD="$(echo $fetch_result | jq -r .password)"
 	set -x
-	`
-	s = dedent.Dedent(s)
-	return fmt.Sprintf(s, fetchFunc)
+	`).Requires("fetch", "report", "json_object").Provides("WEKA_USERNAME", "WEKA_PASSWORD")
 }
 
-func (j *JoinScriptGenerator) getIsReadyScript() string {
-	s := `
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Waiting for WEKA cluster to be ready\"}"
+func (j *JoinScriptGenerator) addIsReadyScript(s *script.Builder) {
+	s.Section("", `
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Waiting for WEKA cluster to be ready")"
 
 	while ! weka debug manhole -s 0 operational_status | grep '"is_ready": true' ; do
 		sleep 1
 	done
 	echo Connected to cluster
-	`
-	return dedent.Dedent(s)
+	`).Requires("report", "json_object")
 }
 
-func (j *JoinScriptGenerator) getAddDrivesScript() string {
-	// supposes 'report' and 'join_finalization' are already defined
-	s := `
+func (j *JoinScriptGenerator) addAddDrivesScript(s *script.Builder) {
+	s.Section("", `
 	set +x
 	export WEKA_RUN_CREDS="-e WEKA_USERNAME=$WEKA_USERNAME -e WEKA_PASSWORD=$WEKA_PASSWORD"
 	set -x
 
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Adding drives to WEKA cluster\"}"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Adding drives to WEKA cluster")"
+
+	`).Requires("report", "json_object", "WEKA_USERNAME", "WEKA_PASSWORD")
 
-	compute_name=$(%s)
+	s.Expr("compute_name", "$("+j.GetInstanceNameCmd+")")
 
+	layout := j.Params.InstanceParams.ContainerLayout()
+	computeContainers, driveContainers := layout.ByRole(protocol.ComputeContainer), layout.ByRole(protocol.DriveContainer)
+	if len(computeContainers) == 0 || len(driveContainers) == 0 {
+		s.Fail(fmt.Errorf("container layout must have compute and drive containers"))
+		return
+	}
+	var driveContainerNames []string
+	for _, container := range driveContainers {
+		driveContainerNames = append(driveContainerNames, container.Name)
+	}
+	s.Var("compute_container", computeContainers[0].Name)
+	s.Var("drive_containers", driveContainerNames)
+
+	findDrivesTemplate := `
 	mkdir -p /opt/weka/tmp
 
 	# write down find_drives script (another string input for this template)
 	cat >/opt/weka/tmp/find_drives.py <<EOL%sEOL
+	`
+	s.Section("", fmt.Sprintf(dedent.Dedent(findDrivesTemplate), j.FindDrivesScript))
+
+	s.Section("", `
 	set +x
-	devices=$(weka local run --container compute0 $WEKA_RUN_CREDS bash -ce 'wapi machine-query-info --info-types=DISKS -J | python3 /opt/weka/tmp/find_drives.py')
-	host_id=$(weka local run --container compute0 $WEKA_RUN_CREDS manhole getServerInfo | grep hostIdValue: | awk '{print $2}')
+	devices=$(weka local run --container $compute_container $WEKA_RUN_CREDS bash -ce 'wapi machine-query-info --info-types=DISKS -J | python3 /opt/weka/tmp/find_drives.py')
+	host_id=$(weka local run --container $compute_container $WEKA_RUN_CREDS manhole getServerInfo | grep hostIdValue: | awk '{print $2}')
 	set -x
 
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Signing drives\"}"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Signing drives")"
+	# the devices are split between the drive containers, as the clusterize script adds them
+	k=0
 	for device in $devices; do
-		weka local exec --container drives0 /weka/tools/weka_sign_drive $device
+		weka local exec --container "${drive_containers[k % ${#drive_containers[@]}]}" /weka/tools/weka_sign_drive $device
+		k=$((k+1))
 	done
 	ready=0
 	while [ $ready -eq 0 ] ; do
@@ -302,32 +260,30 @@ func (j *JoinScriptGenerator) getAddDrivesScript() string {
 		done
 	done
 
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Running drives scan\"}"
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Running drives scan")"
 
 	count=1
 	while ! weka cluster drive scan "$host_id"; do
 		count=$((count+1))
 		if [ "$count" -gt 60 ]; then
-			report "{\"hostname\": \"$HOSTNAME\", \"type\": \"error\", \"message\": \"Failed to run drives scan\"}"
+			report "$(json_object hostname "$HOSTNAME" type "error" message "Failed to run drives scan")"
 			containers=($(weka cluster container | grep "$HOSTNAME" | awk '{print $1}'))
 			for c in "${containers[@]}"
 			do
-				report "{\"hostname\": \"$HOSTNAME\", \"type\": \"debug\", \"message\": \"Deactivating container: $c\"}"
+				report "$(json_object hostname "$HOSTNAME" type "debug" message "Deactivating container: $c")"
 				weka cluster container deactivate $c || true
 			done
 			exit 1
 		fi
 		sleep 1
 		echo "Retrying drives scan, try: $count/60"
-		report "{\"hostname\": \"$HOSTNAME\", \"type\": \"debug\", \"message\": \"Retrying drives scan\"}"
+		report "$(json_object hostname "$HOSTNAME" type "debug" message "Retrying drives scan")"
 	done
 
 	weka events trigger-event "Scale up operation completed on host $HOSTNAME, data redistribution may still be running"
 
-	join_finalization "{\"name\": \"$compute_name\"}"
+	join_finalization "$(json_object name "$compute_name")"
 	echo "completed successfully" > /tmp/weka_join_completion_validation
-	report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Joining new instance completed successfully\"}"
-	`
-	s = dedent.Dedent(s)
-	return fmt.Sprintf(s, j.GetInstanceNameCmd, j.FindDrivesScript)
+	report "$(json_object hostname "$HOSTNAME" type "progress" message "Joining new instance completed successfully")"
+	`).Requires("report", "json_object", "join_finalization", "compute_name", "compute_container", "drive_containers")
 }
@@ -1,78 +1,95 @@
 package join
 
 import (
-	"fmt"
-
-	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/common"
 	"github.com/weka/go-cloud-lib/deploy"
 	"github.com/weka/go-cloud-lib/functions_def"
+	"github.com/weka/go-cloud-lib/protocol"
 )
 
+// NFSInterfaceGroupPort is an interface group the joining host is added to, through its NIC NicName
+type NFSInterfaceGroupPort struct {
+	InterfaceGroupName string
+	NicName            string // empty for the management NIC
+}
+
 type JoinNFSScriptGenerator struct {
 	DeviceNameCmd      string
 	DeploymentParams   deploy.DeploymentParams
-	InterfaceGroupName string
+	InterfaceGroupName string                  // ignored if InterfaceGroups is set
+	InterfaceGroups    []NFSInterfaceGroupPort // for clusters with several interface groups
 	FuncDef            functions_def.FunctionDef
 	Name               string //for AWS we provide here the instance id
 }
 
+func (j *JoinNFSScriptGenerator) interfaceGroups() []NFSInterfaceGroupPort {
+	if len(j.InterfaceGroups) > 0 {
+		return j.InterfaceGroups
+	}
+	return []NFSInterfaceGroupPort{{InterfaceGroupName: j.InterfaceGroupName}}
+}
+
 func (j *JoinNFSScriptGenerator) GetJoinNFSHostScript() string {
 	deployScriptGenerator := deploy.DeployScriptGenerator{
 		DeviceNameCmd: j.DeviceNameCmd,
 		FuncDef:       j.FuncDef,
 		Params:        j.DeploymentParams,
 	}
-	deploymentBashScript := deployScriptGenerator.GetBaseProtocolGWDeployScript()
-	joinNfsFinalizationFunc := j.FuncDef.GetFunctionCmdDefinition(functions_def.JoinNfsFinalization)
-	reportFunc := j.FuncDef.GetFunctionCmdDefinition(functions_def.Report)
-	joinScriptTemplate := `
-	interface_group_name="%s"
-
-	# join_nfs_finalization function definition
-	%s
-
-	# report function definition
-	%s
+	var groupNames, groupNics []string
+	for _, group := range j.interfaceGroups() {
+		groupNames = append(groupNames, group.InterfaceGroupName)
+		groupNics = append(groupNics, group.NicName)
+	}
 
-	instance_name="%s"
+	s := deployScriptGenerator.BaseProtocolGWDeployScriptBuilder().
+		Var("interface_group_names", groupNames).
+		Var("interface_group_nics", groupNics).
+		CloudFunctions(j.FuncDef, functions_def.JoinNfsFinalization, functions_def.Report).
+		Var("instance_name", j.Name)
 
+	s.Section("", `
 	function wait_for_nfs_interface_group(){
 	  max_retries=12 # 12 * 10 = 2 minutes
 	  for ((i=0; i<max_retries; i++)); do
-		status=$(weka_rest interfacegroups | jq .data | jq -r '.[] | select(.name == "'${interface_group_name}'").status')
+		status=$(weka_rest interfacegroups | jq .data | jq -r --arg name "$interface_group_name" '.[] | select(.name == $name).status')
 		if [ "$status" == "OK" ]; then
-			echo "$(date -u): interface group status: $status"
+			echo "$(date -u): interface group $interface_group_name status: $status"
 			break
 		fi
-		echo "$(date -u): waiting for interface group status to be OK, current status: $status"
+		echo "$(date -u): waiting for interface group $interface_group_name status to be OK, current status: $status"
 		sleep 10
 	  done
 	  if [ "$status" != "OK" ]; then
-		echo "$(date -u): failed to wait for the interface group status to be OK"
+		echo "$(date -u): failed to wait for the interface group $interface_group_name status to be OK"
 		return 1
 	  fi
 	}
 	
 	weka_rest interfacegroups | jq -r .data
-	interface_group_uid=$(weka_rest interfacegroups | jq -r .data[].uid)
-	weka_rest "interfacegroups/$interface_group_uid/ports/$container_uid" "{\"port\":\"$nic_name\"}"
+	for index in "${!interface_group_names[@]}"; do
+		interface_group_name=${interface_group_names[$index]}
+		port_nic_name=${interface_group_nics[$index]:-$nic_name}
+		interface_group_uid=$(weka_rest interfacegroups | jq -r --arg name "$interface_group_name" '.data[] | select(.name == $name).uid')
+		# a re-run of the script adds the port again, the interface group status tells whether it was added
+		weka_rest "interfacegroups/$interface_group_uid/ports/$container_uid" "$(json_object port "$port_nic_name")" || echo "$(date -u): failed to add port $port_nic_name to interface group $interface_group_name"
 
-	wait_for_nfs_interface_group || exit 1
+		wait_for_nfs_interface_group || exit 1
+	done
 	weka_rest interfacegroups | jq -r .data
 
 	echo "$(date -u): NFS setup complete"
 
-	join_nfs_finalization "{\"name\": \"$instance_name\", \"protocol\": \"nfs\"}"
+	join_nfs_finalization "$(json_object name "$instance_name" protocol "nfs")"
 	echo "completed successfully" > /tmp/weka_join_nfs_completion_validation
-	report "{\"hostname\": \"$HOSTNAME\", \"protocol\": \"nfs\", \"type\": \"progress\", \"message\": \"Joining new NFS instance completed successfully\"}"
-	`
-	nfsSetupScript := fmt.Sprintf(
-		joinScriptTemplate,
-		j.InterfaceGroupName,
-		joinNfsFinalizationFunc,
-		reportFunc,
-		j.Name,
+	report "$(json_object hostname "$HOSTNAME" protocol "nfs" type "progress" message "Joining new NFS instance completed successfully")"
+	`).Requires(
+		"report", "json_object", "join_nfs_finalization", "weka_rest",
+		"interface_group_names", "interface_group_nics", "instance_name", "container_uid", "nic_name",
 	)
 
-	return deploymentBashScript + dedent.Dedent(nfsSetupScript)
+	joinScript, err := s.Build()
+	if err != nil {
+		return common.GetErrorScript(err, j.FuncDef.GetFunctionCmdDefinition(functions_def.Report), protocol.NFS)
+	}
+	return joinScript
 }
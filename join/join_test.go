@@ -0,0 +1,97 @@
+package join
+
+import (
+	"context"
+	"testing"
+
+	"github.com/weka/go-cloud-lib/deploy"
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/script"
+	"github.com/weka/go-cloud-lib/script/scripttest"
+)
+
+func testGenerator() JoinScriptGenerator {
+	return JoinScriptGenerator{
+		DeviceNameCmd:      "/dev/sdb",
+		GetInstanceNameCmd: "hostname",
+		FindDrivesScript:   "\nimport json\n",
+		ScriptBase:         "#!/bin/bash\nset -ex\n",
+		Params: JoinParams{
+			// a single ip, as the ips are shuffled
+			IPs:            []string{"10.0.0.2"},
+			InstallDpdk:    true,
+			InstanceParams: protocol.BackendCoreCount{Compute: 2, Frontend: 1, Drive: 1, ComputeMemory: "10GB"},
+			Gateways:       []string{"10.0.0.1"},
+		},
+		FuncDef: scripttest.FunctionDef{},
+	}
+}
+
+func TestJoinScript(t *testing.T) {
+	tests := map[string]func(*JoinScriptGenerator){
+		"join":           func(j *JoinScriptGenerator) {},
+		"join_udp":       func(j *JoinScriptGenerator) { j.Params.InstallDpdk = false },
+		"join_no_fe":     func(j *JoinScriptGenerator) { j.Params.InstanceParams.Frontend = 0 },
+		"join_bm":        func(j *JoinScriptGenerator) { j.Params.IsBM = true },
+		"join_proxy":     func(j *JoinScriptGenerator) { j.Params.ProxyUrl = "http://proxy:8080"; j.Params.CgroupsMode = "none" },
+		"join_quoted":    func(j *JoinScriptGenerator) { j.Params.ProxyUrl = `http://proxy"$(reboot)'` },
+		"join_converged": func(j *JoinScriptGenerator) { j.Params.InstanceParams.Converged = true },
+		"join_layout": func(j *JoinScriptGenerator) {
+			j.Params.InstanceParams.Layout = (&protocol.ContainerLayout{}).
+				Add(protocol.DriveContainer, 2, 2, "").
+				Add(protocol.ComputeContainer, 2, 3, "20GB")
+		},
+	}
+
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			j := testGenerator()
+			modify(&j)
+
+			if err := j.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			scripttest.CheckGolden(t, name, j.GetJoinScript(context.Background()))
+		})
+	}
+}
+
+func TestExistingContainersJoinScript(t *testing.T) {
+	j := testGenerator()
+	joinScript := j.GetExistingContainersJoinScript(context.Background())
+	if err := script.Validate(joinScript); err != nil {
+		t.Fatal(err)
+	}
+	scripttest.CheckGolden(t, "join_existing_containers", joinScript)
+}
+
+func TestJoinNFSHostScript(t *testing.T) {
+	j := JoinNFSScriptGenerator{
+		DeviceNameCmd: "/dev/sdb",
+		DeploymentParams: deploy.DeploymentParams{
+			VMName:                    "weka-nfs-2",
+			WekaInstallUrl:            "https://get.weka.io/dist/v1/install/4.2.0/4.2.0",
+			WekaToken:                 "token",
+			InstallDpdk:               true,
+			Protocol:                  protocol.NFS,
+			NFSSecondaryIpsNum:        2,
+			ProtocolGatewayFeCoresNum: 1,
+			GetPrimaryIpCmd:           "hostname -I | awk '{print $1}'",
+		},
+		InterfaceGroupName: "weka-ig",
+		FuncDef:            scripttest.FunctionDef{},
+		Name:               "weka-nfs-2",
+	}
+	joinScript := j.GetJoinNFSHostScript()
+	if err := script.Validate(joinScript); err != nil {
+		t.Fatal(err)
+	}
+	scripttest.CheckGolden(t, "join_nfs", joinScript)
+
+	j.InterfaceGroups = []NFSInterfaceGroupPort{{InterfaceGroupName: "tenant-a", NicName: "eth1"}, {InterfaceGroupName: "tenant-b", NicName: "eth2"}}
+	joinScript = j.GetJoinNFSHostScript()
+	if err := script.Validate(joinScript); err != nil {
+		t.Fatal(err)
+	}
+	scripttest.CheckGolden(t, "join_nfs_groups", joinScript)
+}
@@ -0,0 +1,177 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed standard 5 fields cron expression: minute hour day-of-month month day-of-week
+type Schedule struct {
+	minute     map[int]bool
+	hour       map[int]bool
+	dayOfMonth map[int]bool
+	month      map[int]bool
+	dayOfWeek  map[int]bool
+	anyDom     bool
+	anyDow     bool
+}
+
+type bounds struct {
+	name string
+	min  int
+	max  int
+}
+
+var fieldsBounds = []bounds{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse parses expressions such as "0 9 * * 1-5", supporting '*', lists, ranges and steps
+func Parse(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(fieldsBounds) {
+		return nil, fmt.Errorf("invalid cron expression %q: expected %d fields, got %d", expr, len(fieldsBounds), len(fields))
+	}
+
+	var values []map[int]bool
+	for i, field := range fields {
+		fieldValues, err := parseField(field, fieldsBounds[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+		values = append(values, fieldValues)
+	}
+
+	// both 0 and 7 stand for sunday
+	if values[4][7] {
+		values[4][0] = true
+	}
+
+	return &Schedule{
+		minute:     values[0],
+		hour:       values[1],
+		dayOfMonth: values[2],
+		month:      values[3],
+		dayOfWeek:  values[4],
+		anyDom:     fields[2] == "*",
+		anyDow:     fields[4] == "*",
+	}, nil
+}
+
+func parseField(field string, b bounds) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %s field: %q", b.name, part)
+			}
+			part = part[:idx]
+		}
+
+		start, end := b.min, b.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			rangeParts := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			start, err1 = strconv.Atoi(rangeParts[0])
+			end, err2 = strconv.Atoi(rangeParts[1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid range in %s field: %q", b.name, part)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in %s field: %q", b.name, part)
+			}
+			start = value
+			if step == 1 {
+				end = value
+			}
+		}
+
+		if start < b.min || end > b.max || start > end {
+			return nil, fmt.Errorf("%s field value out of range [%d-%d]: %q", b.name, b.min, b.max, part)
+		}
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Matches returns true if t (truncated to the minute) matches the schedule
+func (s *Schedule) Matches(t time.Time) bool {
+	return s.minute[t.Minute()] && s.hour[t.Hour()] && s.month[int(t.Month())] && s.matchesDay(t)
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	domMatch := s.dayOfMonth[t.Day()]
+	dowMatch := s.dayOfWeek[int(t.Weekday())]
+	// standard cron semantics: if both day fields are restricted, either of them may match
+	if !s.anyDom && !s.anyDow {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Next returns the first matching minute strictly after t, or zero time if there is none before limit.
+// A field which doesn't match skips the candidate to the start of its next month, day or hour.
+func (s *Schedule) Next(t time.Time, limit time.Time) time.Time {
+	candidate := t.Truncate(time.Minute).Add(time.Minute)
+	for !candidate.After(limit) {
+		y, m, d := candidate.Date()
+		loc := candidate.Location()
+		var next time.Time
+		switch {
+		case !s.month[int(m)]:
+			next = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !s.matchesDay(candidate):
+			next = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !s.hour[candidate.Hour()]:
+			next = time.Date(y, m, d, candidate.Hour()+1, 0, 0, 0, loc)
+		case !s.minute[candidate.Minute()]:
+			next = candidate.Add(time.Minute)
+		default:
+			return candidate
+		}
+		// a daylight saving transition may map the start of the next hour back, the candidate must move forward
+		if !next.After(candidate) {
+			next = candidate.Add(time.Minute)
+		}
+		candidate = next
+	}
+	return time.Time{}
+}
+
+// Prev returns the last matching minute at or before t, or zero time if there is none since limit.
+// A field which doesn't match skips the candidate to the last minute of its previous month, day or hour.
+func (s *Schedule) Prev(t time.Time, limit time.Time) time.Time {
+	candidate := t.Truncate(time.Minute)
+	for !candidate.Before(limit) {
+		y, m, d := candidate.Date()
+		loc := candidate.Location()
+		switch {
+		case !s.month[int(m)]:
+			candidate = time.Date(y, m, 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !s.matchesDay(candidate):
+			candidate = time.Date(y, m, d, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !s.hour[candidate.Hour()]:
+			candidate = time.Date(y, m, d, candidate.Hour(), 0, 0, 0, loc).Add(-time.Minute)
+		case !s.minute[candidate.Minute()]:
+			candidate = candidate.Add(-time.Minute)
+		default:
+			return candidate
+		}
+	}
+	return time.Time{}
+}
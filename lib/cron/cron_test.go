@@ -0,0 +1,157 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		expr  string
+		valid bool
+	}{
+		{"every minute", "* * * * *", true},
+		{"lists, ranges and steps", "0,30 9-17 */2 1-12/3 1-5", true},
+		{"sunday as 7", "0 0 * * 7", true},
+		{"too few fields", "* * * *", false},
+		{"too many fields", "* * * * * *", false},
+		{"minute out of range", "60 * * * *", false},
+		{"day of month out of range", "* * 0 * *", false},
+		{"month out of range", "* * * 13 *", false},
+		{"reversed range", "5-1 * * * *", false},
+		{"zero step", "*/0 * * * *", false},
+		{"invalid value", "a * * * *", false},
+		{"invalid range", "1-a * * * *", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			if tt.valid && err != nil {
+				t.Errorf("Parse(%q) failed: %v", tt.expr, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("Parse(%q) succeeded; want an error", tt.expr)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		time    time.Time
+		matches bool
+	}{
+		{"step", "*/15 * * * *", time.Date(2024, 1, 8, 10, 30, 0, 0, time.UTC), true},
+		{"step miss", "*/15 * * * *", time.Date(2024, 1, 8, 10, 31, 0, 0, time.UTC), false},
+		{"step from value", "5/20 * * * *", time.Date(2024, 1, 8, 10, 45, 0, 0, time.UTC), true},
+		{"step from value miss", "5/20 * * * *", time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC), false},
+		{"step of range", "1-10/3 * * * *", time.Date(2024, 1, 8, 10, 7, 0, 0, time.UTC), true},
+		{"step of range miss", "1-10/3 * * * *", time.Date(2024, 1, 8, 10, 8, 0, 0, time.UTC), false},
+		{"business hours", "* 9-17 * * 1-5", time.Date(2024, 1, 8, 17, 59, 0, 0, time.UTC), true},
+		{"business hours at night", "* 9-17 * * 1-5", time.Date(2024, 1, 8, 18, 0, 0, 0, time.UTC), false},
+		{"business hours on saturday", "* 9-17 * * 1-5", time.Date(2024, 1, 13, 10, 0, 0, 0, time.UTC), false},
+		{"list", "0 0 1,15 * *", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), true},
+		{"list miss", "0 0 1,15 * *", time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), false},
+		{"month", "0 0 * 2 *", time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), false},
+		{"sunday as 0", "0 0 * * 0", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC), true},
+		{"sunday as 7", "0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC), true},
+		// both day fields restricted, either of them matches
+		{"day of month or day of week, monday", "0 0 1 * 1", time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), true},
+		{"day of month or day of week, 1st", "0 0 1 * 1", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), true},
+		{"day of month or day of week, neither", "0 0 1 * 1", time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC), false},
+		// a single restricted day field must match
+		{"day of week only", "0 0 * * 1", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), false},
+		{"day of month only", "0 0 1 * *", time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if schedule.Matches(tt.time) != tt.matches {
+				t.Errorf("Matches(%s) = %t; want %t", tt.time, !tt.matches, tt.matches)
+			}
+		})
+	}
+}
+
+func TestNextPrev(t *testing.T) {
+	schedule, err := Parse("0 9 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Friday evening
+	friday := time.Date(2024, 1, 12, 18, 0, 0, 0, time.UTC)
+	monday := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		find     func(t time.Time, limit time.Time) time.Time
+		from     time.Time
+		limit    time.Time
+		expected time.Time
+	}{
+		{"next after the weekend", schedule.Next, friday, friday.Add(7 * 24 * time.Hour), monday},
+		{"next is strictly after", schedule.Next, monday, monday.Add(7 * 24 * time.Hour), monday.Add(24 * time.Hour)},
+		{"next beyond limit", schedule.Next, friday, friday.Add(24 * time.Hour), time.Time{}},
+		{"prev before the weekend", schedule.Prev, monday.Add(-time.Minute), friday.Add(-7 * 24 * time.Hour), friday.Add(-9 * time.Hour)},
+		{"prev includes the time", schedule.Prev, monday, friday, monday},
+		{"prev beyond limit", schedule.Prev, monday.Add(-time.Minute), friday, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := tt.find(tt.from, tt.limit); !result.Equal(tt.expected) {
+				t.Errorf("got %s; want %s", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNextPrevSkipAhead(t *testing.T) {
+	// only on leap days
+	leapDay, err := Parse("30 12 29 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nightly, err := Parse("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	expectedNext := time.Date(2028, 2, 29, 12, 30, 0, 0, time.UTC)
+	expectedPrev := time.Date(2024, 2, 29, 12, 30, 0, 0, time.UTC)
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// the clocks go back from 2:00 to 1:00
+	fallBack := time.Date(2024, 11, 3, 1, 59, 0, 0, newYork)
+
+	tests := []struct {
+		name     string
+		find     func(t time.Time, limit time.Time) time.Time
+		from     time.Time
+		limit    time.Time
+		expected time.Time
+	}{
+		{"next years ahead", leapDay.Next, from, from.AddDate(4, 0, 0), expectedNext},
+		{"prev years behind", leapDay.Prev, from, from.AddDate(-4, 0, 0), expectedPrev},
+		{"next beyond limit", leapDay.Next, from, from.AddDate(2, 0, 0), time.Time{}},
+		{"next across daylight saving", nightly.Next, fallBack, fallBack.Add(24 * time.Hour), time.Date(2024, 11, 3, 2, 30, 0, 0, newYork)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := tt.find(tt.from, tt.limit); !result.Equal(tt.expected) {
+				t.Errorf("got %s; want %s", result, tt.expected)
+			}
+		})
+	}
+}
@@ -21,6 +21,30 @@ const (
 	JrpcInterfaceGroupList       JrpcMethod = "interface_group_list"
 	JrpcInterfaceGroupDeletePort JrpcMethod = "interface_group_delete_port"
 	JrpcManualOverrideList       JrpcMethod = "manual_override_list"
+	JrpcNfsClientGroupList       JrpcMethod = "nfs_client_group_list"
+	JrpcNfsClientGroupAdd        JrpcMethod = "nfs_client_group_add"
+	JrpcNfsClientGroupAddRule    JrpcMethod = "nfs_client_group_add_rule"
+	JrpcNfsClientGroupDeleteRule JrpcMethod = "nfs_client_group_delete_rule"
+	JrpcNfsPermissionList        JrpcMethod = "nfs_permission_list"
+	JrpcNfsPermissionAdd         JrpcMethod = "nfs_permission_add"
+	JrpcNfsPermissionUpdate      JrpcMethod = "nfs_permission_update"
+	JrpcNfsPermissionDelete      JrpcMethod = "nfs_permission_delete"
+	JrpcClusterCreate            JrpcMethod = "cluster_create"
+	JrpcUserAdd                  JrpcMethod = "user_add"
+	JrpcUserList                 JrpcMethod = "user_list"
+	JrpcAddDrives                JrpcMethod = "cluster_add_drives"
+	JrpcClusterUpdate            JrpcMethod = "cluster_update"
+	JrpcSetHotSpare              JrpcMethod = "cluster_set_hot_spare"
+	JrpcStartIo                  JrpcMethod = "cluster_start_io"
+	JrpcFilesystemGroupList      JrpcMethod = "filesystem_group_list"
+	JrpcFilesystemGroupCreate    JrpcMethod = "filesystem_group_create"
+	JrpcFilesystemList           JrpcMethod = "filesystems_list"
+	JrpcFilesystemCreate         JrpcMethod = "filesystem_create"
+	JrpcNfsGlobalConfigSet       JrpcMethod = "nfs_global_config_set"
+	JrpcDataServiceConfigSet     JrpcMethod = "dataservice_global_config_set"
+	JrpcCloudProxySet            JrpcMethod = "cloud_set_proxy"
+	JrpcCloudEnable              JrpcMethod = "cloud_enable"
+	JrpcAlertsMute               JrpcMethod = "alerts_mute"
 )
 
 type HostListResponse map[HostId]Host
@@ -28,6 +52,11 @@ type DriveListResponse map[DriveId]Drive
 type NodeListResponse map[NodeId]Node
 type InterfaceGroupListResponse []InterfaceGroup
 type ManualDebugOverrideListResponse map[OverrideId]DebugOverride
+type UserListResponse []User
+type FilesystemGroupListResponse map[string]FilesystemGroup
+type FilesystemListResponse map[string]Filesystem
+type NfsClientGroupListResponse []NfsClientGroup
+type NfsPermissionListResponse []NfsPermission
 
 type Activity struct {
 	NumOps                    float32 `json:"num_ops"`
@@ -49,11 +78,18 @@ type ClusterCount struct {
 	Clients     HostsCount `json:"clients"`
 	TotalCount  int        `json:"total_count"`
 }
+type StatusCapacity struct {
+	TotalBytes         int64 `json:"total_bytes"`
+	UnprovisionedBytes int64 `json:"unprovisioned_bytes"`
+}
+
 type StatusResponse struct {
-	IoStatus string       `json:"io_status"`
-	Upgrade  string       `json:"upgrade"`
-	Activity Activity     `json:"activity"`
-	Hosts    ClusterCount `json:"hosts"`
+	IoStatus  string         `json:"io_status"`
+	Upgrade   string         `json:"upgrade"`
+	Activity  Activity       `json:"activity"`
+	Hosts     ClusterCount   `json:"hosts"`
+	IsCluster bool           `json:"is_cluster"`
+	Capacity  StatusCapacity `json:"capacity"`
 }
 
 type Host struct {
@@ -106,6 +142,43 @@ type InterfaceGroup struct {
 	Status          string               `json:"status"`
 }
 
+type User struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type FilesystemGroup struct {
+	Name string `json:"name"`
+}
+
+type Filesystem struct {
+	Name      string `json:"name"`
+	GroupName string `json:"group_name"`
+}
+
+type NfsClientGroupRule struct {
+	Uid  string `json:"uid"`
+	Type string `json:"type"` // IP or DNS
+	Rule string `json:"rule"`
+}
+
+type NfsClientGroup struct {
+	Uid   string               `json:"uid"`
+	Name  string               `json:"name"`
+	Rules []NfsClientGroupRule `json:"rules"`
+}
+
+type NfsPermission struct {
+	Uid            string `json:"uid"`
+	Filesystem     string `json:"filesystem"`
+	Group          string `json:"group"`
+	Path           string `json:"path"`
+	PermissionType string `json:"permission_type"`
+	SquashMode     string `json:"squash_mode"`
+	AnonUid        int    `json:"anon_uid"`
+	AnonGid        int    `json:"anon_gid"`
+}
+
 type DebugOverride struct {
 	BucketId     string      `json:"bucket_id"`
 	BucketString string      `json:"bucket_string"`
@@ -0,0 +1,186 @@
+package nfs_permissions
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/types"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// Change is a JRPC call bringing the cluster closer to the desired client groups
+type Change struct {
+	Method      weka.JrpcMethod
+	Params      types.JsonDict
+	Description string
+}
+
+// Diff returns the changes making the rules and permissions of the desired client groups on the cluster match them.
+// Client groups which are not desired are not managed, and are left as they are.
+func Diff(desired []protocol.NFSClientGroup, clientGroups weka.NfsClientGroupListResponse, permissions weka.NfsPermissionListResponse) (changes []Change) {
+	currentGroups := make(map[string]weka.NfsClientGroup)
+	for _, clientGroup := range clientGroups {
+		currentGroups[clientGroup.Name] = clientGroup
+	}
+
+	for _, group := range desired {
+		current, exists := currentGroups[group.Name]
+		if !exists {
+			changes = append(changes, Change{
+				Method:      weka.JrpcNfsClientGroupAdd,
+				Params:      types.JsonDict{"name": group.Name},
+				Description: fmt.Sprintf("add client group %s", group.Name),
+			})
+		}
+		changes = append(changes, diffRules(group, current)...)
+		changes = append(changes, diffPermissions(group, permissions)...)
+	}
+	return
+}
+
+func diffRules(group protocol.NFSClientGroup, current weka.NfsClientGroup) (changes []Change) {
+	desiredRules := make(map[string]string) // rule -> type
+	for _, ip := range group.Ips {
+		desiredRules[ip] = "IP"
+	}
+	for _, dns := range group.Dns {
+		desiredRules[dns] = "DNS"
+	}
+
+	currentRules := make(map[string]bool)
+	for _, rule := range current.Rules {
+		if ruleType, ok := desiredRules[rule.Rule]; ok && ruleType == rule.Type {
+			currentRules[rule.Rule] = true
+			continue
+		}
+		changes = append(changes, Change{
+			Method:      weka.JrpcNfsClientGroupDeleteRule,
+			Params:      types.JsonDict{"name": group.Name, "rule_uid": rule.Uid},
+			Description: fmt.Sprintf("delete %s rule %s of client group %s", rule.Type, rule.Rule, group.Name),
+		})
+	}
+
+	add := func(ruleType, key, rule string) {
+		if currentRules[rule] {
+			return
+		}
+		changes = append(changes, Change{
+			Method:      weka.JrpcNfsClientGroupAddRule,
+			Params:      types.JsonDict{"name": group.Name, key: rule},
+			Description: fmt.Sprintf("add %s rule %s to client group %s", ruleType, rule, group.Name),
+		})
+	}
+	for _, ip := range group.Ips {
+		add("IP", "ip", ip)
+	}
+	for _, dns := range group.Dns {
+		add("DNS", "dns", dns)
+	}
+	return
+}
+
+func diffPermissions(group protocol.NFSClientGroup, permissions weka.NfsPermissionListResponse) (changes []Change) {
+	desired := make(map[string]protocol.NFSPermission)
+	for _, permission := range group.Permissions {
+		permission = permission.WithDefaults()
+		desired[exportKey(permission.Filesystem, permission.Path)] = permission
+	}
+
+	existing := make(map[string]bool)
+	for _, current := range permissions {
+		if current.Group != group.Name {
+			continue
+		}
+		key := exportKey(current.Filesystem, current.Path)
+		permission, ok := desired[key]
+		if !ok {
+			changes = append(changes, Change{
+				Method:      weka.JrpcNfsPermissionDelete,
+				Params:      types.JsonDict{"uid": current.Uid},
+				Description: fmt.Sprintf("delete permission of client group %s on %s", group.Name, key),
+			})
+			continue
+		}
+		existing[key] = true
+		if current.PermissionType != string(permission.AccessType) || current.SquashMode != string(permission.SquashMode) ||
+			current.AnonUid != permission.AnonUid || current.AnonGid != permission.AnonGid {
+			params := permissionParams(group.Name, permission)
+			params["uid"] = current.Uid
+			changes = append(changes, Change{
+				Method:      weka.JrpcNfsPermissionUpdate,
+				Params:      params,
+				Description: fmt.Sprintf("update permission of client group %s on %s", group.Name, key),
+			})
+		}
+	}
+
+	for _, permission := range group.Permissions {
+		permission = permission.WithDefaults()
+		key := exportKey(permission.Filesystem, permission.Path)
+		if existing[key] {
+			continue
+		}
+		existing[key] = true
+		changes = append(changes, Change{
+			Method:      weka.JrpcNfsPermissionAdd,
+			Params:      permissionParams(group.Name, permission),
+			Description: fmt.Sprintf("add permission of client group %s on %s", group.Name, key),
+		})
+	}
+	return
+}
+
+func permissionParams(group string, permission protocol.NFSPermission) types.JsonDict {
+	return types.JsonDict{
+		"filesystem":      permission.Filesystem,
+		"group":           group,
+		"path":            permission.Path,
+		"permission_type": permission.AccessType,
+		"squash_mode":     permission.SquashMode,
+		"anon_uid":        permission.AnonUid,
+		"anon_gid":        permission.AnonGid,
+	}
+}
+
+func exportKey(filesystem, path string) string {
+	return filesystem + ":" + path
+}
+
+// Reconcile applies the changes of Diff against the current client groups and permissions of the cluster, and
+// returns the applied changes. It stops at the first failing change, re-running it continues from there.
+func Reconcile(ctx context.Context, jpool *jrpc.Pool, desired []protocol.NFSClientGroup) (applied []Change, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	for _, group := range desired {
+		if err = group.Validate(); err != nil {
+			return
+		}
+	}
+
+	clientGroups := weka.NfsClientGroupListResponse{}
+	err = jpool.Call(weka.JrpcNfsClientGroupList, struct{}{}, &clientGroups)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	permissions := weka.NfsPermissionListResponse{}
+	err = jpool.Call(weka.JrpcNfsPermissionList, struct{}{}, &permissions)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	for _, change := range Diff(desired, clientGroups, permissions) {
+		logger.Info().Msgf("NFS permissions: %s", change.Description)
+		err = jpool.Call(change.Method, change.Params, nil)
+		if err != nil {
+			logger.Error().Err(err).Msgf("failed to %s", change.Description)
+			err = fmt.Errorf("failed to %s: %w", change.Description, err)
+			return
+		}
+		applied = append(applied, change)
+	}
+	return
+}
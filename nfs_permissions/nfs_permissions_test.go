@@ -0,0 +1,66 @@
+package nfs_permissions
+
+import (
+	"testing"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestDiff(t *testing.T) {
+	desired := []protocol.NFSClientGroup{
+		{
+			Name: "tenant-a",
+			Ips:  []string{"10.1.0.0/16", "10.3.0.0/16"},
+			Permissions: []protocol.NFSPermission{
+				{Filesystem: "default"},
+				{Filesystem: "archive", AccessType: protocol.NFSReadOnly},
+			},
+		},
+		{Name: "tenant-b", Dns: []string{"*.b.example.com"}, Permissions: []protocol.NFSPermission{{Filesystem: "default"}}},
+	}
+	clientGroups := weka.NfsClientGroupListResponse{
+		{Uid: "g1", Name: "tenant-a", Rules: []weka.NfsClientGroupRule{
+			{Uid: "r1", Type: "IP", Rule: "10.1.0.0/16"},
+			{Uid: "r2", Type: "IP", Rule: "10.2.0.0/16"},
+		}},
+		{Uid: "g9", Name: "unmanaged", Rules: []weka.NfsClientGroupRule{{Uid: "r9", Type: "IP", Rule: "0.0.0.0/0"}}},
+	}
+	permissions := weka.NfsPermissionListResponse{
+		{Uid: "p1", Filesystem: "default", Group: "tenant-a", Path: "/", PermissionType: "RW", SquashMode: "root", AnonUid: 65534, AnonGid: 65534},
+		{Uid: "p2", Filesystem: "archive", Group: "tenant-a", Path: "/", PermissionType: "RW", SquashMode: "root", AnonUid: 65534, AnonGid: 65534},
+		{Uid: "p3", Filesystem: "scratch", Group: "tenant-a", Path: "/", PermissionType: "RW", SquashMode: "root", AnonUid: 65534, AnonGid: 65534},
+		{Uid: "p9", Filesystem: "default", Group: "unmanaged", Path: "/", PermissionType: "RW", SquashMode: "none"},
+	}
+
+	expected := []string{
+		"delete IP rule 10.2.0.0/16 of client group tenant-a",
+		"add IP rule 10.3.0.0/16 to client group tenant-a",
+		"update permission of client group tenant-a on archive:/",
+		"delete permission of client group tenant-a on scratch:/",
+		"add client group tenant-b",
+		"add DNS rule *.b.example.com to client group tenant-b",
+		"add permission of client group tenant-b on default:/",
+	}
+	changes := Diff(desired, clientGroups, permissions)
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), changes)
+	}
+	for i, change := range changes {
+		if change.Description != expected[i] {
+			t.Errorf("change %d: expected %q, got %q", i, expected[i], change.Description)
+		}
+	}
+	if changes[2].Params["uid"] != "p2" || changes[2].Params["permission_type"] != protocol.NFSReadOnly {
+		t.Errorf("unexpected update params %v", changes[2].Params)
+	}
+
+	// applying the desired state leaves nothing to change
+	permissions[1].PermissionType = "RO"
+	clientGroups[0].Rules = []weka.NfsClientGroupRule{{Uid: "r1", Type: "IP", Rule: "10.1.0.0/16"}, {Uid: "r3", Type: "IP", Rule: "10.3.0.0/16"}}
+	clientGroups = append(clientGroups, weka.NfsClientGroup{Uid: "g2", Name: "tenant-b", Rules: []weka.NfsClientGroupRule{{Uid: "r4", Type: "DNS", Rule: "*.b.example.com"}}})
+	permissions = append(permissions[:2], weka.NfsPermission{Uid: "p4", Filesystem: "default", Group: "tenant-b", Path: "/", PermissionType: "RW", SquashMode: "root", AnonUid: 65534, AnonGid: 65534})
+	if changes = Diff(desired, clientGroups, permissions); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
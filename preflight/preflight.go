@@ -0,0 +1,136 @@
+package preflight
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	DefaultMaxClockSkew = 5 * time.Second
+	// memoryTolerance is the relative memory difference between VMs of the same type, as some memory is reserved
+	memoryTolerance = 0.05
+)
+
+// Params are the expectations the inventories are validated against, zero values aren't checked
+type Params struct {
+	Hostnames    []string // the VMs expected to report, defaults to ClusterizationTarget VMs of any hostname
+	WekaVersion  string
+	MinCores     int
+	MinDrives    int
+	MinNics      int
+	InstallDpdk  bool          // the data NICs must be DPDK capable
+	MaxClockSkew time.Duration // between any two VMs, defaults to DefaultMaxClockSkew
+}
+
+// Validate checks the inventories of the state against params and one another
+func Validate(state *protocol.ClusterState, params Params) protocol.PreflightReport {
+	report := protocol.PreflightReport{
+		Errors:      []string{},
+		Warnings:    []string{},
+		Missing:     []string{},
+		Inventories: state.Inventories,
+		CheckedAt:   time.Now().UTC(),
+	}
+	errorf := func(format string, args ...interface{}) {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+	}
+
+	if len(params.Hostnames) > 0 {
+		for _, hostname := range params.Hostnames {
+			if _, ok := state.Inventories[hostname]; !ok {
+				report.Missing = append(report.Missing, hostname)
+			}
+		}
+		if len(report.Missing) > 0 {
+			errorf("missing inventories of %s", strings.Join(report.Missing, ", "))
+		}
+	} else if len(state.Inventories) < state.ClusterizationTarget {
+		errorf("%d of %d inventories were reported", len(state.Inventories), state.ClusterizationTarget)
+	}
+
+	hostnames := make([]string, 0, len(state.Inventories))
+	for hostname := range state.Inventories {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	if len(hostnames) == 0 {
+		return report
+	}
+
+	maxClockSkew := params.MaxClockSkew
+	if maxClockSkew == 0 {
+		maxClockSkew = DefaultMaxClockSkew
+	}
+	first := state.Inventories[hostnames[0]]
+	earliest, latest := hostnames[0], hostnames[0]
+	for _, hostname := range hostnames {
+		inventory := state.Inventories[hostname]
+
+		if params.WekaVersion != "" && inventory.WekaVersion != params.WekaVersion {
+			errorf("%s: weka version %s, expected %s", hostname, inventory.WekaVersion, params.WekaVersion)
+		} else if inventory.WekaVersion != first.WekaVersion {
+			errorf("%s: weka version %s differs from %s of %s", hostname, inventory.WekaVersion, first.WekaVersion, hostnames[0])
+		}
+		if inventory.Cores < params.MinCores {
+			errorf("%s: %d cores, at least %d are required", hostname, inventory.Cores, params.MinCores)
+		} else if inventory.Cores != first.Cores {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %d cores differ from %d of %s", hostname, inventory.Cores, first.Cores, hostnames[0]))
+		}
+		if math.Abs(float64(inventory.MemoryBytes-first.MemoryBytes)) > memoryTolerance*float64(first.MemoryBytes) {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %d memory bytes differ from %d of %s", hostname, inventory.MemoryBytes, first.MemoryBytes, hostnames[0]))
+		}
+
+		if len(inventory.Drives) == 0 {
+			errorf("%s: no NVMe drives were found", hostname)
+		} else if len(inventory.Drives) < params.MinDrives {
+			errorf("%s: %d NVMe drives, at least %d are required", hostname, len(inventory.Drives), params.MinDrives)
+		} else if len(inventory.Drives) != len(first.Drives) {
+			errorf("%s: %d NVMe drives differ from %d of %s", hostname, len(inventory.Drives), len(first.Drives), hostnames[0])
+		}
+
+		if len(inventory.Nics) < params.MinNics {
+			errorf("%s: %d NICs, at least %d are required", hostname, len(inventory.Nics), params.MinNics)
+		} else if len(inventory.Nics) != len(first.Nics) {
+			errorf("%s: %d NICs differ from %d of %s", hostname, len(inventory.Nics), len(first.Nics), hostnames[0])
+		}
+		for i, nic := range inventory.DataNics() {
+			firstNics := first.DataNics()
+			if i < len(firstNics) && nic.Mtu != firstNics[i].Mtu {
+				errorf("%s: MTU %d of %s differs from %d of %s on %s", hostname, nic.Mtu, nic.Name, firstNics[i].Mtu, firstNics[i].Name, hostnames[0])
+			}
+		}
+		if params.InstallDpdk && !inventory.DpdkCapable() {
+			errorf("%s: the data NICs aren't DPDK capable", hostname)
+		}
+
+		if inventory.ClockSkew() < state.Inventories[earliest].ClockSkew() {
+			earliest = hostname
+		}
+		if inventory.ClockSkew() > state.Inventories[latest].ClockSkew() {
+			latest = hostname
+		}
+	}
+	if skew := state.Inventories[latest].ClockSkew() - state.Inventories[earliest].ClockSkew(); skew > maxClockSkew {
+		errorf("clock of %s is %s ahead of %s, at most %s is allowed", latest, skew, earliest, maxClockSkew)
+	}
+
+	report.Passed = len(report.Errors) == 0
+	return report
+}
+
+// Check validates the inventories, sets the report on reports and returns an error if the clusterization is blocked
+func Check(state *protocol.ClusterState, params Params, reports *protocol.Reports) error {
+	report := Validate(state, params)
+	if reports != nil {
+		reports.Preflight = &report
+	}
+	if !report.Passed {
+		return fmt.Errorf("preflight failed: %s", strings.Join(report.Errors, "; "))
+	}
+	return nil
+}
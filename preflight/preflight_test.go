@@ -0,0 +1,70 @@
+package preflight
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func inventory(receivedAt time.Time) protocol.Inventory {
+	return protocol.Inventory{
+		WekaVersion: "4.4.2",
+		Cores:       48,
+		MemoryBytes: 384 << 30,
+		Drives:      []string{"/dev/nvme0n1", "/dev/nvme1n1"},
+		Nics: []protocol.InventoryNic{
+			{Name: "eth0", Mtu: 1500, Driver: "hv_netvsc", DpdkCapable: true},
+			{Name: "eth1", Mtu: 9000, Driver: "mlx5_core", DpdkCapable: true},
+		},
+		ClockUnixMs: receivedAt.UnixMilli(),
+		ReceivedAt:  receivedAt,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	state := &protocol.ClusterState{
+		ClusterizationTarget: 3,
+		Inventories: map[string]protocol.Inventory{
+			"weka-1": inventory(now),
+			"weka-2": inventory(now.Add(time.Second)),
+			"weka-3": inventory(now),
+		},
+	}
+	params := Params{WekaVersion: "4.4.2", MinCores: 32, MinDrives: 2, MinNics: 2, InstallDpdk: true}
+	reports := &protocol.Reports{}
+	if err := Check(state, params, reports); err != nil || !reports.Preflight.Passed {
+		t.Fatalf("expected preflight to pass, got %v", err)
+	}
+
+	mismatched := inventory(now)
+	mismatched.WekaVersion = "4.4.1"
+	mismatched.Drives = mismatched.Drives[:1]
+	mismatched.Nics[1].Mtu = 1500
+	mismatched.Nics[1].DpdkCapable = false
+	mismatched.MemoryBytes = 256 << 30
+	mismatched.ClockUnixMs = now.Add(10 * time.Second).UnixMilli()
+	state.Inventories["weka-3"] = mismatched
+	params.Hostnames = []string{"weka-1", "weka-2", "weka-3", "weka-4"}
+
+	err := Check(state, params, reports)
+	if err == nil || reports.Preflight.Passed {
+		t.Fatal("expected preflight to fail")
+	}
+	expected := []string{
+		"missing inventories of weka-4",
+		"weka-3: weka version 4.4.1, expected 4.4.2",
+		"weka-3: 1 NVMe drives, at least 2 are required",
+		"weka-3: MTU 1500 of eth1 differs from 9000 of eth1 on weka-1",
+		"weka-3: the data NICs aren't DPDK capable",
+		"clock of weka-3 is 10s ahead of weka-1, at most 5s is allowed",
+	}
+	if strings.Join(reports.Preflight.Errors, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected errors:\n%s", strings.Join(reports.Preflight.Errors, "\n"))
+	}
+	if len(reports.Preflight.Warnings) != 1 || !strings.HasPrefix(reports.Preflight.Warnings[0], "weka-3: 274877906944 memory bytes") {
+		t.Errorf("expected a memory warning, got %v", reports.Preflight.Warnings)
+	}
+}
@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+)
+
+type ContainerRole string
+
+const (
+	DriveContainer    ContainerRole = "drive"
+	ComputeContainer  ContainerRole = "compute"
+	FrontendContainer ContainerRole = "frontend"
+)
+
+// ContainerPortsStep is the distance between the base ports of the containers of a default layout
+const ContainerPortsStep = 1000
+
+// ConvergedComputeMemory limits the compute container memory of converged instances without a ComputeMemory
+const ConvergedComputeMemory = "8GB"
+
+// containerNamePrefixes keeps the container names of the original layout: drives0, compute0 and frontend0
+var containerNamePrefixes = map[ContainerRole]string{
+	DriveContainer:    "drives",
+	ComputeContainer:  "compute",
+	FrontendContainer: "frontend",
+}
+
+var containerName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ContainerSpec describes a weka container of a backend instance
+type ContainerSpec struct {
+	Name     string
+	Role     ContainerRole
+	BasePort int
+	Cores    int
+	Memory   string // compute containers only, empty for the weka default
+}
+
+// ContainerLayout describes the weka containers of a backend instance, in setup order
+type ContainerLayout struct {
+	Containers []ContainerSpec
+	Converged  bool // the instance is shared with application workloads, the containers don't dedicate it to weka
+}
+
+// Add appends count containers of the given role, named and ported after the containers already in the layout
+func (l *ContainerLayout) Add(role ContainerRole, count, cores int, memory string) *ContainerLayout {
+	for i := 0; i < count; i++ {
+		l.Containers = append(l.Containers, ContainerSpec{
+			Name:     fmt.Sprintf("%s%d", containerNamePrefixes[role], len(l.ByRole(role))),
+			Role:     role,
+			BasePort: weka.ManagementJrpcPort + len(l.Containers)*ContainerPortsStep,
+			Cores:    cores,
+			Memory:   memory,
+		})
+	}
+	return l
+}
+
+func (l ContainerLayout) ByRole(role ContainerRole) (containers []ContainerSpec) {
+	for _, container := range l.Containers {
+		if container.Role == role {
+			containers = append(containers, container)
+		}
+	}
+	return
+}
+
+func (l ContainerLayout) Names() (names []string) {
+	for _, container := range l.Containers {
+		names = append(names, container.Name)
+	}
+	return
+}
+
+func (l ContainerLayout) Ports() (ports []int) {
+	for _, container := range l.Containers {
+		ports = append(ports, container.BasePort)
+	}
+	return
+}
+
+func (l ContainerLayout) Validate() error {
+	var errs []error
+	if len(l.ByRole(DriveContainer)) == 0 {
+		errs = append(errs, fmt.Errorf("layout has no drive container"))
+	}
+	if len(l.ByRole(ComputeContainer)) == 0 {
+		errs = append(errs, fmt.Errorf("layout has no compute container"))
+	}
+	if len(l.Containers) > 0 && l.Containers[0].BasePort != weka.ManagementJrpcPort {
+		errs = append(errs, fmt.Errorf("first container %s must use base port %d", l.Containers[0].Name, weka.ManagementJrpcPort))
+	}
+
+	names := make(map[string]bool)
+	ports := make(map[int]bool)
+	for _, container := range l.Containers {
+		if !containerName.MatchString(container.Name) {
+			errs = append(errs, fmt.Errorf("invalid container name %q", container.Name))
+		}
+		if names[container.Name] {
+			errs = append(errs, fmt.Errorf("duplicate container name %s", container.Name))
+		}
+		names[container.Name] = true
+		if ports[container.BasePort] {
+			errs = append(errs, fmt.Errorf("duplicate base port %d", container.BasePort))
+		}
+		ports[container.BasePort] = true
+		if _, ok := containerNamePrefixes[container.Role]; !ok {
+			errs = append(errs, fmt.Errorf("container %s has invalid role %q", container.Name, container.Role))
+		}
+		if container.Cores <= 0 {
+			errs = append(errs, fmt.Errorf("container %s has no cores", container.Name))
+		}
+		if container.Memory != "" && container.Role != ComputeContainer {
+			errs = append(errs, fmt.Errorf("container %s: memory can be set on compute containers only", container.Name))
+		}
+		if l.Converged && container.Role == ComputeContainer && container.Memory == "" {
+			errs = append(errs, fmt.Errorf("converged container %s must have a memory limit", container.Name))
+		}
+	}
+	if l.Converged && len(l.ByRole(FrontendContainer)) == 0 {
+		errs = append(errs, fmt.Errorf("converged layout has no frontend container for local mounts"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+// DefaultContainerLayout is the layout of instances without an explicit one: drives0, compute0 and frontend0
+// if frontend cores are set
+func DefaultContainerLayout(drive, compute, frontend int, computeMemory string) ContainerLayout {
+	layout := &ContainerLayout{}
+	layout.Add(DriveContainer, 1, drive, "").Add(ComputeContainer, 1, compute, computeMemory)
+	if frontend > 0 {
+		layout.Add(FrontendContainer, 1, frontend, "")
+	}
+	return *layout
+}
+
+// ConvergedContainerLayout is the layout of instances shared with application workloads: drives0 and compute0 on half
+// of the drive and compute cores, the compute memory limited, and a single core frontend0 for local mounts
+func ConvergedContainerLayout(drive, compute int, computeMemory string) ContainerLayout {
+	if computeMemory == "" {
+		computeMemory = ConvergedComputeMemory
+	}
+	layout := &ContainerLayout{Converged: true}
+	layout.Add(DriveContainer, 1, max(1, drive/2), "").
+		Add(ComputeContainer, 1, max(1, compute/2), computeMemory).
+		Add(FrontendContainer, 1, 1, "")
+	return *layout
+}
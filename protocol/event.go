@@ -0,0 +1,50 @@
+package protocol
+
+import "time"
+
+type Severity string
+
+const (
+	SeverityDebug   Severity = "debug"
+	SeverityInfo    Severity = "info"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+var severityLevels = map[Severity]int{SeverityDebug: 0, SeverityInfo: 1, SeverityWarning: 2, SeverityError: 3}
+
+// AtLeast returns whether s is as severe as other, unknown severities are the least severe
+func (s Severity) AtLeast(other Severity) bool {
+	return severityLevels[s] >= severityLevels[other]
+}
+
+// Event is a structured report, kept in ClusterState.Events in the order of arrival
+type Event struct {
+	Seq        int64             `json:"seq"` // increasing in ClusterState, a paging cursor
+	Time       time.Time         `json:"time"`
+	Phase      string            `json:"phase,omitempty"`   // e.g. a deploy script step name, or clusterization
+	StepId     string            `json:"step_id,omitempty"` // the step within the phase
+	Severity   Severity          `json:"severity"`
+	Hostname   string            `json:"hostname"`
+	InstanceId string            `json:"instance_id,omitempty"`
+	Protocol   ProtocolGW        `json:"protocol,omitempty"`
+	ErrorCode  string            `json:"error_code,omitempty"`
+	Message    string            `json:"message"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// EventSummary summarizes the compacted events of a host, which were dropped by the retention policy
+type EventSummary struct {
+	Count     int       `json:"count"`
+	Errors    int       `json:"errors"`
+	Warnings  int       `json:"warnings"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// EventsPage is a page of events in order, NextCursor is the cursor of the next page or 0 if it's the last one
+type EventsPage struct {
+	Events     []Event `json:"events"`
+	NextCursor int64   `json:"next_cursor"`
+}
@@ -43,6 +43,9 @@ type InstanceRefreshState struct {
 	// Instance tracking - snapshot of original instances at start
 	OriginalInstanceIds []string `json:"original_instance_ids"`
 
+	// The original instances retired by each iteration, empty if scale down picks them
+	IterationTargetIds [][]string `json:"iteration_target_ids,omitempty"`
+
 	// Timing
 	StartedAt          time.Time  `json:"started_at"`
 	UpdatedAt          time.Time  `json:"updated_at"`
@@ -54,6 +57,18 @@ type InstanceRefreshState struct {
 
 	// Error tracking
 	LastError *string `json:"last_error,omitempty"`
+
+	// Set while the scale policy doesn't allow scale operations
+	DeferredUntil  *time.Time `json:"deferred_until,omitempty"`
+	DeferredReason string     `json:"deferred_reason,omitempty"`
+}
+
+// InstanceRefreshInstance is an original instance of an instance refresh and where it runs, the instances retired
+// in one iteration are of different failure domains and zones
+type InstanceRefreshInstance struct {
+	Id            string `json:"id"`
+	FailureDomain string `json:"failure_domain,omitempty"`
+	Zone          string `json:"zone,omitempty"`
 }
 
 // WekaHealthStatus shows the Weka cluster health metrics being tracked during instance refresh
@@ -82,6 +97,8 @@ type InstanceRefreshProgress struct {
 	Duration             string               `json:"duration,omitempty"`
 	AvgIterationDuration string               `json:"avg_iteration_duration,omitempty"`
 	LastError            *string              `json:"last_error,omitempty"`
+	DeferredUntil        string               `json:"deferred_until,omitempty"`
+	DeferredReason       string               `json:"deferred_reason,omitempty"`
 	WekaHealth           *WekaHealthStatus    `json:"weka_health,omitempty"`
 }
 
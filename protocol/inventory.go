@@ -0,0 +1,56 @@
+package protocol
+
+import "time"
+
+// InventoryNic is a network interface of a VM, in the interfaces order of the VM
+type InventoryNic struct {
+	Name        string `json:"name"`
+	Mtu         int    `json:"mtu"`
+	Driver      string `json:"driver"`
+	DpdkCapable bool   `json:"dpdk_capable"` // the driver is supported by weka DPDK networking
+}
+
+// Inventory is reported by every backend VM in the preflight phase, before clusterization, and is validated across
+// the VMs so a mismatch blocks the clusterization instead of failing it midway
+type Inventory struct {
+	WekaVersion string         `json:"weka_version"`
+	Cores       int            `json:"cores"`
+	MemoryBytes int64          `json:"memory_bytes"`
+	Drives      []string       `json:"drives"` // the NVMe devices found by find_drives.py
+	Nics        []InventoryNic `json:"nics"`
+	ClockUnixMs int64          `json:"clock_unix_ms"` // the VM clock when reporting
+	ReceivedAt  time.Time      `json:"received_at"`   // the receiver clock, set by report.UpdateReport
+}
+
+// ClockSkew returns how far the VM clock is ahead of the receiver clock, including the report latency
+func (i Inventory) ClockSkew() time.Duration {
+	return time.UnixMilli(i.ClockUnixMs).Sub(i.ReceivedAt)
+}
+
+// DataNics returns the NICs weka uses for its data path: all the NICs but the management one, unless it's the only one
+func (i Inventory) DataNics() []InventoryNic {
+	if len(i.Nics) > 1 {
+		return i.Nics[1:]
+	}
+	return i.Nics
+}
+
+func (i Inventory) DpdkCapable() bool {
+	nics := i.DataNics()
+	for _, nic := range nics {
+		if !nic.DpdkCapable {
+			return false
+		}
+	}
+	return len(nics) > 0
+}
+
+// PreflightReport is the result of validating the inventories, clusterization is blocked unless it passed
+type PreflightReport struct {
+	Passed      bool                 `json:"passed"`
+	Errors      []string             `json:"errors"`
+	Warnings    []string             `json:"warnings"`
+	Missing     []string             `json:"missing"` // hostnames expected to report an inventory that didn't
+	Inventories map[string]Inventory `json:"inventories"`
+	CheckedAt   time.Time            `json:"checked_at"`
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+type NFSAccessType string
+
+const (
+	NFSReadOnly  NFSAccessType = "RO"
+	NFSReadWrite NFSAccessType = "RW"
+)
+
+type NFSSquashMode string
+
+const (
+	NFSNoSquash   NFSSquashMode = "none"
+	NFSRootSquash NFSSquashMode = "root"
+	NFSAllSquash  NFSSquashMode = "all"
+)
+
+// NFSAnonymousId is the anonymous uid and gid of squashed users without explicit ones (nobody)
+const NFSAnonymousId = 65534
+
+// NFSPermission exports a filesystem path to the clients of a client group
+type NFSPermission struct {
+	Filesystem string
+	Path       string        // defaults to /
+	AccessType NFSAccessType // defaults to NFSReadWrite
+	SquashMode NFSSquashMode // defaults to NFSRootSquash
+	AnonUid    int           // defaults to NFSAnonymousId if squashing
+	AnonGid    int           // defaults to NFSAnonymousId if squashing
+}
+
+// NFSClientGroup is a set of NFS clients, matched by IP or DNS rules, and the exports they are permitted to mount
+type NFSClientGroup struct {
+	Name        string
+	Ips         []string // an IP, a CIDR or an IP/netmask
+	Dns         []string // a hostname, may contain wildcards
+	Permissions []NFSPermission
+}
+
+// WithDefaults returns the permission with its unset fields defaulted, as applied on the cluster
+func (p NFSPermission) WithDefaults() NFSPermission {
+	if p.Path == "" {
+		p.Path = "/"
+	}
+	if p.AccessType == "" {
+		p.AccessType = NFSReadWrite
+	}
+	if p.SquashMode == "" {
+		p.SquashMode = NFSRootSquash
+	}
+	if p.SquashMode != NFSNoSquash {
+		if p.AnonUid == 0 {
+			p.AnonUid = NFSAnonymousId
+		}
+		if p.AnonGid == 0 {
+			p.AnonGid = NFSAnonymousId
+		}
+	}
+	return p
+}
+
+func (g NFSClientGroup) Validate() error {
+	var errs []error
+	if g.Name == "" {
+		errs = append(errs, fmt.Errorf("client group name is empty"))
+	}
+	if len(g.Ips) == 0 && len(g.Dns) == 0 {
+		errs = append(errs, fmt.Errorf("client group %s has no rules", g.Name))
+	}
+	for _, rule := range g.Ips {
+		if !validIpRule(rule) {
+			errs = append(errs, fmt.Errorf("client group %s has invalid ip rule %s", g.Name, rule))
+		}
+	}
+	for _, rule := range g.Dns {
+		if rule == "" || strings.ContainsAny(rule, " /") {
+			errs = append(errs, fmt.Errorf("client group %s has invalid dns rule %q", g.Name, rule))
+		}
+	}
+	exports := make(map[string]bool)
+	for _, permission := range g.Permissions {
+		permission = permission.WithDefaults()
+		export := permission.Filesystem + ":" + permission.Path
+		if permission.Filesystem == "" {
+			errs = append(errs, fmt.Errorf("client group %s has a permission without a filesystem", g.Name))
+		}
+		if !strings.HasPrefix(permission.Path, "/") {
+			errs = append(errs, fmt.Errorf("client group %s: path %s is not absolute", g.Name, permission.Path))
+		}
+		if exports[export] {
+			errs = append(errs, fmt.Errorf("client group %s has duplicate permissions for %s", g.Name, export))
+		}
+		exports[export] = true
+		if permission.AccessType != NFSReadOnly && permission.AccessType != NFSReadWrite {
+			errs = append(errs, fmt.Errorf("client group %s: invalid access type %q", g.Name, permission.AccessType))
+		}
+		switch permission.SquashMode {
+		case NFSNoSquash, NFSRootSquash, NFSAllSquash:
+		default:
+			errs = append(errs, fmt.Errorf("client group %s: invalid squash mode %q", g.Name, permission.SquashMode))
+		}
+		if permission.AnonUid < 0 || permission.AnonGid < 0 {
+			errs = append(errs, fmt.Errorf("client group %s: anon uid and gid can't be negative", g.Name))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+// validIpRule accepts an IP, a CIDR or an IP/netmask
+func validIpRule(rule string) bool {
+	ip, mask, found := strings.Cut(rule, "/")
+	if net.ParseIP(ip) == nil {
+		return false
+	}
+	if !found {
+		return true
+	}
+	if _, _, err := net.ParseCIDR(rule); err == nil {
+		return true
+	}
+	maskIp := net.ParseIP(mask).To4()
+	return maskIp != nil && validMask(net.IPMask(maskIp))
+}
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/weka/go-cloud-lib/lib/types"
@@ -10,9 +11,28 @@ import (
 
 var Version = 1
 
+type InstanceLifecycle string
+
+const (
+	OnDemandInstance InstanceLifecycle = "on-demand"
+	SpotInstance     InstanceLifecycle = "spot" // spot / preemptible / low priority
+)
+
 type HgInstance struct {
-	Id        string
-	PrivateIp string
+	Id                string
+	PrivateIp         string
+	LaunchTime        time.Time         // zero if unknown to the cloud function
+	Lifecycle         InstanceLifecycle // empty means on-demand
+	PendingPreemption bool              // set by the cloud function when a preemption notice was received
+	RefreshTarget     bool              // set by the cloud function for the instances the instance refresh retires now
+}
+
+func (i HgInstance) IsSpot() bool {
+	return i.Lifecycle == SpotInstance
+}
+
+func (i HgInstance) String() string {
+	return i.Id + ":" + i.PrivateIp
 }
 
 type HostGroupInfoResponse struct {
@@ -25,6 +45,10 @@ type HostGroupInfoResponse struct {
 	NfsBackendInstances          []HgInstance          `json:"nfs_backend_instances"`
 	NfsInterfaceGroupInstanceIps map[string]types.Nilt `json:"nfs_interface_group_instance_ips"` // the key is the instance ip
 	DownBackendsRemovalTimeout   time.Duration         `json:"down_backends_removal_timeout"`
+	JoinTimeout                  time.Duration         `json:"join_timeout,omitempty"` // defaults to scale_up.DefaultJoinTimeout
+	ScalePolicy                  *ScalePolicy          `json:"scale_policy,omitempty"`
+	RecentDeactivations          []time.Time           `json:"recent_deactivations,omitempty"` // times of previous ScaleResponse.DeactivatedMachines, for rate limiting
+	JoiningSince                 map[string]time.Time  `json:"joining_since,omitempty"`        // the ScaleUpResponse.JoiningSince of the previous scale up
 	BackendIps                   []string              `json:"backend_ips"`
 	Role                         string                `json:"role"`
 	Version                      int                   `json:"version"`
@@ -65,6 +89,23 @@ func (hg *HostGroupInfoResponse) Validate() error {
 	return nil
 }
 
+// ScheduleWindow is either a recurring window, starting on every match of the Cron expression and lasting Duration,
+// or a one-time window between Start and End
+type ScheduleWindow struct {
+	Cron     string        `json:"cron,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Start    *time.Time    `json:"start,omitempty"`
+	End      *time.Time    `json:"end,omitempty"`
+}
+
+// ScalePolicy restricts when topology changes (scale down, instance refresh) may happen
+type ScalePolicy struct {
+	Timezone           string           `json:"timezone,omitempty"`            // IANA name, cron expressions are evaluated in it, defaults to UTC
+	MaintenanceWindows []ScheduleWindow `json:"maintenance_windows,omitempty"` // if set, scale operations only run inside one of them
+	FreezePeriods      []ScheduleWindow `json:"freeze_periods,omitempty"`      // scale operations never run inside any of them
+	MaxMachinesPerHour int              `json:"max_machines_per_hour,omitempty"`
+}
+
 type ScaleResponseHost struct {
 	InstanceId string      `json:"instance_id"`
 	PrivateIp  string      `json:"private_ip"`
@@ -74,10 +115,13 @@ type ScaleResponseHost struct {
 }
 
 type ScaleResponse struct {
-	Hosts           []ScaleResponseHost `json:"hosts"`
-	ToTerminate     []HgInstance        `json:"to_terminate"`
-	TransientErrors []string
-	Version         int `json:"version"`
+	Hosts               []ScaleResponseHost `json:"hosts"`
+	ToTerminate         []HgInstance        `json:"to_terminate"`
+	DeactivatedMachines []string            `json:"deactivated_machines,omitempty"`
+	DeferredUntil       *time.Time          `json:"deferred_until,omitempty"`
+	DeferredReason      string              `json:"deferred_reason,omitempty"`
+	TransientErrors     []string
+	Version             int `json:"version"`
 }
 
 func (r *ScaleResponse) AddTransientErrors(errs []error, caller string) {
@@ -90,6 +134,27 @@ func (r *ScaleResponse) AddTransientError(err error, caller string) {
 	r.TransientErrors = append(r.TransientErrors, fmt.Sprintf("%s:%s", caller, err.Error()))
 }
 
+type ScaleUpResponse struct {
+	ToWait          []HgInstance `json:"to_wait"`
+	ToRecycle       []HgInstance `json:"to_recycle"`
+	MissingCapacity int          `json:"missing_capacity"`
+	// by instance id, the time scale up first saw the joining instances without a launch time or containers, to pass
+	// back in HostGroupInfoResponse.JoiningSince
+	JoiningSince    map[string]time.Time `json:"joining_since,omitempty"`
+	TransientErrors []string
+	Version         int `json:"version"`
+}
+
+func (r *ScaleUpResponse) AddTransientErrors(errs []error, caller string) {
+	for _, err := range errs {
+		r.TransientErrors = append(r.TransientErrors, fmt.Sprintf("%s:%s", caller, err.Error()))
+	}
+}
+
+func (r *ScaleUpResponse) AddTransientError(err error, caller string) {
+	r.TransientErrors = append(r.TransientErrors, fmt.Sprintf("%s:%s", caller, err.Error()))
+}
+
 type TerminatedInstance struct {
 	InstanceId string    `json:"instance_id"`
 	Creation   time.Time `json:"creation_date"`
@@ -116,6 +181,19 @@ type BackendCoreCount struct {
 	Drive         int
 	Converged     bool
 	ComputeMemory string
+	Layout        *ContainerLayout // overrides the drives0/compute0/frontend0 layout of the core counts above
+}
+
+func (b BackendCoreCount) ContainerLayout() ContainerLayout {
+	if b.Layout != nil {
+		layout := *b.Layout
+		layout.Converged = layout.Converged || b.Converged
+		return layout
+	}
+	if b.Converged {
+		return ConvergedContainerLayout(b.Drive, b.Compute, b.ComputeMemory)
+	}
+	return DefaultContainerLayout(b.Drive, b.Compute, b.Frontend, b.ComputeMemory)
 }
 
 type BackendCoreCounts map[string]BackendCoreCount
@@ -140,14 +218,120 @@ const (
 	DATA ProtocolGW = "data"
 )
 
+type SMBShare struct {
+	Name         string
+	Filesystem   string // defaults to the default filesystem
+	InternalPath string // optional, the share exposes the whole filesystem if empty
+}
+
+type SMBParams struct {
+	ClusterName        string // netbios name of the smb cluster
+	DomainName         string
+	DomainNetbiosName  string // optional
+	DomainJoinUsername string // the cluster joins the domain only if set, with the password of fetch_smb_domain_join_password
+	ContainersUid      []string
+	FloatingIps        []string
+	Shares             []SMBShare
+	HostsNum           int
+}
+
+type S3Params struct {
+	ContainersUid     []string
+	Port              int    // defaults to 9000
+	DefaultFilesystem string // defaults to the default filesystem
+	TLSCertificate    string // PEM, the cluster keeps its certificate if empty, its key is of fetch_s3_tls_private_key
+	BucketName        string // optional initial bucket
+	AccessKeyUser     string // optional s3 user, created with a generated secret key
+	HostsNum          int
+}
+
+// NFSInterfaceGroup is an NFS interface group on its own client network. The subnet mask and gateway default to the
+// network of the group's NIC on the configuring gateway
+type NFSInterfaceGroup struct {
+	Name         string
+	SubnetMask   string // dotted netmask, e.g. 255.255.240.0
+	Gateway      string
+	NicNames     []string // the NIC of each of NFSParams.ContainersUid that serves the group
+	SecondaryIps []string // the group's IP pool for client mounts
+}
+
 type NFSParams struct {
+	// InterfaceGroupName, SecondaryIps and NicNames describe a single interface group on the management network,
+	// they are ignored if InterfaceGroups is set
 	InterfaceGroupName string
 	SecondaryIps       []string
 	ContainersUid      []string
 	NicNames           []string
+	InterfaceGroups    []NFSInterfaceGroup
+	ClientGroups       []NFSClientGroup // the exports, applied after the interface groups
 	HostsNum           int
 }
 
+// Groups returns the interface groups to configure, InterfaceGroups or the single group of InterfaceGroupName
+func (p NFSParams) Groups() []NFSInterfaceGroup {
+	if len(p.InterfaceGroups) > 0 {
+		return p.InterfaceGroups
+	}
+	return []NFSInterfaceGroup{{
+		Name:         p.InterfaceGroupName,
+		NicNames:     p.NicNames,
+		SecondaryIps: p.SecondaryIps,
+	}}
+}
+
+func (p NFSParams) Validate() error {
+	var errs []error
+	if len(p.ContainersUid) == 0 {
+		errs = append(errs, fmt.Errorf("containers uid list is empty"))
+	}
+	names := make(map[string]bool)
+	for _, group := range p.Groups() {
+		if group.Name == "" {
+			errs = append(errs, fmt.Errorf("interface group name is empty"))
+		}
+		if names[group.Name] {
+			errs = append(errs, fmt.Errorf("duplicate interface group %s", group.Name))
+		}
+		names[group.Name] = true
+		if len(group.NicNames) != len(p.ContainersUid) {
+			errs = append(errs, fmt.Errorf("interface group %s has %d nic names for %d containers", group.Name, len(group.NicNames), len(p.ContainersUid)))
+		}
+		if group.SubnetMask != "" {
+			if ip := net.ParseIP(group.SubnetMask).To4(); ip == nil || !validMask(net.IPMask(ip)) {
+				errs = append(errs, fmt.Errorf("interface group %s has invalid subnet mask %s", group.Name, group.SubnetMask))
+			}
+		}
+		if group.Gateway != "" && net.ParseIP(group.Gateway) == nil {
+			errs = append(errs, fmt.Errorf("interface group %s has invalid gateway %s", group.Name, group.Gateway))
+		}
+		for _, ip := range group.SecondaryIps {
+			if net.ParseIP(ip) == nil {
+				errs = append(errs, fmt.Errorf("interface group %s has invalid secondary ip %s", group.Name, ip))
+			}
+		}
+	}
+	clientGroups := make(map[string]bool)
+	for _, clientGroup := range p.ClientGroups {
+		if err := clientGroup.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if clientGroups[clientGroup.Name] {
+			errs = append(errs, fmt.Errorf("duplicate client group %s", clientGroup.Name))
+		}
+		clientGroups[clientGroup.Name] = true
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("validation failed: %v", errs)
+	}
+	return nil
+}
+
+// validMask is false for non canonical masks, whose 1 bits are not leading
+func validMask(mask net.IPMask) bool {
+	_, bits := mask.Size()
+	return bits != 0
+}
+
 type Vm struct {
 	Name         string     `json:"name"`
 	Protocol     ProtocolGW `json:"protocol"`
@@ -158,4 +342,27 @@ type Vm struct {
 type FetchRequest struct {
 	FetchWekaCredentials bool `json:"fetch_weka_credentials"`
 	ShowAdminPassword    bool `json:"show_admin_password,omitempty"`
+	FetchKmsCredentials  bool `json:"fetch_kms_credentials,omitempty"` // answered with KmsCredentials
+
+	FetchSmbDomainJoinPassword bool `json:"fetch_smb_domain_join_password,omitempty"` // answered with SmbDomainJoinCredentials
+	FetchS3TlsPrivateKey       bool `json:"fetch_s3_tls_private_key,omitempty"`       // answered with S3TlsCredentials
+}
+
+// KmsCredentials is the fetch response to FetchKmsCredentials, the token of a vault KMS or the client certificate
+// and key of a kmip KMS
+type KmsCredentials struct {
+	Token      string `json:"token,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+}
+
+// SmbDomainJoinCredentials is the fetch response to FetchSmbDomainJoinPassword, the password of
+// SMBParams.DomainJoinUsername
+type SmbDomainJoinCredentials struct {
+	Password string `json:"password,omitempty"`
+}
+
+// S3TlsCredentials is the fetch response to FetchS3TlsPrivateKey, the PEM private key of S3Params.TLSCertificate
+type S3TlsCredentials struct {
+	PrivateKey string `json:"private_key,omitempty"`
 }
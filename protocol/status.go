@@ -14,27 +14,33 @@ type Update struct {
 }
 
 type ClusterizationStatusSummary struct {
-	ReadyForClusterization int      `json:"ready_for_clusterization"`
-	Stopped                int      `json:"stopped"`
-	InProgress             int      `json:"in_progress"`
-	Unknown                []string `json:"unknown"`
-	ClusterizationTarget   int      `json:"clusterization_target"`
-	ClusterizationInstance string   `json:"clusterization_instance"`
-	Clusterized            bool     `json:"clusterized"`
+	ReadyForClusterization        int      `json:"ready_for_clusterization"`
+	Stopped                       int      `json:"stopped"`
+	InProgress                    int      `json:"in_progress"`
+	Unknown                       []string `json:"unknown"`
+	ClusterizationTarget          int      `json:"clusterization_target"`
+	ClusterizationInstance        string   `json:"clusterization_instance"`
+	Clusterized                   bool     `json:"clusterized"`
+	Stuck                         int      `json:"stuck"`
+	ClusterizationInstanceMissing bool     `json:"clusterization_instance_missing"` // it isn't running
 }
 
 // ClusterState is maintained in object store
 type ClusterState struct {
-	InitialSize          int                 `json:"initial_size"`
-	DesiredSize          int                 `json:"desired_size"`
-	Progress             map[string][]string `json:"progress"`
-	Errors               map[string][]string `json:"errors"`
-	Debug                map[string][]string `json:"debug"`
-	Instances            []Vm                `json:"instances"`
-	Clusterized          bool                `json:"clusterized"`
-	ClusterizationTarget int                 `json:"clusterization_target"`
-	Updates              map[string]Update   `json:"updates,omitempty"`
-	NfsInstancesMigrated bool                `json:"nfs_instances_migrated"` // for NFS VMs that were created as separate instances, outside of the instances group
+	InitialSize          int                     `json:"initial_size"`
+	DesiredSize          int                     `json:"desired_size"`
+	Progress             map[string][]string     `json:"progress"`
+	Errors               map[string][]string     `json:"errors"`
+	Debug                map[string][]string     `json:"debug"`
+	Instances            []Vm                    `json:"instances"`
+	Clusterized          bool                    `json:"clusterized"`
+	ClusterizationTarget int                     `json:"clusterization_target"`
+	Updates              map[string]Update       `json:"updates,omitempty"`
+	NfsInstancesMigrated bool                    `json:"nfs_instances_migrated"`     // for NFS VMs that were created as separate instances, outside of the instances group
+	Inventories          map[string]Inventory    `json:"inventories,omitempty"`      // preflight inventories by hostname
+	Events               []Event                 `json:"events,omitempty"`           // Progress, Errors and Debug are projected from them
+	EventSeq             int64                   `json:"event_seq,omitempty"`        // the Seq of the last event
+	CompactedEvents      map[string]EventSummary `json:"compacted_events,omitempty"` // by hostname
 }
 
 type ClusterStatus struct {
@@ -45,10 +51,20 @@ type ClusterStatus struct {
 }
 
 type Report struct {
-	Type     string     `json:"type"`
-	Message  string     `json:"message"`
-	Hostname string     `json:"hostname"`
-	Protocol ProtocolGW `json:"protocol"`
+	Type      string     `json:"type"`
+	Message   string     `json:"message"`
+	Hostname  string     `json:"hostname"`
+	Protocol  ProtocolGW `json:"protocol"`
+	Inventory *Inventory `json:"inventory,omitempty"` // of an "inventory" report
+
+	// structured event fields, all optional, see Event
+	Time       *time.Time        `json:"time,omitempty"`     // the reporter clock, defaults to the receiver clock
+	Phase      string            `json:"phase,omitempty"`    // defaults to the phase of the previous event of the host
+	Step       string            `json:"step,omitempty"`     // the step id
+	Severity   Severity          `json:"severity,omitempty"` // defaults to the severity of Type
+	InstanceId string            `json:"instance_id,omitempty"`
+	ErrorCode  string            `json:"error_code,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
 }
 
 type Reports struct {
@@ -57,7 +73,10 @@ type Reports struct {
 	Errors                 map[string][]string         `json:"errors"`
 	Debug                  map[string][]string         `json:"debug"`
 	InProgress             []string                    `json:"in_progress"`
+	Stuck                  []string                    `json:"stuck"` // in progress past the timeout
 	Summary                ClusterizationStatusSummary `json:"summary"`
+	Preflight              *PreflightReport            `json:"preflight,omitempty"`
+	Events                 *EventsPage                 `json:"events,omitempty"`
 }
 
 type ClusterCloud struct {
@@ -7,29 +7,142 @@ import (
 	"github.com/weka/go-cloud-lib/protocol"
 )
 
-func UpdateReport(report protocol.Report, state *protocol.ClusterState) (err error) {
-	currentTime := time.Now().UTC().Format("15:04:05") + " UTC"
-	switch report.Type {
-	case "error":
+// reportSeverities are the severities of the report types, a report sets Severity to override it
+var reportSeverities = map[string]protocol.Severity{
+	"error":    protocol.SeverityError,
+	"warning":  protocol.SeverityWarning,
+	"progress": protocol.SeverityInfo,
+	"debug":    protocol.SeverityDebug,
+}
+
+// UpdateReport adds the report to the state, keeping the events of DefaultRetention
+func UpdateReport(report protocol.Report, state *protocol.ClusterState) error {
+	return UpdateReportWithRetention(report, state, DefaultRetention)
+}
+
+func updateReport(report protocol.Report, state *protocol.ClusterState) (err error) {
+	if report.Type == "inventory" {
+		if report.Inventory == nil {
+			err = fmt.Errorf("inventory report of %s has no inventory", report.Hostname)
+			return
+		}
+		if state.Inventories == nil {
+			state.Inventories = make(map[string]protocol.Inventory)
+		}
+		inventory := *report.Inventory
+		inventory.ReceivedAt = time.Now().UTC()
+		state.Inventories[report.Hostname] = inventory
+		return
+	}
+
+	event, err := NewEvent(report, state)
+	if err != nil {
+		return
+	}
+	AddEvent(event, state)
+	return
+}
+
+// NewEvent returns the event of a report, the phase defaults to the phase of the last event of the host in state
+func NewEvent(report protocol.Report, state *protocol.ClusterState) (protocol.Event, error) {
+	severity := report.Severity
+	if severity == "" {
+		var ok bool
+		if severity, ok = reportSeverities[report.Type]; !ok {
+			return protocol.Event{}, fmt.Errorf("invalid type: %s", report.Type)
+		}
+	}
+	eventTime := time.Now().UTC()
+	if report.Time != nil {
+		eventTime = report.Time.UTC()
+	}
+	phase := report.Phase
+	for i := len(state.Events) - 1; i >= 0 && phase == ""; i-- {
+		if state.Events[i].Hostname == report.Hostname {
+			phase = state.Events[i].Phase
+		}
+	}
+	return protocol.Event{
+		Time:       eventTime,
+		Phase:      phase,
+		StepId:     report.Step,
+		Severity:   severity,
+		Hostname:   report.Hostname,
+		InstanceId: report.InstanceId,
+		Protocol:   report.Protocol,
+		ErrorCode:  report.ErrorCode,
+		Message:    report.Message,
+		Details:    report.Details,
+	}, nil
+}
+
+// AddEvent appends the event to the state events and projects it into the Progress, Errors and Debug maps. The map
+// entries of a state without events are converted to events first.
+func AddEvent(event protocol.Event, state *protocol.ClusterState) {
+	if state.EventSeq == 0 {
+		convertLegacyEntries(state, event.Time)
+	}
+	state.EventSeq++
+	event.Seq = state.EventSeq
+	state.Events = append(state.Events, event)
+	projectEvent(event, state)
+}
+
+// ProjectEvents rebuilds the Progress, Errors and Debug maps of the state from its events
+func ProjectEvents(state *protocol.ClusterState) {
+	state.Progress, state.Errors, state.Debug = nil, nil, nil
+	for _, event := range state.Events {
+		projectEvent(event, state)
+	}
+}
+
+func projectEvent(event protocol.Event, state *protocol.ClusterState) {
+	entry := fmt.Sprintf("%s: %s", event.Time.UTC().Format("15:04:05")+" UTC", event.Message)
+	switch event.Severity {
+	case protocol.SeverityError:
 		if state.Errors == nil {
 			state.Errors = make(map[string][]string)
 		}
-		state.Errors[report.Hostname] = append(state.Errors[report.Hostname], fmt.Sprintf("%s: %s", currentTime, report.Message))
-	case "progress":
-		if state.Progress == nil {
-			state.Progress = make(map[string][]string)
-		}
-		state.Progress[report.Hostname] = append(state.Progress[report.Hostname], fmt.Sprintf("%s: %s", currentTime, report.Message))
-	case "debug":
+		state.Errors[event.Hostname] = append(state.Errors[event.Hostname], entry)
+	case protocol.SeverityDebug:
 		if state.Debug == nil {
 			state.Debug = make(map[string][]string)
 		}
-		state.Debug[report.Hostname] = append(state.Debug[report.Hostname], fmt.Sprintf("%s: %s", currentTime, report.Message))
+		state.Debug[event.Hostname] = append(state.Debug[event.Hostname], entry)
 	default:
-		err = fmt.Errorf("invalid type: %s", report.Type)
-		return
+		if state.Progress == nil {
+			state.Progress = make(map[string][]string)
+		}
+		state.Progress[event.Hostname] = append(state.Progress[event.Hostname], entry)
 	}
-	return
+}
+
+// EventFilter selects events, zero values match any event
+type EventFilter struct {
+	Hostname    string
+	InstanceId  string
+	Phase       string
+	MinSeverity protocol.Severity
+	Since       time.Time
+}
+
+func (f EventFilter) Match(event protocol.Event) bool {
+	return (f.Hostname == "" || event.Hostname == f.Hostname) &&
+		(f.InstanceId == "" || event.InstanceId == f.InstanceId) &&
+		(f.Phase == "" || event.Phase == f.Phase) &&
+		(f.MinSeverity == "" || event.Severity.AtLeast(f.MinSeverity)) &&
+		!event.Time.Before(f.Since)
+}
+
+// FilterEvents returns the events matching the filter, in order
+func FilterEvents(events []protocol.Event, filter EventFilter) []protocol.Event {
+	var filtered []protocol.Event
+	for _, event := range events {
+		if filter.Match(event) {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
 }
 
 func AddClusterUpdate(update protocol.Update, state *protocol.ClusterState) {
@@ -0,0 +1,55 @@
+package report
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestUpdateReport(t *testing.T) {
+	state := &protocol.ClusterState{}
+	reportTime := time.Date(2024, 5, 1, 10, 20, 30, 0, time.UTC)
+	reports := []protocol.Report{
+		{Type: "progress", Hostname: "weka-1", Message: "Running step 4/7: drives discovery", Phase: "drives discovery", Step: "4", Time: &reportTime},
+		{Type: "debug", Hostname: "weka-1", Message: "waiting for nvme"},
+		{Type: "progress", Hostname: "weka-2", Message: "Weka containers are ready", InstanceId: "i-2"},
+		{Type: "error", Hostname: "weka-1", Message: "No drives were found", ErrorCode: "no_drives", Details: map[string]string{"found": "0"}},
+		{Type: "progress", Hostname: "weka-1", Message: "Drives are slow", Severity: protocol.SeverityWarning},
+	}
+	for _, report := range reports {
+		if err := UpdateReport(report, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := UpdateReport(protocol.Report{Type: "info", Hostname: "weka-1"}, state); err == nil {
+		t.Error("expected an invalid type error")
+	}
+
+	if len(state.Events) != len(reports) {
+		t.Fatalf("expected %d events, got %d", len(reports), len(state.Events))
+	}
+	if event := state.Events[3]; event.Phase != "drives discovery" || event.Severity != protocol.SeverityError || event.ErrorCode != "no_drives" {
+		t.Errorf("expected an error event of the drives discovery phase, got %+v", event)
+	}
+	if state.Events[2].Phase != "" {
+		t.Errorf("expected no phase for weka-2, got %s", state.Events[2].Phase)
+	}
+	if state.Progress["weka-1"][0] != "10:20:30 UTC: Running step 4/7: drives discovery" || len(state.Progress["weka-1"]) != 2 {
+		t.Errorf("unexpected progress %v", state.Progress["weka-1"])
+	}
+	if len(state.Errors["weka-1"]) != 1 || len(state.Debug["weka-1"]) != 1 || len(state.Progress["weka-2"]) != 1 {
+		t.Errorf("unexpected projection %v %v %v", state.Progress, state.Errors, state.Debug)
+	}
+
+	progress, errors := state.Progress, state.Errors
+	ProjectEvents(state)
+	if len(state.Progress["weka-1"]) != len(progress["weka-1"]) || state.Errors["weka-1"][0] != errors["weka-1"][0] {
+		t.Errorf("expected the same projection, got %v %v", state.Progress, state.Errors)
+	}
+
+	warnings := FilterEvents(state.Events, EventFilter{Phase: "drives discovery", MinSeverity: protocol.SeverityWarning})
+	if len(warnings) != 2 || warnings[0].Message != "No drives were found" {
+		t.Errorf("unexpected filtered events %+v", warnings)
+	}
+}
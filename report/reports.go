@@ -0,0 +1,96 @@
+package report
+
+import (
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// DefaultInProgressTimeout is the time an instance may take from launch to being ready for clusterization
+const DefaultInProgressTimeout = 30 * time.Minute
+
+type InstanceState string
+
+const (
+	InstanceStatePending    InstanceState = "pending"
+	InstanceStateRunning    InstanceState = "running"
+	InstanceStateStopped    InstanceState = "stopped"
+	InstanceStateTerminated InstanceState = "terminated"
+	InstanceStateUnknown    InstanceState = "unknown"
+)
+
+// InstanceInfo is a backend instance of the cloud, each cloud maps its instance states to InstanceState
+type InstanceInfo struct {
+	Id         string
+	Name       string // the VM name of protocol.Vm
+	State      InstanceState
+	LaunchTime time.Time
+}
+
+// BuildReports returns the reports of the state and the cloud instances, see BuildReportsWithTimeout
+func BuildReports(state protocol.ClusterState, instances []InstanceInfo) protocol.Reports {
+	return BuildReportsWithTimeout(state, instances, DefaultInProgressTimeout)
+}
+
+// BuildReportsWithTimeout returns the reports of the state and the cloud instances. Before clusterization, a running
+// instance which isn't ready for clusterization is in progress, or stuck if it was launched more than inProgressTimeout
+// ago. Instances of an unknown state, and ready ones which aren't instances anymore, are unknown.
+func BuildReportsWithTimeout(state protocol.ClusterState, instances []InstanceInfo, inProgressTimeout time.Duration) protocol.Reports {
+	reports := protocol.Reports{
+		ReadyForClusterization: []string{},
+		Progress:               state.Progress,
+		Errors:                 state.Errors,
+		Debug:                  state.Debug,
+		InProgress:             []string{},
+		Stuck:                  []string{},
+		Summary: protocol.ClusterizationStatusSummary{
+			Unknown:              []string{},
+			ClusterizationTarget: state.ClusterizationTarget,
+			Clusterized:          state.Clusterized,
+		},
+	}
+
+	ready := make(map[string]bool)
+	for _, vm := range state.Instances {
+		reports.ReadyForClusterization = append(reports.ReadyForClusterization, vm.Name)
+		ready[vm.Name] = true
+	}
+
+	running := make(map[string]bool)
+	known := make(map[string]bool)
+	now := time.Now()
+	for _, instance := range instances {
+		known[instance.Name] = true
+		switch instance.State {
+		case InstanceStateStopped, InstanceStateTerminated:
+			reports.Summary.Stopped++
+		case InstanceStatePending, InstanceStateRunning:
+			running[instance.Name] = true
+			if state.Clusterized || ready[instance.Name] {
+				continue
+			}
+			if !instance.LaunchTime.IsZero() && now.Sub(instance.LaunchTime) > inProgressTimeout {
+				reports.Stuck = append(reports.Stuck, instance.Name)
+			} else {
+				reports.InProgress = append(reports.InProgress, instance.Name)
+			}
+		default:
+			reports.Summary.Unknown = append(reports.Summary.Unknown, instance.Name)
+		}
+	}
+	for _, vm := range state.Instances {
+		if !known[vm.Name] && !state.Clusterized {
+			reports.Summary.Unknown = append(reports.Summary.Unknown, vm.Name)
+		}
+	}
+
+	reports.Summary.ReadyForClusterization = len(reports.ReadyForClusterization)
+	reports.Summary.InProgress = len(reports.InProgress)
+	reports.Summary.Stuck = len(reports.Stuck)
+	if state.ClusterizationTarget > 0 && len(state.Instances) >= state.ClusterizationTarget {
+		// the instance completing the target gets the clusterization script
+		reports.Summary.ClusterizationInstance = state.Instances[state.ClusterizationTarget-1].Name
+		reports.Summary.ClusterizationInstanceMissing = !state.Clusterized && !running[reports.Summary.ClusterizationInstance]
+	}
+	return reports
+}
@@ -0,0 +1,53 @@
+package report
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestBuildReports(t *testing.T) {
+	now := time.Now()
+	state := protocol.ClusterState{
+		ClusterizationTarget: 3,
+		Instances:            []protocol.Vm{{Name: "weka-1"}, {Name: "weka-2"}, {Name: "weka-3"}, {Name: "weka-gone"}},
+		Progress:             map[string][]string{"weka-1": {"10:00:00 UTC: Weka containers are ready"}},
+	}
+	instances := []InstanceInfo{
+		{Id: "i-1", Name: "weka-1", State: InstanceStateRunning, LaunchTime: now.Add(-time.Hour)},
+		{Id: "i-2", Name: "weka-2", State: InstanceStateRunning, LaunchTime: now.Add(-time.Hour)},
+		{Id: "i-3", Name: "weka-3", State: InstanceStateStopped, LaunchTime: now.Add(-time.Hour)},
+		{Id: "i-4", Name: "weka-4", State: InstanceStatePending, LaunchTime: now.Add(-time.Minute)},
+		{Id: "i-5", Name: "weka-5", State: InstanceStateRunning, LaunchTime: now.Add(-time.Hour)},
+		{Id: "i-6", Name: "weka-6", State: InstanceStateUnknown},
+	}
+
+	reports := BuildReports(state, instances)
+	if fmt.Sprint(reports.InProgress, reports.Stuck, reports.Summary.Unknown) != "[weka-4] [weka-5] [weka-6 weka-gone]" {
+		t.Errorf("unexpected classification %v %v %v", reports.InProgress, reports.Stuck, reports.Summary.Unknown)
+	}
+	expected := protocol.ClusterizationStatusSummary{
+		ReadyForClusterization:        4,
+		Stopped:                       1,
+		InProgress:                    1,
+		Stuck:                         1,
+		ClusterizationTarget:          3,
+		ClusterizationInstance:        "weka-3",
+		ClusterizationInstanceMissing: true,
+	}
+	reports.Summary.Unknown = nil
+	if fmt.Sprint(reports.Summary) != fmt.Sprint(expected) {
+		t.Errorf("expected summary %+v, got %+v", expected, reports.Summary)
+	}
+	if len(reports.Progress["weka-1"]) != 1 {
+		t.Errorf("expected the state progress, got %v", reports.Progress)
+	}
+
+	state.Clusterized = true
+	reports = BuildReports(state, instances)
+	if len(reports.InProgress) != 0 || len(reports.Stuck) != 0 || reports.Summary.ClusterizationInstanceMissing {
+		t.Errorf("expected nothing in progress after clusterization, got %+v", reports)
+	}
+}
@@ -0,0 +1,163 @@
+package report
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// Retention bounds the events kept in ClusterState, which is rewritten on every report
+type Retention struct {
+	MaxEventsPerHost int           // the size of the per host ring buffer, 0 keeps all the events
+	MaxAge           time.Duration // older events are compacted, 0 keeps the events of any age
+}
+
+// DefaultRetention is the retention of UpdateReport
+var DefaultRetention = Retention{MaxEventsPerHost: 500}
+
+// UpdateReportWithRetention adds the report to the state and compacts the events exceeding the retention
+func UpdateReportWithRetention(report protocol.Report, state *protocol.ClusterState, retention Retention) error {
+	if err := updateReport(report, state); err != nil {
+		return err
+	}
+	Compact(state, retention, time.Now().UTC())
+	return nil
+}
+
+// Compact drops the events exceeding the retention into the per host CompactedEvents summaries, and projects the
+// remaining events into the Progress, Errors and Debug maps. It returns the number of compacted events.
+// The map entries of a state without events, reported before events were kept, are trimmed to the ring buffer size,
+// they are converted to events along with its first event, see convertLegacyEntries.
+func Compact(state *protocol.ClusterState, retention Retention, now time.Time) int {
+	kept := make([]protocol.Event, 0, len(state.Events))
+	counts := make(map[string]int)
+	var compacted []protocol.Event
+	for i := len(state.Events) - 1; i >= 0; i-- {
+		event := state.Events[i]
+		counts[event.Hostname]++
+		if (retention.MaxEventsPerHost > 0 && counts[event.Hostname] > retention.MaxEventsPerHost) ||
+			(retention.MaxAge > 0 && now.Sub(event.Time) > retention.MaxAge) {
+			compacted = append(compacted, event)
+			continue
+		}
+		kept = append(kept, event)
+	}
+
+	if len(compacted) > 0 {
+		if state.CompactedEvents == nil {
+			state.CompactedEvents = make(map[string]protocol.EventSummary)
+		}
+		// oldest first, so the last error is the latest one
+		for i := len(compacted) - 1; i >= 0; i-- {
+			state.CompactedEvents[compacted[i].Hostname] = summarize(state.CompactedEvents[compacted[i].Hostname], compacted[i])
+		}
+		for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+			kept[i], kept[j] = kept[j], kept[i]
+		}
+		state.Events = kept
+
+		ProjectEvents(state)
+	}
+
+	if retention.MaxEventsPerHost > 0 {
+		for _, entries := range []map[string][]string{state.Progress, state.Errors, state.Debug} {
+			for hostname, hostEntries := range entries {
+				if len(hostEntries) > retention.MaxEventsPerHost {
+					entries[hostname] = hostEntries[len(hostEntries)-retention.MaxEventsPerHost:]
+				}
+			}
+		}
+	}
+	return len(compacted)
+}
+
+func summarize(summary protocol.EventSummary, event protocol.Event) protocol.EventSummary {
+	if summary.Count == 0 || event.Time.Before(summary.From) {
+		summary.From = event.Time
+	}
+	if event.Time.After(summary.To) {
+		summary.To = event.Time
+	}
+	summary.Count++
+	switch event.Severity {
+	case protocol.SeverityError:
+		summary.Errors++
+		summary.LastError = event.Message
+	case protocol.SeverityWarning:
+		summary.Warnings++
+	}
+	return summary
+}
+
+// convertLegacyEntries converts the Progress, Errors and Debug entries of a state reported before events were kept into
+// events, so they are compacted and summarized like the events reported since. The entries only have the time of day,
+// they are dated to the last such time at or before the first event.
+func convertLegacyEntries(state *protocol.ClusterState, firstEventTime time.Time) {
+	var legacy []protocol.Event
+	for _, severityEntries := range []struct {
+		entries  map[string][]string
+		severity protocol.Severity
+	}{
+		{state.Progress, protocol.SeverityInfo},
+		{state.Errors, protocol.SeverityError},
+		{state.Debug, protocol.SeverityDebug},
+	} {
+		hostnames := make([]string, 0, len(severityEntries.entries))
+		for hostname := range severityEntries.entries {
+			hostnames = append(hostnames, hostname)
+		}
+		sort.Strings(hostnames)
+		for _, hostname := range hostnames {
+			for _, entry := range severityEntries.entries[hostname] {
+				legacy = append(legacy, legacyEvent(hostname, entry, severityEntries.severity, firstEventTime))
+			}
+		}
+	}
+	sort.SliceStable(legacy, func(i, j int) bool {
+		return legacy[i].Time.Before(legacy[j].Time)
+	})
+	for _, event := range legacy {
+		state.EventSeq++
+		event.Seq = state.EventSeq
+		state.Events = append(state.Events, event)
+	}
+}
+
+// legacyEvent returns the event of an "15:04:05 UTC: message" entry, an entry of another format is kept as the message
+func legacyEvent(hostname, entry string, severity protocol.Severity, firstEventTime time.Time) protocol.Event {
+	event := protocol.Event{Time: firstEventTime, Severity: severity, Hostname: hostname, Message: entry}
+	clock, message, ok := strings.Cut(entry, " UTC: ")
+	if !ok {
+		return event
+	}
+	timeOfDay, err := time.Parse("15:04:05", clock)
+	if err != nil {
+		return event
+	}
+	first := firstEventTime.UTC()
+	event.Time = time.Date(first.Year(), first.Month(), first.Day(), timeOfDay.Hour(), timeOfDay.Minute(), timeOfDay.Second(), 0, time.UTC)
+	if event.Time.After(first) {
+		event.Time = event.Time.AddDate(0, 0, -1)
+	}
+	event.Message = message
+	return event
+}
+
+// PageEvents returns up to limit events matching the filter, following the event of the cursor Seq, 0 for the first
+// page. A non-positive limit returns all the matching events.
+func PageEvents(state *protocol.ClusterState, filter EventFilter, cursor int64, limit int) protocol.EventsPage {
+	page := protocol.EventsPage{Events: []protocol.Event{}}
+	for _, event := range state.Events {
+		if event.Seq <= cursor || !filter.Match(event) {
+			continue
+		}
+		if limit > 0 && len(page.Events) == limit {
+			page.NextCursor = page.Events[len(page.Events)-1].Seq
+			break
+		}
+		page.Events = append(page.Events, event)
+	}
+	return page
+}
@@ -0,0 +1,111 @@
+package report
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestCompact(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// entries reported before events were kept, of a host without events and of hosts with events
+	state := &protocol.ClusterState{
+		Progress: map[string][]string{
+			"legacy": {"08:00:00 UTC: a", "08:00:01 UTC: b", "08:00:02 UTC: c", "08:00:03 UTC: d"},
+			"weka-1": {"05:30:00 UTC: booted"},
+		},
+		Errors: map[string][]string{"weka-2": {"05:45:00 UTC: failed"}},
+	}
+	for i := 0; i < 6; i++ {
+		reportTime := now.Add(time.Duration(i-6) * time.Hour)
+		reportType := "progress"
+		if i == 1 {
+			reportType = "error"
+		}
+		for _, hostname := range []string{"weka-1", "weka-2"} {
+			report := protocol.Report{Type: reportType, Hostname: hostname, Message: fmt.Sprintf("report %d", i), Time: &reportTime}
+			if err := updateReport(report, state); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	retention := Retention{MaxEventsPerHost: 3, MaxAge: 150 * time.Minute}
+	if compacted := Compact(state, retention, now); compacted != 14 {
+		t.Fatalf("expected 14 compacted events, got %d", compacted)
+	}
+	if len(state.Events) != 4 || state.Events[0].Message != "report 4" || state.Events[3].Seq != 18 {
+		t.Errorf("unexpected events %+v", state.Events)
+	}
+	summary := state.CompactedEvents["weka-1"]
+	if summary.Count != 5 || summary.Errors != 1 || summary.LastError != "report 1" || !summary.From.Equal(now.Add(-6*time.Hour-30*time.Minute)) {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if summary = state.CompactedEvents["weka-2"]; summary.Count != 5 || summary.Errors != 2 || summary.LastError != "report 1" {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	// the legacy entries are dated to the day before the first event, which is at 06:00
+	if summary = state.CompactedEvents["legacy"]; summary.Count != 4 || !summary.From.Equal(now.Add(-28*time.Hour)) {
+		t.Errorf("unexpected legacy summary %+v", summary)
+	}
+	if len(state.Errors) != 0 || len(state.Progress["weka-1"]) != 2 || state.Progress["weka-1"][0] != "10:00:00 UTC: report 4" {
+		t.Errorf("unexpected projection %v %v", state.Progress, state.Errors)
+	}
+	if _, ok := state.Progress["legacy"]; ok {
+		t.Errorf("expected the legacy entries to be compacted, got %v", state.Progress["legacy"])
+	}
+}
+
+func TestCompactLegacyEntries(t *testing.T) {
+	// a state without events keeps its entries trimmed to the ring buffer size
+	state := &protocol.ClusterState{Progress: map[string][]string{"legacy": {"08:00:00 UTC: a", "08:00:01 UTC: b", "08:00:02 UTC: c", "08:00:03 UTC: d"}}}
+	Compact(state, Retention{MaxEventsPerHost: 3}, time.Now())
+	if len(state.Progress["legacy"]) != 3 || state.Progress["legacy"][0] != "08:00:01 UTC: b" {
+		t.Errorf("expected legacy entries to be trimmed, got %v", state.Progress["legacy"])
+	}
+
+	// along with the first event, they are converted to events projected to the same entries
+	reportTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	report := protocol.Report{Type: "progress", Hostname: "legacy", Message: "e", Time: &reportTime}
+	if err := UpdateReportWithRetention(report, state, Retention{MaxEventsPerHost: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Events) != 3 || state.Events[0].Message != "c" || !state.Events[0].Time.Equal(time.Date(2024, 5, 1, 8, 0, 2, 0, time.UTC)) {
+		t.Errorf("unexpected events %+v", state.Events)
+	}
+	if fmt.Sprint(state.Progress["legacy"]) != "[08:00:02 UTC: c 08:00:03 UTC: d 12:00:00 UTC: e]" {
+		t.Errorf("unexpected projection %v", state.Progress["legacy"])
+	}
+	if summary := state.CompactedEvents["legacy"]; summary.Count != 1 {
+		t.Errorf("expected the oldest legacy entry to be compacted, got %+v", summary)
+	}
+}
+
+func TestPageEvents(t *testing.T) {
+	state := &protocol.ClusterState{}
+	for i := 0; i < 5; i++ {
+		for _, hostname := range []string{"weka-1", "weka-2"} {
+			if err := UpdateReport(protocol.Report{Type: "progress", Hostname: hostname, Message: fmt.Sprintf("report %d", i)}, state); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var messages []string
+	var cursor int64
+	for pages := 0; pages == 0 || cursor != 0; pages++ {
+		if pages > 3 {
+			t.Fatal("expected 3 pages")
+		}
+		page := PageEvents(state, EventFilter{Hostname: "weka-2"}, cursor, 2)
+		for _, event := range page.Events {
+			messages = append(messages, event.Message)
+		}
+		cursor = page.NextCursor
+	}
+	if fmt.Sprint(messages) != "[report 0 report 1 report 2 report 3 report 4]" {
+		t.Errorf("unexpected pages %v", messages)
+	}
+}
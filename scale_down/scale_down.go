@@ -17,6 +17,7 @@ import (
 	"github.com/weka/go-cloud-lib/lib/weka"
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/schedule"
 	"github.com/weka/go-cloud-lib/weka_events"
 
 	"github.com/google/uuid"
@@ -25,12 +26,15 @@ import (
 type hostState int
 
 const unhealthyDeactivateTimeout = 120 * time.Minute
+const spotDownDeactivateTimeout = 5 * time.Minute
 const notPartOfNFSInterfaceGroupTimeout = time.Hour
 
 func (h hostState) String() string {
 	switch h {
 	case DEACTIVATING:
 		return "DEACTIVATING"
+	case PREEMPTED:
+		return "PREEMPTED"
 	case HEALTHY:
 		return "HEALTHY"
 	case UNHEALTHY:
@@ -45,6 +49,7 @@ const (
 		Order matters, it defines priority of hosts removal
 	*/
 	DEACTIVATING hostState = iota
+	PREEMPTED
 	UNHEALTHY
 	HEALTHY
 )
@@ -53,10 +58,13 @@ type driveMap map[weka.DriveId]weka.Drive
 type nodeMap map[weka.NodeId]weka.Node
 type hostInfo struct {
 	weka.Host
-	id         weka.HostId
-	drives     driveMap
-	nodes      nodeMap
-	scaleState hostState
+	id                weka.HostId
+	drives            driveMap
+	nodes             nodeMap
+	scaleState        hostState
+	spot              bool
+	pendingPreemption bool
+	refreshTarget     bool
 }
 
 type EventReason string
@@ -66,6 +74,7 @@ const (
 	InactiveMachineEvent EventReason = "inactive machine"
 	DownMachineEvent     EventReason = "down machine"
 	NfsLeftoverEvent     EventReason = "nfs leftover"
+	PreemptionEvent      EventReason = "spot preemption"
 )
 
 type deactivateEventInfo struct {
@@ -146,6 +155,8 @@ type machineState struct {
 	Healthy      int
 	Unhealthy    int
 	Deactivating int
+	Preempted    int
+	Spot         bool
 }
 
 func getNumToDeactivate(ctx context.Context, hostInfo []hostInfo, desired int) int {
@@ -159,12 +170,16 @@ func getNumToDeactivate(ctx context.Context, hostInfo []hostInfo, desired int) i
 		new_D = func(A, U, T, D)
 
 		new_D = max(A+U+D-T, min(2-D, U), 0)
+
+		Spot machines being preempted (P) or already deactivating (D_spot) are not counted toward the 2 unhealthy limit
 	*/
 	logger := logging.LoggerFromCtx(ctx)
 
 	nHealthy := 0
 	nUnhealthy := 0
 	nDeactivating := 0
+	nPreempted := 0
+	nSpotDeactivating := 0
 
 	machines := make(map[string]*machineState)
 	for _, host := range hostInfo {
@@ -173,8 +188,9 @@ func getNumToDeactivate(ctx context.Context, hostInfo []hostInfo, desired int) i
 			continue
 		}
 		if _, ok := machines[host.HostIp]; !ok {
-			machines[host.HostIp] = &machineState{0, 0, 0}
+			machines[host.HostIp] = &machineState{}
 		}
+		machines[host.HostIp].Spot = host.spot
 		switch host.scaleState {
 		case HEALTHY:
 			machines[host.HostIp].Healthy++
@@ -182,27 +198,44 @@ func getNumToDeactivate(ctx context.Context, hostInfo []hostInfo, desired int) i
 			machines[host.HostIp].Unhealthy++
 		case DEACTIVATING:
 			machines[host.HostIp].Deactivating++
+		case PREEMPTED:
+			machines[host.HostIp].Preempted++
 		}
 	}
 
 	for _, machine := range machines {
-		if machine.Unhealthy > 0 {
+		if machine.Preempted > 0 {
+			nPreempted++
+		} else if machine.Unhealthy > 0 {
 			nUnhealthy++
 		} else if machine.Deactivating > 0 {
 			nDeactivating++
+			if machine.Spot {
+				nSpotDeactivating++
+			}
 		} else {
 			nHealthy++
 		}
 	}
 
-	toDeactivate := CalculateDeactivateTarget(nHealthy, nUnhealthy, nDeactivating, desired)
-	logger.Info().Msgf("%d machines set to deactivate. nHealthy: %d nUnhealthy:%d nDeactivating: %d desired:%d", toDeactivate, nHealthy, nUnhealthy, nDeactivating, desired)
+	toDeactivate := CalculateDeactivateTargetWithPreempted(nHealthy, nUnhealthy, nDeactivating, nPreempted, nSpotDeactivating, desired)
+	logger.Info().Msgf("%d machines set to deactivate. nHealthy: %d nUnhealthy:%d nDeactivating: %d nPreempted: %d nSpotDeactivating: %d desired:%d",
+		toDeactivate, nHealthy, nUnhealthy, nDeactivating, nPreempted, nSpotDeactivating, desired)
 	return toDeactivate
 }
 
 func CalculateDeactivateTarget(nHealthy int, nUnhealthy int, nDeactivating int, desired int) int {
-	ret := math.Max(nHealthy+nUnhealthy+nDeactivating-desired, math.Min(2-nDeactivating, nUnhealthy))
-	ret = math.Max(nDeactivating, ret)
+	return CalculateDeactivateTargetWithPreempted(nHealthy, nUnhealthy, nDeactivating, 0, 0, desired)
+}
+
+// CalculateDeactivateTargetWithPreempted is CalculateDeactivateTarget for host groups with spot machines.
+// nPreempted machines are always deactivated, and nSpotDeactivating (out of nDeactivating) machines
+// don't count toward the limit of 2 unhealthy machines being deactivated
+func CalculateDeactivateTargetWithPreempted(nHealthy int, nUnhealthy int, nDeactivating int, nPreempted int, nSpotDeactivating int, desired int) int {
+	nOnDemandDeactivating := nDeactivating - nSpotDeactivating
+	unhealthyTarget := math.Max(nOnDemandDeactivating, math.Min(2-nOnDemandDeactivating, nUnhealthy))
+	ret := math.Max(nHealthy+nUnhealthy+nDeactivating+nPreempted-desired, unhealthyTarget+nSpotDeactivating+nPreempted)
+	ret = math.Max(nDeactivating+nPreempted, ret)
 	return ret
 }
 
@@ -232,6 +265,14 @@ func deriveHostState(ctx context.Context, host *hostInfo) hostState {
 	if strings.AnyOf(host.State, "DEACTIVATING", "REMOVING", "INACTIVE") {
 		return DEACTIVATING
 	}
+	if host.pendingPreemption {
+		logger.Info().Msgf("Marking %s as preempted due to preemption notice", host.id.String())
+		return PREEMPTED
+	}
+	if host.spot && strings.AnyOf(host.Status, "DOWN") && host.managementTimedOut(ctx, spotDownDeactivateTimeout) {
+		logger.Info().Msgf("Marking %s as preempted due to DOWN spot machine", host.id.String())
+		return PREEMPTED
+	}
 	if strings.AnyOf(host.Status, "DOWN", "DEGRADED") && host.managementTimedOut(ctx, unhealthyDeactivateTimeout) {
 		logger.Info().Msgf("Marking %s as unhealthy due to DOWN", host.id.String())
 		return UNHEALTHY
@@ -250,6 +291,17 @@ func calculateHostsState(ctx context.Context, hosts []hostInfo) {
 	}
 }
 
+func setInstancesLifecycle(hosts []hostInfo, instances []protocol.HgInstance) {
+	for i := range hosts {
+		instance := selectInstanceByIp(hosts[i].HostIp, instances)
+		if instance != nil {
+			hosts[i].spot = instance.IsSpot()
+			hosts[i].pendingPreemption = instance.PendingPreemption
+			hosts[i].refreshTarget = instance.RefreshTarget
+		}
+	}
+}
+
 func selectInstanceByIp(ip string, instances []protocol.HgInstance) *protocol.HgInstance {
 	for _, i := range instances {
 		if i.PrivateIp == ip {
@@ -337,8 +389,9 @@ func removeDrive(ctx context.Context, jpool *jrpc.Pool, drive weka.Drive, p *pro
 	}
 }
 
-func getMachineToHostMap(ctx context.Context, hosts hostsMap) map[string][]hostInfo {
-	logger := logging.LoggerFromCtx(ctx)
+// getMachineToHostMap groups the backend containers by machine, a machine runs any number of containers of its
+// container layout
+func getMachineToHostMap(hosts hostsMap) (map[string][]hostInfo, error) {
 	machineToHostMap := make(map[string][]hostInfo)
 
 	for _, host := range hosts {
@@ -349,18 +402,15 @@ func getMachineToHostMap(ctx context.Context, hosts hostsMap) map[string][]hostI
 
 	for hostIp, machineHosts := range machineToHostMap {
 		machineIdentifiers := make(map[string]types.Nilt)
-		if len(machineHosts) > 3 {
-			logger.Fatal().Msgf("Found more than 3 backend containers for host %s", hostIp)
-		}
 		for _, machineHost := range machineHosts {
 			machineIdentifiers[machineHost.MachineIdentifier] = types.Nilv
 		}
 		if len(machineIdentifiers) > 1 {
-			logger.Fatal().Msgf("Found more than 1 machine identifier for host %s", hostIp)
+			return nil, fmt.Errorf("found more than 1 machine identifier for host %s", hostIp)
 		}
 	}
 
-	return machineToHostMap
+	return machineToHostMap, nil
 }
 
 func allContainersInactive(hosts []hostInfo) bool {
@@ -372,6 +422,15 @@ func allContainersInactive(hosts []hostInfo) bool {
 	return true
 }
 
+func allContainersDeactivating(hosts []hostInfo) bool {
+	for _, host := range hosts {
+		if !strings.AnyOf(host.State, "DEACTIVATING", "REMOVING", "INACTIVE") {
+			return false
+		}
+	}
+	return true
+}
+
 func allContainersDownOrInactive(hosts []hostInfo) bool {
 	for _, host := range hosts {
 		if host.Status != "DOWN" && host.State != "INACTIVE" {
@@ -381,7 +440,9 @@ func allContainersDownOrInactive(hosts []hostInfo) bool {
 	return true
 }
 
-func deactivate(ctx context.Context, jpool *jrpc.Pool, hostIp string, hostIds []weka.HostId, response *protocol.ScaleResponse) {
+// deactivate deactivates the containers of a machine, newly deactivated machines are added to DeactivatedMachines, as
+// they count toward the rate limit, machines already deactivating are deactivated again on every run
+func deactivate(ctx context.Context, jpool *jrpc.Pool, hostIp string, hostIds []weka.HostId, alreadyDeactivating bool, response *protocol.ScaleResponse) {
 	logger := logging.LoggerFromCtx(ctx)
 	err := jpool.Call(weka.JrpcDeactivateHosts, types.JsonDict{
 		"host_ids":                 hostIds,
@@ -392,6 +453,9 @@ func deactivate(ctx context.Context, jpool *jrpc.Pool, hostIp string, hostIds []
 		response.AddTransientError(err, "deactivateHost")
 	} else {
 		jpool.Drop(hostIp)
+		if !alreadyDeactivating {
+			response.DeactivatedMachines = append(response.DeactivatedMachines, hostIp)
+		}
 	}
 	return
 }
@@ -421,17 +485,20 @@ func deactivateMachine(ctx context.Context, jpool *jrpc.Pool, machineHosts []hos
 	if len(nfsHostsMap) > 0 {
 		machineTxt = "nfs backend machine"
 		for _, host := range machineHosts {
-			if _, ok := nfsHostsMap[host.id]; !ok {
+			nfsHost, ok := nfsHostsMap[host.id]
+			if !ok {
 				continue
 			}
-			err1 := jpool.Call(weka.JrpcInterfaceGroupDeletePort, types.JsonDict{
-				"name":    nfsHostsMap[host.id].InterfaceGroupName,
-				"host_id": nfsHostsMap[host.id].HostId.String(),
-				"port":    nfsHostsMap[host.id].Port,
-			}, nil)
-			if err1 != nil {
-				logger.Error().Err(err1).Send()
-				response.AddTransientError(err1, "interfaceGroupDeletePort")
+			for _, port := range nfsHost.Ports {
+				err1 := jpool.Call(weka.JrpcInterfaceGroupDeletePort, types.JsonDict{
+					"name":    port.InterfaceGroupName,
+					"host_id": nfsHost.HostId.String(),
+					"port":    port.Port,
+				}, nil)
+				if err1 != nil {
+					logger.Error().Err(err1).Send()
+					response.AddTransientError(err1, "interfaceGroupDeletePort")
+				}
 			}
 		}
 	}
@@ -447,7 +514,7 @@ func deactivateMachine(ctx context.Context, jpool *jrpc.Pool, machineHosts []hos
 
 	_ = weka_events.EmitCustomEventUsingJPool(ctx, message, jpool)
 
-	deactivate(ctx, jpool, machineHosts[0].HostIp, hostIds, response)
+	deactivate(ctx, jpool, machineHosts[0].HostIp, hostIds, allContainersDeactivating(machineHosts), response)
 
 }
 
@@ -463,12 +530,23 @@ func isMBC(hostsApiList weka.HostListResponse) bool {
 type hostsMap map[weka.HostId]hostInfo
 type HostGroupType string
 
-type NfsHost struct {
+// NfsHostPort is the membership of a host in an NFS interface group, through the NIC Port
+type NfsHostPort struct {
 	InterfaceGroupName string
-	HostId             weka.HostId
 	Port               string
 }
 
+// NfsHost is a host serving NFS, in one or more interface groups
+type NfsHost struct {
+	HostId weka.HostId
+	Ports  []NfsHostPort
+
+	// Deprecated: the first of Ports, use Ports
+	InterfaceGroupName string
+	// Deprecated: the first of Ports, use Ports
+	Port string
+}
+
 func GetNfsHostsMap(ctx context.Context, jpool *jrpc.Pool) (nfsHostsMap map[weka.HostId]NfsHost, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 	nfsHostsMap = make(map[weka.HostId]NfsHost)
@@ -478,20 +556,31 @@ func GetNfsHostsMap(ctx context.Context, jpool *jrpc.Pool) (nfsHostsMap map[weka
 		logger.Error().Err(err).Send()
 		return
 	}
+	addNfsInterfaceGroups(ctx, nfsHostsMap, interfaceGroupList)
+	return
+}
+
+func addNfsInterfaceGroups(ctx context.Context, nfsHostsMap map[weka.HostId]NfsHost, interfaceGroupList weka.InterfaceGroupListResponse) {
+	logger := logging.LoggerFromCtx(ctx)
 	for _, interfaceGroup := range interfaceGroupList {
-		if interfaceGroup.Type == "NFS" {
-			for _, portHost := range interfaceGroup.Ports {
-				logger.Debug().Msgf("Found NFS port host %s", portHost.HostId)
-				nfsHostsMap[portHost.HostId] = NfsHost{
-					InterfaceGroupName: interfaceGroup.Name,
-					HostId:             portHost.HostId,
-					Port:               portHost.Port,
-				}
+		if interfaceGroup.Type != "NFS" {
+			continue
+		}
+		for _, portHost := range interfaceGroup.Ports {
+			logger.Debug().Msgf("Found NFS port host %s in interface group %s", portHost.HostId, interfaceGroup.Name)
+			nfsHost := nfsHostsMap[portHost.HostId]
+			nfsHost.HostId = portHost.HostId
+			if len(nfsHost.Ports) == 0 {
+				nfsHost.InterfaceGroupName = interfaceGroup.Name
+				nfsHost.Port = portHost.Port
 			}
+			nfsHost.Ports = append(nfsHost.Ports, NfsHostPort{
+				InterfaceGroupName: interfaceGroup.Name,
+				Port:               portHost.Port,
+			})
+			nfsHostsMap[portHost.HostId] = nfsHost
 		}
 	}
-
-	return
 }
 
 func getHostGroupHosts(hosts map[weka.HostId]hostInfo, instances []protocol.HgInstance) map[weka.HostId]hostInfo {
@@ -584,6 +673,17 @@ func ScaleDown(ctx context.Context, info protocol.HostGroupInfoResponse) (respon
 		}
 	}
 
+	decision, err := schedule.Evaluate(info.ScalePolicy, time.Now(), info.RecentDeactivations)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	if decision.Deferred {
+		// the cleanup of inactive, preempted and deactivating machines goes on, only new deactivations are deferred
+		logger.Info().Msgf("Deferring new deactivations, %s", decision)
+	}
+	budget := newDeactivationBudget(decision)
+
 	err = jpool.Call(weka.JrpcHostList, struct{}{}, &hostsApiList)
 	if err != nil {
 		logger.Error().Err(err).Send()
@@ -640,7 +740,7 @@ func ScaleDown(ctx context.Context, info protocol.HostGroupInfoResponse) (respon
 	var errs []error
 	hgHosts := getHostGroupHosts(hosts, info.WekaBackendInstances)
 	logger.Info().Msg("Running scale down on weka backends...")
-	err = ScaleHgDown(ctx, jpool, info.WekaBackendInstances, hgHosts, info.WekaBackendsDesiredCapacity, &response, nil)
+	err = scaleHgDown(ctx, jpool, info.WekaBackendInstances, hgHosts, info.WekaBackendsDesiredCapacity, &response, nil, budget)
 	if err != nil {
 		errs = append(errs, err)
 	}
@@ -671,7 +771,7 @@ func ScaleDown(ctx context.Context, info protocol.HostGroupInfoResponse) (respon
 				}
 			}
 		}
-		err2 := ScaleHgDown(ctx, jpool, info.NfsBackendInstances, nfsHosts, info.NfsBackendsDesiredCapacity, &response, nfsHostsMap)
+		err2 := scaleHgDown(ctx, jpool, info.NfsBackendInstances, nfsHosts, info.NfsBackendsDesiredCapacity, &response, nfsHostsMap, budget)
 		if err2 != nil {
 			errs = append(errs, err2)
 		}
@@ -701,7 +801,36 @@ func getHostIdsString(hosts hostsMap) (hostIds string) {
 	return
 }
 
+// deactivationBudget limits the number of machines scale down starts deactivating, according to the scale policy rate limit
+type deactivationBudget struct {
+	remaining int // schedule.Unlimited if there is no limit
+	resetAt   time.Time
+	reason    string
+}
+
+func newDeactivationBudget(decision schedule.Decision) *deactivationBudget {
+	if decision.Deferred {
+		return &deactivationBudget{remaining: 0, resetAt: decision.DeferredUntil, reason: decision.Reason}
+	}
+	return &deactivationBudget{remaining: decision.Budget, resetAt: decision.BudgetResetAt, reason: "max machines per hour"}
+}
+
+func (b *deactivationBudget) take() bool {
+	if b.remaining == schedule.Unlimited {
+		return true
+	}
+	if b.remaining == 0 {
+		return false
+	}
+	b.remaining--
+	return true
+}
+
 func ScaleHgDown(ctx context.Context, jpool *jrpc.Pool, instances []protocol.HgInstance, hosts hostsMap, desiredCapacity int, response *protocol.ScaleResponse, nfsHostsMap map[weka.HostId]NfsHost) (err error) {
+	return scaleHgDown(ctx, jpool, instances, hosts, desiredCapacity, response, nfsHostsMap, &deactivationBudget{remaining: schedule.Unlimited})
+}
+
+func scaleHgDown(ctx context.Context, jpool *jrpc.Pool, instances []protocol.HgInstance, hosts hostsMap, desiredCapacity int, response *protocol.ScaleResponse, nfsHostsMap map[weka.HostId]NfsHost, budget *deactivationBudget) (err error) {
 	/*
 		Code in here based on following logic:
 
@@ -726,7 +855,11 @@ func ScaleHgDown(ctx context.Context, jpool *jrpc.Pool, instances []protocol.HgI
 	var machinesIps []string
 	machinesIpsMap := make(map[string]types.Nilt)
 
-	machineToHostMap := getMachineToHostMap(ctx, hosts) // protocol gws + weka backends
+	machineToHostMap, err := getMachineToHostMap(hosts) // protocol gws + weka backends
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
 	inactiveMachines := make(map[string][]hostInfo)
 	inactiveOrDownHostsIps := make(map[string]types.Nilt)
 	for _, host := range hosts {
@@ -754,10 +887,12 @@ func ScaleHgDown(ctx context.Context, jpool *jrpc.Pool, instances []protocol.HgI
 		}
 	}
 
+	setInstancesLifecycle(hostsList, instances)
 	calculateHostsState(ctx, hostsList)
 
 	sort.Slice(hostsList, func(i, j int) bool {
 		// Giving priority to disks to hosts with disk being removed
+		// Then hosts of the instances the instance refresh retires
 		// Then hosts with disks not in active state
 		// Then hosts sorted by add time
 		a := hostsList[i]
@@ -768,6 +903,9 @@ func ScaleHgDown(ctx context.Context, jpool *jrpc.Pool, instances []protocol.HgI
 		if a.scaleState > b.scaleState {
 			return false
 		}
+		if a.refreshTarget != b.refreshTarget {
+			return a.refreshTarget
+		}
 		if a.numNotHealthyDrives() > b.numNotHealthyDrives() {
 			return true
 		}
@@ -777,11 +915,19 @@ func ScaleHgDown(ctx context.Context, jpool *jrpc.Pool, instances []protocol.HgI
 		return a.AddedTime.Before(b.AddedTime)
 	})
 
+	preemptedMachines := make(map[string]types.Nilt)
+	notDeactivatingMachines := make(map[string]types.Nilt)
 	for _, host := range hostsList {
 		if _, ok := machinesIpsMap[host.HostIp]; !ok {
 			machinesIpsMap[host.HostIp] = types.Nilv
 			machinesIps = append(machinesIps, host.HostIp)
 		}
+		if host.scaleState == PREEMPTED {
+			preemptedMachines[host.HostIp] = types.Nilv
+		}
+		if host.scaleState != DEACTIVATING {
+			notDeactivatingMachines[host.HostIp] = types.Nilv
+		}
 	}
 	backendMachinesNumber := len(machineToHostMap)
 	logger.Info().Msgf("Backend machines number:%d Desired capacity:%d", backendMachinesNumber, desiredCapacity)
@@ -797,6 +943,17 @@ func ScaleHgDown(ctx context.Context, jpool *jrpc.Pool, instances []protocol.HgI
 	numToDeactivate := getNumToDeactivate(ctx, hostsList, desiredCapacity)
 	for _, hostIp := range machinesIps[:numToDeactivate] {
 		eventParams.reason = ScaleDownEvent
+		_, preempted := preemptedMachines[hostIp]
+		if preempted {
+			eventParams.reason = PreemptionEvent
+		}
+		// preempted machines are lost anyway, so they are not limited by the max machines per hour
+		if _, ok := notDeactivatingMachines[hostIp]; ok && !preempted && !budget.take() {
+			logger.Info().Msgf("Not deactivating machine %s, %s", hostIp, budget.reason)
+			response.DeferredUntil = &budget.resetAt
+			response.DeferredReason = budget.reason
+			continue
+		}
 		deactivateMachine(ctx, jpool, machineToHostMap[hostIp], response, &eventParams, nfsHostsMap)
 	}
 
@@ -884,7 +1041,12 @@ func handleLeftOverHosts(ctx context.Context, jpool *jrpc.Pool, instances []prot
 	var hostsList []hostInfo
 	inactiveMachines := make(map[string][]hostInfo)
 	inactiveOrDownHostsIps := make(map[string]types.Nilt)
-	machineToHostMap := getMachineToHostMap(ctx, leftOverHosts)
+	machineToHostMap, err := getMachineToHostMap(leftOverHosts)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		response.AddTransientError(err, "handleLeftOverHosts")
+		return
+	}
 	for _, host := range leftOverHosts {
 		if host.Mode == "client" {
 			continue
@@ -0,0 +1,240 @@
+package scale_down
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/schedule"
+)
+
+func TestCalculateDeactivateTarget(t *testing.T) {
+	tests := []struct {
+		name                 string
+		healthy              int
+		unhealthy            int
+		deactivating         int
+		preempted            int
+		spotDeactivating     int
+		desired              int
+		expectedToDeactivate int
+	}{
+		{"steady", 6, 0, 0, 0, 0, 6, 0},
+		{"scale down", 8, 0, 0, 0, 0, 6, 2},
+		{"unhealthy limit", 6, 4, 0, 0, 0, 10, 2},
+		{"unhealthy limit with deactivating", 6, 3, 2, 0, 0, 11, 2},
+		{"preempted", 6, 0, 0, 3, 0, 9, 3},
+		{"preempted and unhealthy", 6, 3, 0, 3, 0, 12, 5},
+		{"spot deactivating not throttling unhealthy", 6, 3, 2, 0, 2, 11, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := CalculateDeactivateTargetWithPreempted(tt.healthy, tt.unhealthy, tt.deactivating, tt.preempted, tt.spotDeactivating, tt.desired)
+			if result != tt.expectedToDeactivate {
+				t.Errorf("CalculateDeactivateTargetWithPreempted() = %d; want %d", result, tt.expectedToDeactivate)
+			}
+			if tt.preempted == 0 && tt.spotDeactivating == 0 {
+				result = CalculateDeactivateTarget(tt.healthy, tt.unhealthy, tt.deactivating, tt.desired)
+				if result != tt.expectedToDeactivate {
+					t.Errorf("CalculateDeactivateTarget() = %d; want %d", result, tt.expectedToDeactivate)
+				}
+			}
+		})
+	}
+}
+
+func TestAddNfsInterfaceGroups(t *testing.T) {
+	var interfaceGroupList weka.InterfaceGroupListResponse
+	err := json.Unmarshal([]byte(`[
+		{"name": "tenant-a", "type": "NFS", "ports": [{"host_id": "HostId<1>", "port": "eth1"}, {"host_id": "HostId<2>", "port": "eth1"}]},
+		{"name": "tenant-b", "type": "NFS", "ports": [{"host_id": "HostId<1>", "port": "eth2"}]},
+		{"name": "smb", "type": "SMB", "ports": [{"host_id": "HostId<3>", "port": "eth0"}]}
+	]`), &interfaceGroupList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nfsHostsMap := make(map[weka.HostId]NfsHost)
+	addNfsInterfaceGroups(context.Background(), nfsHostsMap, interfaceGroupList)
+	if len(nfsHostsMap) != 2 {
+		t.Fatalf("expected 2 nfs hosts, got %d", len(nfsHostsMap))
+	}
+	for hostId, nfsHost := range nfsHostsMap {
+		expected := map[int][]NfsHostPort{
+			1: {{"tenant-a", "eth1"}, {"tenant-b", "eth2"}},
+			2: {{"tenant-a", "eth1"}},
+		}[hostId.Int()]
+		if len(nfsHost.Ports) != len(expected) {
+			t.Fatalf("host %s: expected ports %v, got %v", hostId, expected, nfsHost.Ports)
+		}
+		for i := range expected {
+			if nfsHost.Ports[i] != expected[i] {
+				t.Errorf("host %s: expected ports %v, got %v", hostId, expected, nfsHost.Ports)
+			}
+		}
+		if nfsHost.InterfaceGroupName != expected[0].InterfaceGroupName || nfsHost.Port != expected[0].Port {
+			t.Errorf("host %s: expected the deprecated fields of the first port %v, got %s %s", hostId, expected[0], nfsHost.InterfaceGroupName, nfsHost.Port)
+		}
+	}
+}
+
+func TestGetMachineToHostMap(t *testing.T) {
+	// 2 drive, 2 compute and a frontend container on one machine
+	var hostList weka.HostListResponse
+	err := json.Unmarshal([]byte(`{
+		"HostId<0>": {"host_ip": "10.0.0.1", "mode": "backend", "machine_identifier": "machine-1"},
+		"HostId<1>": {"host_ip": "10.0.0.1", "mode": "backend", "machine_identifier": "machine-1"},
+		"HostId<2>": {"host_ip": "10.0.0.1", "mode": "backend", "machine_identifier": "machine-1"},
+		"HostId<3>": {"host_ip": "10.0.0.1", "mode": "backend", "machine_identifier": "machine-1"},
+		"HostId<4>": {"host_ip": "10.0.0.1", "mode": "backend", "machine_identifier": "machine-1"},
+		"HostId<5>": {"host_ip": "10.0.0.2", "mode": "client", "machine_identifier": "machine-2"}
+	}`), &hostList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make(hostsMap)
+	for hostId, host := range hostList {
+		hosts[hostId] = hostInfo{Host: host, id: hostId}
+	}
+
+	machineToHostMap, err := getMachineToHostMap(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machineToHostMap) != 1 || len(machineToHostMap["10.0.0.1"]) != 5 {
+		t.Errorf("expected a machine of 5 containers, got %v", machineToHostMap)
+	}
+
+	for hostId, host := range hosts {
+		if hostId.Int() == 4 {
+			host.MachineIdentifier = "machine-3"
+			hosts[hostId] = host
+		}
+	}
+	if _, err = getMachineToHostMap(hosts); err == nil {
+		t.Error("expected an error for a machine with 2 machine identifiers")
+	}
+}
+
+// newFakePool returns a pool of a JSON-RPC server that succeeds every call, and the methods it was called with
+func newFakePool(t *testing.T) (*jrpc.Pool, func() []string) {
+	var mu sync.Mutex
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Method string          `json:"method"`
+			Id     json.RawMessage `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		methods = append(methods, request.Method)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": request.Id, "result": nil})
+	}))
+	t.Cleanup(server.Close)
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	pool := &jrpc.Pool{
+		Ips:     []string{serverUrl.Host},
+		Clients: map[string]*jrpc.BaseClient{},
+		Builder: func(ip string) *jrpc.BaseClient {
+			return jrpc.NewClient(ctx, log.New(io.Discard, "", 0), serverUrl, http.DefaultTransport, &jrpc.ClientOptions{})
+		},
+		Ctx: ctx,
+	}
+	return pool, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), methods...)
+	}
+}
+
+func TestScaleHgDownDeferred(t *testing.T) {
+	// a healthy machine, a preempted machine and a machine already deactivating
+	var hostList weka.HostListResponse
+	err := json.Unmarshal([]byte(`{
+		"HostId<1>": {"host_ip": "10.0.0.1", "mode": "backend", "container_name": "compute0", "state": "ACTIVE", "status": "UP", "added_time": "2026-01-01T00:00:00Z"},
+		"HostId<2>": {"host_ip": "10.0.0.2", "mode": "backend", "container_name": "compute0", "state": "ACTIVE", "status": "UP", "added_time": "2026-01-02T00:00:00Z"},
+		"HostId<3>": {"host_ip": "10.0.0.3", "mode": "backend", "container_name": "compute0", "state": "DEACTIVATING", "status": "UP", "added_time": "2026-01-03T00:00:00Z"}
+	}`), &hostList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := []protocol.HgInstance{
+		{Id: "i-1", PrivateIp: "10.0.0.1"},
+		{Id: "i-2", PrivateIp: "10.0.0.2", Lifecycle: protocol.SpotInstance, PendingPreemption: true},
+		{Id: "i-3", PrivateIp: "10.0.0.3"},
+	}
+	deferredUntil := time.Date(2026, 1, 5, 6, 0, 0, 0, time.UTC)
+	decision := schedule.Decision{Deferred: true, DeferredUntil: deferredUntil, Reason: "freeze period"}
+
+	tests := []struct {
+		name                string
+		desired             int
+		expectedDeactivated []string
+		expectedDeferred    bool
+	}{
+		// the preempted and deactivating machines are deactivated, only the former is newly deactivated
+		{"no new deactivation", 3, []string{"10.0.0.2"}, false},
+		// scaling down the healthy machine is deferred
+		{"scale down", 0, []string{"10.0.0.2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := make(hostsMap)
+			for hostId, host := range hostList {
+				hosts[hostId] = hostInfo{Host: host, id: hostId}
+			}
+			pool, methods := newFakePool(t)
+			response := protocol.ScaleResponse{}
+			err := scaleHgDown(context.Background(), pool, instances, hosts, tt.desired, &response, nil, newDeactivationBudget(decision))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(response.DeactivatedMachines, tt.expectedDeactivated) {
+				t.Errorf("expected deactivated machines %v, got %v", tt.expectedDeactivated, response.DeactivatedMachines)
+			}
+			deactivateCalls := 0
+			for _, method := range methods() {
+				if method == string(weka.JrpcDeactivateHosts) {
+					deactivateCalls++
+				}
+			}
+			if deactivateCalls != 2 {
+				t.Errorf("expected the preempted and deactivating machines to be deactivated, got %d calls", deactivateCalls)
+			}
+			if tt.expectedDeferred {
+				if response.DeferredUntil == nil || !response.DeferredUntil.Equal(deferredUntil) || response.DeferredReason != "freeze period" {
+					t.Errorf("expected a deferral until %s, got %v %q", deferredUntil, response.DeferredUntil, response.DeferredReason)
+				}
+			} else if response.DeferredUntil != nil {
+				t.Errorf("expected no deferral, got %s", response.DeferredUntil)
+			}
+			if len(response.Hosts) != 3 {
+				t.Errorf("expected 3 hosts in the response, got %d", len(response.Hosts))
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package scale_up
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	strings2 "strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/connectors"
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/math"
+	"github.com/weka/go-cloud-lib/lib/strings"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const DefaultJoinTimeout = 60 * time.Minute
+
+type joinState int
+
+const (
+	JOINING joinState = iota
+	JOINED
+	UNHEALTHY
+	LEAVING
+)
+
+func (s joinState) String() string {
+	switch s {
+	case JOINING:
+		return "JOINING"
+	case JOINED:
+		return "JOINED"
+	case UNHEALTHY:
+		return "UNHEALTHY"
+	case LEAVING:
+		return "LEAVING"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", s)
+	}
+}
+
+type machineInfo struct {
+	hosts  []weka.Host
+	drives []weka.Drive
+}
+
+// joinStartTime returns the time the instance started joining: its launch time if the cloud function
+// provided one, otherwise the time the first container of the machine was added to the cluster, otherwise firstSeen,
+// the time scale up first saw the instance
+func (m machineInfo) joinStartTime(instance protocol.HgInstance, firstSeen time.Time) time.Time {
+	if !instance.LaunchTime.IsZero() {
+		return instance.LaunchTime
+	}
+	var started time.Time
+	for _, host := range m.hosts {
+		if started.IsZero() || host.AddedTime.Before(started) {
+			started = host.AddedTime
+		}
+	}
+	if started.IsZero() {
+		return firstSeen
+	}
+	return started
+}
+
+func (m machineInfo) hasDriveContainer() bool {
+	for _, host := range m.hosts {
+		if strings2.Contains(host.ContainerName, "drive") {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveJoinState returns the join state of a machine, only a JOINING machine is timed by the join timeout
+func deriveJoinState(machine machineInfo) joinState {
+	if len(machine.hosts) == 0 {
+		return JOINING
+	}
+	for _, host := range machine.hosts {
+		if strings.AnyOf(host.State, "DEACTIVATING", "REMOVING", "INACTIVE") {
+			return LEAVING
+		}
+	}
+	if !machine.hasDriveContainer() || len(machine.drives) == 0 {
+		return JOINING
+	}
+	// the drives were added, the machine joined the cluster, a DOWN container or an inactive drive is left to the
+	// unhealthy handling of scale down
+	for _, host := range machine.hosts {
+		if host.State != "ACTIVE" || host.Status != "UP" {
+			return UNHEALTHY
+		}
+	}
+	for _, drive := range machine.drives {
+		if drive.Status != "ACTIVE" {
+			return UNHEALTHY
+		}
+	}
+	return JOINED
+}
+
+func getMachinesMap(hostsApiList weka.HostListResponse, driveApiList weka.DriveListResponse) map[string]*machineInfo {
+	machines := make(map[string]*machineInfo)
+	for _, host := range hostsApiList {
+		if host.Mode != "backend" {
+			continue
+		}
+		if _, ok := machines[host.HostIp]; !ok {
+			machines[host.HostIp] = &machineInfo{}
+		}
+		machines[host.HostIp].hosts = append(machines[host.HostIp].hosts, host)
+	}
+	for _, drive := range driveApiList {
+		host, ok := hostsApiList[drive.HostId]
+		if !ok || host.Mode != "backend" {
+			continue
+		}
+		machines[host.HostIp].drives = append(machines[host.HostIp].drives, drive)
+	}
+	return machines
+}
+
+// CalculateScaleUp decides, for every instance of the host group, whether to keep waiting for it to join the cluster
+// or to recycle it because it is stuck in join for longer than joinTimeout.
+// Missing capacity is the number of instances needed to reach the desired capacity, recycled instances included.
+// joiningSince is the ScaleUpResponse.JoiningSince of the previous run, for instances without a join start time.
+func CalculateScaleUp(ctx context.Context, instances []protocol.HgInstance, hostsApiList weka.HostListResponse, driveApiList weka.DriveListResponse, desiredCapacity int, joinTimeout time.Duration, joiningSince map[string]time.Time, response *protocol.ScaleUpResponse) {
+	logger := logging.LoggerFromCtx(ctx)
+	machines := getMachinesMap(hostsApiList, driveApiList)
+	now := time.Now().UTC()
+
+	joined := 0
+	for _, instance := range instances {
+		if instance.PendingPreemption {
+			// about to be preempted and deactivated by scale down, its capacity is counted as missing
+			logger.Info().Msgf("Instance %s:%s is pending preemption", instance.Id, instance.PrivateIp)
+			continue
+		}
+		machine, ok := machines[instance.PrivateIp]
+		if !ok {
+			machine = &machineInfo{}
+		}
+
+		state := deriveJoinState(*machine)
+		logger.Info().Msgf("Instance %s:%s join state: %s", instance.Id, instance.PrivateIp, state)
+		switch state {
+		case JOINED, UNHEALTHY:
+			joined++
+		case LEAVING:
+			// scale down takes care of machines which are being removed
+			continue
+		case JOINING:
+			firstSeen, ok := joiningSince[instance.Id]
+			if !ok {
+				firstSeen = now
+			}
+			started := machine.joinStartTime(instance, firstSeen)
+			if instance.LaunchTime.IsZero() && len(machine.hosts) == 0 {
+				if response.JoiningSince == nil {
+					response.JoiningSince = make(map[string]time.Time)
+				}
+				response.JoiningSince[instance.Id] = firstSeen
+			}
+			if now.Sub(started) > joinTimeout {
+				logger.Info().Msgf("Instance %s:%s is stuck in join for %s, recycling", instance.Id, instance.PrivateIp, now.Sub(started))
+				response.ToRecycle = append(response.ToRecycle, instance)
+				continue
+			}
+			response.ToWait = append(response.ToWait, instance)
+		}
+	}
+
+	response.MissingCapacity = math.Max(desiredCapacity-joined-len(response.ToWait), 0)
+	logger.Info().Msgf("Joined: %d, joining: %d, to recycle: %d, missing capacity: %d, desired capacity: %d",
+		joined, len(response.ToWait), len(response.ToRecycle), response.MissingCapacity, desiredCapacity)
+}
+
+func ScaleUp(ctx context.Context, info protocol.HostGroupInfoResponse) (response protocol.ScaleUpResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msg("Running scale up...")
+	response.Version = protocol.Version
+
+	err = info.Validate()
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	if info.Role != "backend" {
+		logger.Info().Msg("Skipping scale up, not a backend")
+		return
+	}
+
+	joinTimeout := info.JoinTimeout
+	if joinTimeout <= 0 {
+		joinTimeout = DefaultJoinTimeout
+	}
+
+	jrpcBuilder := func(ip string) *jrpc.BaseClient {
+		return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, info.Username, info.Password)
+	}
+	ips := info.BackendIps
+	rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	jpool := &jrpc.Pool{
+		Ips:     ips,
+		Clients: map[string]*jrpc.BaseClient{},
+		Active:  "",
+		Builder: jrpcBuilder,
+		Ctx:     ctx,
+	}
+
+	hostsApiList := weka.HostListResponse{}
+	driveApiList := weka.DriveListResponse{}
+
+	err = jpool.Call(weka.JrpcHostList, struct{}{}, &hostsApiList)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	err = jpool.Call(weka.JrpcDrivesList, struct{}{}, &driveApiList)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	CalculateScaleUp(ctx, info.WekaBackendInstances, hostsApiList, driveApiList, info.WekaBackendsDesiredCapacity, joinTimeout, info.JoiningSince, &response)
+	return
+}
@@ -0,0 +1,147 @@
+package scale_up
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestDeriveJoinState(t *testing.T) {
+	driveHost := weka.Host{ContainerName: "drives0", State: "ACTIVE", Status: "UP"}
+	computeHost := weka.Host{ContainerName: "compute0", State: "ACTIVE", Status: "UP"}
+	activeDrive := weka.Drive{Status: "ACTIVE"}
+
+	tests := []struct {
+		name     string
+		machine  machineInfo
+		expected joinState
+	}{
+		{"no containers", machineInfo{}, JOINING},
+		{"joined", machineInfo{hosts: []weka.Host{driveHost, computeHost}, drives: []weka.Drive{activeDrive}}, JOINED},
+		{"deactivating", machineInfo{hosts: []weka.Host{driveHost, {ContainerName: "compute0", State: "DEACTIVATING", Status: "UP"}}, drives: []weka.Drive{activeDrive}}, LEAVING},
+		{"inactive", machineInfo{hosts: []weka.Host{{ContainerName: "drives0", State: "INACTIVE", Status: "DOWN"}}}, LEAVING},
+		{"no drive container", machineInfo{hosts: []weka.Host{computeHost}}, JOINING},
+		{"no drives", machineInfo{hosts: []weka.Host{driveHost, computeHost}}, JOINING},
+		{"container down", machineInfo{hosts: []weka.Host{driveHost, {ContainerName: "compute0", State: "ACTIVE", Status: "DOWN"}}, drives: []weka.Drive{activeDrive}}, UNHEALTHY},
+		{"failed drive", machineInfo{hosts: []weka.Host{driveHost, computeHost}, drives: []weka.Drive{activeDrive, {Status: "FAILED"}}}, UNHEALTHY},
+		{"container down without drives", machineInfo{hosts: []weka.Host{{ContainerName: "drives0", State: "ACTIVE", Status: "DOWN"}}}, JOINING},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if state := deriveJoinState(tt.machine); state != tt.expected {
+				t.Errorf("deriveJoinState() = %s; want %s", state, tt.expected)
+			}
+		})
+	}
+}
+
+func TestJoinStartTime(t *testing.T) {
+	launched := time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC)
+	added := time.Date(2024, 1, 8, 10, 5, 0, 0, time.UTC)
+	firstSeen := time.Date(2024, 1, 8, 10, 10, 0, 0, time.UTC)
+	machine := machineInfo{hosts: []weka.Host{{AddedTime: added.Add(time.Minute)}, {AddedTime: added}}}
+
+	tests := []struct {
+		name     string
+		machine  machineInfo
+		instance protocol.HgInstance
+		expected time.Time
+	}{
+		{"launch time", machine, protocol.HgInstance{LaunchTime: launched}, launched},
+		{"first container added", machine, protocol.HgInstance{}, added},
+		{"first seen", machineInfo{}, protocol.HgInstance{}, firstSeen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if started := tt.machine.joinStartTime(tt.instance, firstSeen); !started.Equal(tt.expected) {
+				t.Errorf("joinStartTime() = %s; want %s", started, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCalculateScaleUp(t *testing.T) {
+	now := time.Now().UTC()
+	recently := now.Add(-5 * time.Minute).Format(time.RFC3339)
+	longAgo := now.Add(-2 * time.Hour)
+
+	var hosts weka.HostListResponse
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{
+		"HostId<0>": {"host_ip": "10.0.0.1", "mode": "backend", "container_name": "drives0", "state": "ACTIVE", "status": "UP", "added_time": %[1]q},
+		"HostId<1>": {"host_ip": "10.0.0.1", "mode": "backend", "container_name": "compute0", "state": "ACTIVE", "status": "UP", "added_time": %[1]q},
+		"HostId<2>": {"host_ip": "10.0.0.2", "mode": "backend", "container_name": "drives0", "state": "ACTIVE", "status": "DOWN", "added_time": %[1]q},
+		"HostId<3>": {"host_ip": "10.0.0.3", "mode": "backend", "container_name": "drives0", "state": "ACTIVE", "status": "DOWN", "added_time": %[2]q},
+		"HostId<4>": {"host_ip": "10.0.0.4", "mode": "backend", "container_name": "drives0", "state": "DEACTIVATING", "status": "UP", "added_time": %[2]q},
+		"HostId<5>": {"host_ip": "10.0.0.9", "mode": "client", "container_name": "client", "state": "ACTIVE", "status": "UP", "added_time": %[2]q},
+		"HostId<6>": {"host_ip": "10.0.0.10", "mode": "backend", "container_name": "drives0", "state": "ACTIVE", "status": "UP", "added_time": %[2]q}
+	}`, recently, longAgo.Format(time.RFC3339))), &hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var drives weka.DriveListResponse
+	err = json.Unmarshal([]byte(`{"DiskId<0>": {"host_id": "HostId<0>", "status": "ACTIVE"}, "DiskId<1>": {"host_id": "HostId<3>", "status": "FAILED"}}`), &drives)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances := []protocol.HgInstance{
+		{Id: "joined", PrivateIp: "10.0.0.1"},
+		{Id: "joining", PrivateIp: "10.0.0.2"},
+		// joined long ago and now DOWN with a failed drive, scale down handles it
+		{Id: "down", PrivateIp: "10.0.0.3"},
+		{Id: "stuck", PrivateIp: "10.0.0.10"},
+		{Id: "leaving", PrivateIp: "10.0.0.4"},
+		{Id: "stuck-launched", PrivateIp: "10.0.0.5", LaunchTime: longAgo},
+		{Id: "stuck-first-seen", PrivateIp: "10.0.0.6"},
+		{Id: "new", PrivateIp: "10.0.0.7"},
+		{Id: "preempted", PrivateIp: "10.0.0.8", PendingPreemption: true},
+	}
+	joiningSince := map[string]time.Time{"stuck-first-seen": longAgo, "terminated": longAgo}
+
+	tests := []struct {
+		name            string
+		desired         int
+		missingCapacity int
+	}{
+		{"below desired", 7, 3},
+		{"at desired", 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := protocol.ScaleUpResponse{}
+			CalculateScaleUp(context.Background(), instances, hosts, drives, tt.desired, time.Hour, joiningSince, &response)
+
+			if ids := instanceIds(response.ToWait); ids != "joining new" {
+				t.Errorf("expected to wait for joining and new, got %s", ids)
+			}
+			if ids := instanceIds(response.ToRecycle); ids != "stuck stuck-first-seen stuck-launched" {
+				t.Errorf("expected to recycle the stuck instances, got %s", ids)
+			}
+			if response.MissingCapacity != tt.missingCapacity {
+				t.Errorf("missing capacity = %d; want %d", response.MissingCapacity, tt.missingCapacity)
+			}
+			// the instances without a join start time are first seen now, unless seen before
+			if len(response.JoiningSince) != 2 || !response.JoiningSince["stuck-first-seen"].Equal(longAgo) || response.JoiningSince["new"].Before(now) {
+				t.Errorf("unexpected joining since %v", response.JoiningSince)
+			}
+		})
+	}
+}
+
+func instanceIds(instances []protocol.HgInstance) string {
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, instance.Id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
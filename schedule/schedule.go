@@ -0,0 +1,185 @@
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/weka/go-cloud-lib/lib/cron"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const nextWindowSearchLimit = 366 * 24 * time.Hour
+const rateLimitPeriod = time.Hour
+
+// maxEvaluationRounds bounds the search for a time which is both outside freeze periods and inside a maintenance window
+const maxEvaluationRounds = 16
+
+const Unlimited = -1
+
+type Decision struct {
+	Deferred      bool
+	DeferredUntil time.Time
+	Reason        string
+	// Budget is the number of machines that may be deactivated now, Unlimited if no rate limit is set
+	Budget int
+	// BudgetResetAt is when the rate limit budget grows again, zero if Budget is not exhausted
+	BudgetResetAt time.Time
+}
+
+func (d Decision) String() string {
+	if d.Deferred {
+		return fmt.Sprintf("deferred until %s: %s", d.DeferredUntil.UTC().Format(time.RFC3339), d.Reason)
+	}
+	return "allowed"
+}
+
+type window struct {
+	schedule *cron.Schedule
+	protocol.ScheduleWindow
+}
+
+func parseWindows(windows []protocol.ScheduleWindow) (parsed []window, err error) {
+	for _, w := range windows {
+		if w.Cron != "" {
+			if w.Duration <= 0 {
+				err = fmt.Errorf("window %q: duration should be greater than 0", w.Cron)
+				return
+			}
+			var schedule *cron.Schedule
+			schedule, err = cron.Parse(w.Cron)
+			if err != nil {
+				return
+			}
+			parsed = append(parsed, window{schedule, w})
+			continue
+		}
+		if w.Start == nil || w.End == nil || !w.End.After(*w.Start) {
+			err = fmt.Errorf("window should have either cron and duration or start before end")
+			return
+		}
+		parsed = append(parsed, window{nil, w})
+	}
+	return
+}
+
+// activeUntil returns the end of the window if t is inside it, zero time otherwise
+func (w window) activeUntil(t time.Time) time.Time {
+	if w.schedule == nil {
+		if !t.Before(*w.Start) && t.Before(*w.End) {
+			return *w.End
+		}
+		return time.Time{}
+	}
+	start := w.schedule.Prev(t, t.Add(-w.Duration).Add(time.Minute))
+	if start.IsZero() {
+		return time.Time{}
+	}
+	return start.Add(w.Duration)
+}
+
+// nextStart returns the first start of the window after t, zero time if there is none
+func (w window) nextStart(t time.Time) time.Time {
+	if w.schedule == nil {
+		if w.Start.After(t) {
+			return *w.Start
+		}
+		return time.Time{}
+	}
+	return w.schedule.Next(t, t.Add(nextWindowSearchLimit))
+}
+
+// Evaluate decides whether scale operations may run at now according to the policy.
+// recentDeactivations are the times machines were deactivated, used for the max machines per hour limit.
+func Evaluate(policy *protocol.ScalePolicy, now time.Time, recentDeactivations []time.Time) (decision Decision, err error) {
+	decision.Budget = Unlimited
+	if policy == nil {
+		return
+	}
+
+	location := time.UTC
+	if policy.Timezone != "" {
+		location, err = time.LoadLocation(policy.Timezone)
+		if err != nil {
+			err = fmt.Errorf("invalid scale policy timezone: %w", err)
+			return
+		}
+	}
+	freezes, err := parseWindows(policy.FreezePeriods)
+	if err != nil {
+		err = fmt.Errorf("invalid scale policy freeze period: %w", err)
+		return
+	}
+	maintenanceWindows, err := parseWindows(policy.MaintenanceWindows)
+	if err != nil {
+		err = fmt.Errorf("invalid scale policy maintenance window: %w", err)
+		return
+	}
+
+	now = now.In(location)
+	t := now
+	for i := 0; i < maxEvaluationRounds; i++ {
+		moved := false
+		for _, freeze := range freezes {
+			if end := freeze.activeUntil(t); !end.IsZero() {
+				t = end
+				decision.Reason = "freeze period"
+				moved = true
+			}
+		}
+
+		if len(maintenanceWindows) > 0 {
+			inside := false
+			var next time.Time
+			for _, w := range maintenanceWindows {
+				if !w.activeUntil(t).IsZero() {
+					inside = true
+					break
+				}
+				if start := w.nextStart(t); !start.IsZero() && (next.IsZero() || start.Before(next)) {
+					next = start
+				}
+			}
+			if !inside {
+				if next.IsZero() {
+					err = fmt.Errorf("no upcoming maintenance window")
+					return
+				}
+				t = next
+				if decision.Reason == "" {
+					decision.Reason = "outside maintenance window"
+				}
+				moved = true
+			}
+		}
+
+		if !moved {
+			break
+		}
+	}
+
+	if t.After(now) {
+		decision.Deferred = true
+		decision.DeferredUntil = t
+		return
+	}
+	decision.Reason = ""
+
+	if policy.MaxMachinesPerHour > 0 {
+		decision.Budget = policy.MaxMachinesPerHour
+		var oldest time.Time
+		for _, deactivation := range recentDeactivations {
+			if now.Sub(deactivation) >= rateLimitPeriod || deactivation.After(now) {
+				continue
+			}
+			decision.Budget--
+			if oldest.IsZero() || deactivation.Before(oldest) {
+				oldest = deactivation
+			}
+		}
+		if decision.Budget <= 0 {
+			decision.Budget = 0
+			decision.BudgetResetAt = oldest.Add(rateLimitPeriod)
+		}
+	}
+	return
+}
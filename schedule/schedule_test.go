@@ -0,0 +1,111 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestEvaluate(t *testing.T) {
+	// Monday
+	now := time.Date(2024, 1, 8, 10, 30, 0, 0, time.UTC)
+	freezeStart := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+	freezeEnd := time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		policy        *protocol.ScalePolicy
+		deferred      bool
+		deferredUntil time.Time
+		reason        string
+	}{
+		{"no policy", nil, false, time.Time{}, ""},
+		{
+			"business hours freeze",
+			&protocol.ScalePolicy{FreezePeriods: []protocol.ScheduleWindow{{Cron: "0 9 * * 1-5", Duration: 9 * time.Hour}}},
+			true, time.Date(2024, 1, 8, 18, 0, 0, 0, time.UTC), "freeze period",
+		},
+		{
+			"outside business hours freeze",
+			&protocol.ScalePolicy{FreezePeriods: []protocol.ScheduleWindow{{Cron: "0 9 * * 1-5", Duration: time.Hour}}},
+			false, time.Time{}, "",
+		},
+		{
+			"freeze in timezone",
+			&protocol.ScalePolicy{Timezone: "Asia/Jerusalem", FreezePeriods: []protocol.ScheduleWindow{{Cron: "0 9 * * 1-5", Duration: 9 * time.Hour}}},
+			true, time.Date(2024, 1, 8, 16, 0, 0, 0, time.UTC), "freeze period",
+		},
+		{
+			"nightly maintenance window",
+			&protocol.ScalePolicy{MaintenanceWindows: []protocol.ScheduleWindow{{Cron: "0 2 * * *", Duration: 2 * time.Hour}}},
+			true, time.Date(2024, 1, 9, 2, 0, 0, 0, time.UTC), "outside maintenance window",
+		},
+		{
+			"inside maintenance window",
+			&protocol.ScalePolicy{MaintenanceWindows: []protocol.ScheduleWindow{{Cron: "0 10 * * *", Duration: time.Hour}}},
+			false, time.Time{}, "",
+		},
+		{
+			"one time freeze before maintenance window",
+			&protocol.ScalePolicy{
+				MaintenanceWindows: []protocol.ScheduleWindow{{Cron: "0 2 * * *", Duration: 2 * time.Hour}},
+				FreezePeriods:      []protocol.ScheduleWindow{{Start: &freezeStart, End: &freezeEnd}},
+			},
+			true, time.Date(2024, 1, 9, 2, 0, 0, 0, time.UTC), "freeze period",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := Evaluate(tt.policy, now, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision.Deferred != tt.deferred {
+				t.Fatalf("deferred = %t; want %t", decision.Deferred, tt.deferred)
+			}
+			if tt.deferred && !decision.DeferredUntil.Equal(tt.deferredUntil) {
+				t.Errorf("deferred until = %s; want %s", decision.DeferredUntil, tt.deferredUntil)
+			}
+			if decision.Reason != tt.reason {
+				t.Errorf("reason = %q; want %q", decision.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestEvaluateRateLimit(t *testing.T) {
+	now := time.Date(2024, 1, 8, 10, 30, 0, 0, time.UTC)
+	policy := &protocol.ScalePolicy{MaxMachinesPerHour: 2}
+
+	decision, err := Evaluate(policy, now, []time.Time{now.Add(-2 * time.Hour), now.Add(-10 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Budget != 1 {
+		t.Errorf("budget = %d; want 1", decision.Budget)
+	}
+
+	decision, err = Evaluate(policy, now, []time.Time{now.Add(-40 * time.Minute), now.Add(-10 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Budget != 0 || !decision.BudgetResetAt.Equal(now.Add(20*time.Minute)) {
+		t.Errorf("budget = %d, reset at %s; want 0, %s", decision.Budget, decision.BudgetResetAt, now.Add(20*time.Minute))
+	}
+}
+
+func TestEvaluateInvalidPolicy(t *testing.T) {
+	policies := []*protocol.ScalePolicy{
+		{Timezone: "Nowhere/Nothing"},
+		{FreezePeriods: []protocol.ScheduleWindow{{Cron: "0 25 * * *", Duration: time.Hour}}},
+		{FreezePeriods: []protocol.ScheduleWindow{{Cron: "0 9 * * *"}}},
+		{MaintenanceWindows: []protocol.ScheduleWindow{{}}},
+	}
+	for _, policy := range policies {
+		if _, err := Evaluate(policy, time.Now(), nil); err == nil {
+			t.Errorf("expected error for policy %+v", policy)
+		}
+	}
+}
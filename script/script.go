@@ -0,0 +1,346 @@
+package script
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lithammer/dedent"
+	"github.com/weka/go-cloud-lib/functions_def"
+)
+
+type blockKind int
+
+const (
+	rawBlock blockKind = iota
+	varBlock
+	functionBlock
+	sectionBlock
+	stepBeginBlock
+	stepEndBlock
+)
+
+// StepsDir keeps a marker file per completed step, so a re-run of the script resumes after the last completed step
+const StepsDir = "/opt/weka/tmp/steps"
+
+type block struct {
+	kind     blockKind
+	name     string
+	comment  string
+	body     string
+	requires []string
+	provides []string
+}
+
+// Builder composes a bash script from variables, function definitions and sections.
+// Every block may declare names (functions or variables) it requires and provides.
+// Requirements of sections and variables must be provided by an earlier block, as they run top to bottom,
+// while requirements of functions may be provided anywhere in the script, as they are resolved when called.
+type Builder struct {
+	blocks []block
+	err    error
+}
+
+func New() *Builder {
+	return &Builder{}
+}
+
+func (b *Builder) add(blk block) *Builder {
+	b.blocks = append(b.blocks, blk)
+	return b
+}
+
+func (b *Builder) last() *block {
+	return &b.blocks[len(b.blocks)-1]
+}
+
+// Shebang adds the bash shebang line
+func (b *Builder) Shebang() *Builder {
+	return b.add(block{kind: rawBlock, body: "#!/bin/bash\n"})
+}
+
+// Raw adds text as is
+func (b *Builder) Raw(text string) *Builder {
+	return b.add(block{kind: rawBlock, body: text})
+}
+
+// Var declares a variable, the value is quoted according to its type:
+// strings are shell quoted, string slices become bash arrays of quoted items, bools and ints are written as is.
+// Values which can't be represented in the script fail Build.
+func (b *Builder) Var(name string, value interface{}) *Builder {
+	quoted, err := literal(value)
+	if err != nil && b.err == nil {
+		b.err = fmt.Errorf("variable %s: %w", name, err)
+	}
+	return b.add(block{kind: varBlock, name: name, body: fmt.Sprintf("%s=%s\n", name, quoted), provides: []string{name}})
+}
+
+// Expr declares a variable set by an unquoted bash expression, e.g. "$(hostname -I)"
+func (b *Builder) Expr(name, expr string) *Builder {
+	return b.add(block{kind: varBlock, name: name, body: fmt.Sprintf("%s=%s\n", name, expr), provides: []string{name}})
+}
+
+// Function adds a function definition block, named after the function it defines
+func (b *Builder) Function(name, definition string) *Builder {
+	return b.add(block{
+		kind:     functionBlock,
+		name:     name,
+		comment:  fmt.Sprintf("%s function definition", name),
+		body:     dedent.Dedent(definition),
+		provides: []string{name},
+	})
+}
+
+// CloudFunctions adds the definitions of the cloud functions which the script calls
+func (b *Builder) CloudFunctions(def functions_def.FunctionDef, names ...functions_def.FunctionName) *Builder {
+	for _, name := range names {
+		b.Function(string(name), def.GetFunctionCmdDefinition(name))
+	}
+	return b
+}
+
+// Section adds a block of commands, the comment is omitted if empty
+func (b *Builder) Section(comment, body string) *Builder {
+	return b.add(block{kind: sectionBlock, comment: comment, body: dedent.Dedent(body)})
+}
+
+// Step begins a resumable step, which ends at EndStep. The blocks of a step are skipped if the step completed in a
+// previous run of the script, or if postcondition (a bash command, may be empty) succeeds. Steps are numbered
+// in order and their progress is reported, so they require the report and json_object functions.
+// Variables needed after the step should be set outside of it, as a completed step is skipped.
+func (b *Builder) Step(name, postcondition string) *Builder {
+	return b.add(block{kind: stepBeginBlock, name: name, body: postcondition, requires: []string{"report", "json_object"}})
+}
+
+// EndStep ends the current step, marking it completed
+func (b *Builder) EndStep() *Builder {
+	return b.add(block{kind: stepEndBlock})
+}
+
+// Requires declares names the last added block depends on
+func (b *Builder) Requires(names ...string) *Builder {
+	b.last().requires = append(b.last().requires, names...)
+	return b
+}
+
+// Provides declares names (usually variables) the last added block sets
+func (b *Builder) Provides(names ...string) *Builder {
+	b.last().provides = append(b.last().provides, names...)
+	return b
+}
+
+// Append adds all the blocks of other to b
+func (b *Builder) Append(other *Builder) *Builder {
+	b.blocks = append(b.blocks, other.blocks...)
+	if b.err == nil {
+		b.err = other.err
+	}
+	return b
+}
+
+// Fail records an error found while generating the script, Build returns the first recorded error
+func (b *Builder) Fail(err error) *Builder {
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+func (b *Builder) check() error {
+	provided := make(map[string]bool)
+	for _, blk := range b.blocks {
+		for _, name := range blk.provides {
+			provided[name] = true
+		}
+	}
+
+	var errs []string
+	inStep := ""
+	for _, blk := range b.blocks {
+		switch blk.kind {
+		case stepBeginBlock:
+			if inStep != "" {
+				errs = append(errs, fmt.Sprintf("step %q begins inside step %q", blk.name, inStep))
+			}
+			inStep = blk.name
+		case stepEndBlock:
+			if inStep == "" {
+				errs = append(errs, "step end without a step")
+			}
+			inStep = ""
+		}
+	}
+	if inStep != "" {
+		errs = append(errs, fmt.Sprintf("step %q does not end", inStep))
+	}
+
+	providedSoFar := make(map[string]bool)
+	for _, blk := range b.blocks {
+		for _, name := range blk.requires {
+			if blk.kind == functionBlock {
+				if !provided[name] {
+					errs = append(errs, fmt.Sprintf("function %s requires %s which is not defined", blk.name, name))
+				}
+				continue
+			}
+			if !providedSoFar[name] {
+				errs = append(errs, fmt.Sprintf("%s requires %s which is not defined before it", blk.description(), name))
+			}
+		}
+		for _, name := range blk.provides {
+			providedSoFar[name] = true
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("script dependencies check failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (blk block) description() string {
+	switch blk.kind {
+	case varBlock:
+		return fmt.Sprintf("variable %s", blk.name)
+	case sectionBlock:
+		if blk.comment != "" {
+			return fmt.Sprintf("section %q", blk.comment)
+		}
+	}
+	return "block"
+}
+
+// Build checks the declared dependencies and renders the script
+func (b *Builder) Build() (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	if err := b.check(); err != nil {
+		return "", err
+	}
+
+	steps := 0
+	for _, blk := range b.blocks {
+		if blk.kind == stepBeginBlock {
+			steps++
+		}
+	}
+
+	var sb strings.Builder
+	prevKind := rawBlock
+	step, stepName := 0, ""
+	for i, blk := range b.blocks {
+		// functions, sections and steps are separated by an empty line, consecutive variables are rendered together
+		separated := blk.kind == functionBlock || blk.kind == sectionBlock || blk.kind == stepBeginBlock || blk.kind == stepEndBlock ||
+			(blk.kind == varBlock && (prevKind == functionBlock || prevKind == sectionBlock))
+		if i > 0 && separated {
+			sb.WriteString("\n")
+		}
+		switch blk.kind {
+		case stepBeginBlock:
+			step++
+			stepName = blk.name
+			sb.WriteString(renderStepBegin(step, steps, blk.name, blk.body))
+			prevKind = blk.kind
+			continue
+		case stepEndBlock:
+			sb.WriteString(renderStepEnd(step, stepName))
+			prevKind = blk.kind
+			continue
+		}
+		if blk.comment != "" {
+			sb.WriteString("# " + blk.comment + "\n")
+		}
+		body := strings.TrimPrefix(blk.body, "\n")
+		sb.WriteString(body)
+		if body != "" && !strings.HasSuffix(body, "\n") {
+			sb.WriteString("\n")
+		}
+		prevKind = blk.kind
+	}
+	return sb.String(), nil
+}
+
+func stepMarker(step int, name string) string {
+	slug := strings.Trim(nonWordChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	return fmt.Sprintf("%s/%02d-%s", StepsDir, step, slug)
+}
+
+func renderStepBegin(step, steps int, name, postcondition string) string {
+	condition := fmt.Sprintf("[ -f %s ]", stepMarker(step, name))
+	if postcondition != "" {
+		condition += fmt.Sprintf(" || { %s; }", postcondition)
+	}
+	title := fmt.Sprintf("step %d/%d: %s", step, steps, name)
+	return fmt.Sprintf(`# %s
+if %s; then
+	echo "$(date -u):" %s
+else
+report "$(json_object hostname "$HOSTNAME" protocol "${PROTOCOL:-}" type "progress" phase %s step "%d" steps "%d" message %s)"
+`, title, condition, Quote(title+" is already done"), Quote(name), step, steps, Quote("Running "+title))
+}
+
+func renderStepEnd(step int, name string) string {
+	return fmt.Sprintf("fi\nmkdir -p %s\necho \"$(date -u)\" > %s\n", StepsDir, stepMarker(step, name))
+}
+
+var nonWordChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+var safeWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// CheckValue returns an error if s can't be passed through a script: bash strings can't hold NUL bytes
+// and json payloads built from them must be valid UTF-8
+func CheckValue(s string) error {
+	if strings.ContainsRune(s, 0) {
+		return fmt.Errorf("value %q contains a NUL character", s)
+	}
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("value %q is not valid UTF-8", s)
+	}
+	return nil
+}
+
+// Quote returns s as a single bash word that expands to s literally
+func Quote(s string) string {
+	if safeWord.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func literal(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case bool, int, int64, uint, uint64:
+		return fmt.Sprintf("%v", v), nil
+	case []string:
+		quoted := make([]string, 0, len(v))
+		for _, item := range v {
+			if err := CheckValue(item); err != nil {
+				return "", err
+			}
+			quoted = append(quoted, Quote(item))
+		}
+		return "(" + strings.Join(quoted, " ") + ")", nil
+	case []int:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, strconv.Itoa(item))
+		}
+		return "(" + strings.Join(items, " ") + ")", nil
+	}
+
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case fmt.Stringer:
+		str = v.String()
+	default:
+		str = fmt.Sprintf("%v", v)
+	}
+	if err := CheckValue(str); err != nil {
+		return "", err
+	}
+	return Quote(str), nil
+}
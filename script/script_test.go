@@ -0,0 +1,166 @@
+package script
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := map[string]string{
+		"abc":           "abc",
+		"10.0.0.1:8080": "10.0.0.1:8080",
+		"":              "''",
+		"a b":           "'a b'",
+		"$(reboot)":     "'$(reboot)'",
+		"it's":          `'it'"'"'s'`,
+	}
+	for input, expected := range tests {
+		if got := Quote(input); got != expected {
+			t.Errorf("Quote(%q) = %s, expected %s", input, got, expected)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	s, err := New().Shebang().
+		Var("NAMES", []string{"a", "b c"}).
+		Var("COUNT", 2).
+		Var("PORTS", []int{14000, 15000}).
+		Function("greet", `
+		function greet {
+			echo "hello $1"
+		}
+		`).
+		Section("greet everyone", `
+		for name in "${NAMES[@]}"; do
+			greet "$name"
+		done
+		`).Requires("greet", "NAMES").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `#!/bin/bash
+NAMES=(a 'b c')
+COUNT=2
+PORTS=(14000 15000)
+
+# greet function definition
+function greet {
+	echo "hello $1"
+}
+
+# greet everyone
+for name in "${NAMES[@]}"; do
+	greet "$name"
+done
+`
+	if s != expected {
+		t.Errorf("unexpected script:\n%s\nexpected:\n%s", s, expected)
+	}
+}
+
+func TestBuildMissingDependency(t *testing.T) {
+	_, err := New().
+		Section("uses a variable before it is set", `echo "$NAME"`).Requires("NAME").
+		Var("NAME", "x").
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "requires NAME") {
+		t.Errorf("expected missing dependency error, got %v", err)
+	}
+
+	// functions may call functions defined later
+	_, err = New().
+		Function("a", "function a { b; }").Requires("b").
+		Function("b", "function b { true; }").
+		Build()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBuildUnrepresentableValue(t *testing.T) {
+	for _, value := range []interface{}{"a\x00b", []string{"ok", "\xff"}} {
+		if _, err := New().Var("NAME", value).Build(); err == nil {
+			t.Errorf("expected error for value %q", value)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]string{
+		"syntax error":            "if true; then\necho x\n",
+		"undefined function":      "report \"$(json_object type progress)\"\nfunction json_object { echo; }\n",
+		"variable used too early": "echo $NAME\nNAME=x\n",
+		"empty function":          "function f() {\n}\nf\n",
+		"variable never set":      "function f {\n\techo $MISSING\n}\n",
+		"set by an uncalled body": "function f {\n\tNAME=x\n}\necho $NAME\n",
+		"local of a called body":  "function f {\n\tlocal NAME=x\n}\nf\necho $NAME\n",
+	}
+	for name, src := range tests {
+		if err := Validate(src); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	valid := `
+	function get_ids {
+		eval "$2=1,2"
+	}
+	get_ids 2 ids
+	function set_name {
+		local name=x
+		NAME="$name"
+	}
+	function call_set_name {
+		set_name
+	}
+	call_set_name
+	echo "$NAME"
+	for i in a b; do
+		echo "$i $ids ${UNSET:-default} $HOSTNAME $1"
+	done
+	((count++))
+	read -r line <<< "x"
+	echo "$count $line"
+	`
+	if err := Validate(valid); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBuildSteps(t *testing.T) {
+	s, err := New().
+		Function("report", "function report { echo \"$@\"; }").
+		Function("json_object", "function json_object { echo \"$@\"; }").
+		Step("Install Weka", "weka version current").
+		Section("", "./install.sh").
+		EndStep().
+		Step("setup", "").
+		Section("", "weka local setup container").
+		EndStep().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"if [ -f " + StepsDir + "/01-install-weka ] || { weka version current; }; then",
+		"if [ -f " + StepsDir + "/02-setup ]; then",
+		`step "1" steps "2" message 'Running step 1/2: Install Weka'`,
+		"echo \"$(date -u)\" > " + StepsDir + "/02-setup\n",
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("expected script to contain %q:\n%s", expected, s)
+		}
+	}
+	if err = Validate(s); err != nil {
+		t.Error(err)
+	}
+
+	for _, b := range []*Builder{New().Step("a", "").Step("b", ""), New().EndStep()} {
+		if _, err = b.Build(); err == nil {
+			t.Error("expected unbalanced steps error")
+		}
+	}
+}
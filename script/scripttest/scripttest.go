@@ -0,0 +1,41 @@
+// Package scripttest has the helpers of the generated scripts tests: a FunctionDef of stub cloud functions and
+// golden files, updated by running the tests with -update
+package scripttest
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/weka/go-cloud-lib/functions_def"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// FunctionDef defines every cloud function as a function echoing its name and arguments
+type FunctionDef struct{}
+
+func (FunctionDef) GetFunctionCmdDefinition(name functions_def.FunctionName) string {
+	return fmt.Sprintf("\nfunction %s {\n\techo %s \"$@\"\n}\n", name, name)
+}
+
+// CheckGolden compares actual to testdata/<name>.golden of the tested package, or writes it with -update
+func CheckGolden(t *testing.T, name, actual string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expected) != actual {
+		t.Errorf("%s differs from %s, run the tests with -update if the change is intended", name, path)
+	}
+}
@@ -0,0 +1,257 @@
+package script
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/weka/go-cloud-lib/functions_def"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// helperFunctions are the bash_functions and cloud functions the generated scripts call,
+// a call to one of them which is not defined in the script is reported by Validate
+var helperFunctions = []string{
+	"get_core_ids", "getNetStrForDpdk", "getAllInterfaces", "weka_rest", "set_backend_ip", "prefix_to_netmask",
+	"json_object", "json_escape", "retry",
+	string(functions_def.Clusterize), string(functions_def.ClusterizeFinalization), string(functions_def.Deploy),
+	string(functions_def.Protect), string(functions_def.Report), string(functions_def.Join),
+	string(functions_def.JoinFinalization), string(functions_def.JoinNfsFinalization), string(functions_def.SetupNFS),
+	string(functions_def.Fetch), string(functions_def.Status),
+}
+
+// environmentVariables are set by bash or the machine, not by the script
+var environmentVariables = []string{
+	"HOSTNAME", "HOME", "PATH", "PWD", "USER", "UID", "EUID", "IFS", "RANDOM", "SECONDS", "LINENO", "OSTYPE",
+	"BASH_SOURCE", "BASH_VERSION", "FUNCNAME", "PIPESTATUS", "OPTARG", "OPTIND", "REPLY",
+}
+
+type validator struct {
+	functions  map[string]bool
+	bodies     map[string]functionBody
+	assigned   map[string]bool
+	setSoFar   map[string]bool
+	local      map[string]bool
+	inFunction bool
+	errs       []string
+}
+
+// functionBody is what a function sets, and the script functions it calls, which may set more
+type functionBody struct {
+	sets  []string
+	calls []string
+}
+
+// Validate parses a generated bash script and reports syntax errors, calls to helper functions
+// which are not defined in the script and variables which are used before they are set
+func Validate(src string) error {
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(src), "")
+	if err != nil {
+		return fmt.Errorf("validation failed: %v", err)
+	}
+
+	v := &validator{
+		functions: make(map[string]bool),
+		bodies:    make(map[string]functionBody),
+		assigned:  make(map[string]bool),
+		setSoFar:  make(map[string]bool),
+	}
+	for _, name := range environmentVariables {
+		v.assigned[name] = true
+		v.setSoFar[name] = true
+	}
+	v.collect(file)
+
+	for _, stmt := range file.Stmts {
+		v.check(stmt)
+	}
+
+	if len(v.errs) > 0 {
+		return fmt.Errorf("validation failed: %s", strings.Join(v.errs, "; "))
+	}
+	return nil
+}
+
+// collect records the defined functions, what they set and every variable the script may set anywhere
+func (v *validator) collect(file *syntax.File) {
+	syntax.Walk(file, func(node syntax.Node) bool {
+		if decl, ok := node.(*syntax.FuncDecl); ok {
+			v.functions[decl.Name.Value] = true
+		}
+		return true
+	})
+	syntax.Walk(file, func(node syntax.Node) bool {
+		for _, name := range assignedNames(node, v.functions) {
+			v.assigned[name] = true
+		}
+		if decl, ok := node.(*syntax.FuncDecl); ok {
+			v.bodies[decl.Name.Value] = v.collectBody(decl)
+		}
+		return true
+	})
+}
+
+func (v *validator) collectBody(decl *syntax.FuncDecl) (body functionBody) {
+	local := make(map[string]bool)
+	syntax.Walk(decl.Body, func(node syntax.Node) bool {
+		if clause, ok := node.(*syntax.DeclClause); ok && clause.Variant.Value == "local" {
+			for _, assign := range clause.Args {
+				if assign.Name != nil {
+					local[assign.Name.Value] = true
+				}
+			}
+		}
+		if call, ok := node.(*syntax.CallExpr); ok && len(call.Args) > 0 && v.functions[call.Args[0].Lit()] {
+			body.calls = append(body.calls, call.Args[0].Lit())
+		}
+		return true
+	})
+	syntax.Walk(decl.Body, func(node syntax.Node) bool {
+		for _, name := range assignedNames(node, v.functions) {
+			if !local[name] {
+				body.sets = append(body.sets, name)
+			}
+		}
+		return true
+	})
+	return
+}
+
+// called marks what the function sets when it's called, following the functions it calls
+func (v *validator) called(function string, visited map[string]bool) {
+	if visited[function] {
+		return
+	}
+	visited[function] = true
+	for _, name := range v.bodies[function].sets {
+		v.setSoFar[name] = true
+	}
+	for _, callee := range v.bodies[function].calls {
+		v.called(callee, visited)
+	}
+}
+
+// check walks a top level statement in order: outside functions variables must be set by an earlier statement,
+// inside functions they must be set somewhere in the script, as functions run when they are called
+func (v *validator) check(stmt *syntax.Stmt) {
+	syntax.Walk(stmt, func(node syntax.Node) bool {
+		switch n := node.(type) {
+		case *syntax.FuncDecl:
+			// accepted by the parser, but a syntax error for bash
+			if block, ok := n.Body.Cmd.(*syntax.Block); ok && len(block.Stmts) == 0 {
+				v.addError(n.Pos(), "function %s has an empty body", n.Name.Value)
+			}
+			// the body runs when the function is called, what it sets is not set after the definition
+			setSoFar := make(map[string]bool, len(v.setSoFar))
+			for name := range v.setSoFar {
+				setSoFar[name] = true
+			}
+			inner := &validator{
+				functions: v.functions, bodies: v.bodies, assigned: v.assigned, setSoFar: setSoFar, local: make(map[string]bool), inFunction: true,
+			}
+			syntax.Walk(n.Body, inner.visit)
+			v.errs = append(v.errs, inner.errs...)
+			return false
+		}
+		return v.visit(node)
+	})
+}
+
+func (v *validator) visit(node syntax.Node) bool {
+	switch n := node.(type) {
+	case *syntax.CallExpr:
+		if len(n.Args) > 0 {
+			name := n.Args[0].Lit()
+			if isHelperFunction(name) && !v.functions[name] {
+				v.addError(n.Pos(), "function %s is called but not defined", name)
+			}
+			if v.functions[name] {
+				v.called(name, make(map[string]bool))
+			}
+		}
+	case *syntax.DeclClause:
+		if v.inFunction && n.Variant.Value == "local" {
+			for _, assign := range n.Args {
+				if assign.Name != nil {
+					v.local[assign.Name.Value] = true
+				}
+			}
+		}
+	case *syntax.ParamExp:
+		v.checkReference(n)
+	}
+	for _, name := range assignedNames(node, v.functions) {
+		v.setSoFar[name] = true
+	}
+	return true
+}
+
+func (v *validator) checkReference(exp *syntax.ParamExp) {
+	if exp.Param == nil || !syntax.ValidName(exp.Param.Value) || exp.Excl || exp.Names != 0 {
+		return
+	}
+	// ${name:-default} and friends are meant for variables which may be unset
+	if exp.Exp != nil && exp.Exp.Op <= syntax.AssignUnsetOrNull {
+		return
+	}
+	name := exp.Param.Value
+	if v.inFunction {
+		if !v.assigned[name] && !v.local[name] {
+			v.addError(exp.Pos(), "variable %s is used but never set", name)
+		}
+		return
+	}
+	if !v.setSoFar[name] {
+		v.addError(exp.Pos(), "variable %s is used before it is set", name)
+	}
+}
+
+func (v *validator) addError(pos syntax.Pos, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Sprintf("line %d: %s", pos.Line(), fmt.Sprintf(format, args...)))
+}
+
+func isHelperFunction(name string) bool {
+	for _, helper := range helperFunctions {
+		if name == helper {
+			return true
+		}
+	}
+	return false
+}
+
+// assignedNames returns the variables the node sets: assignments, declarations, loop variables,
+// arithmetic assignments, 'read' targets and names passed to script functions, which may set them (e.g. get_core_ids)
+func assignedNames(node syntax.Node, functions map[string]bool) (names []string) {
+	switch n := node.(type) {
+	case *syntax.Assign:
+		if n.Name != nil {
+			names = append(names, n.Name.Value)
+		}
+	case *syntax.WordIter:
+		names = append(names, n.Name.Value)
+	case *syntax.BinaryArithm:
+		if n.Op >= syntax.Assgn && n.Op <= syntax.ShrAssgn {
+			if word, ok := n.X.(*syntax.Word); ok {
+				names = append(names, word.Lit())
+			}
+		}
+	case *syntax.UnaryArithm:
+		if n.Op == syntax.Inc || n.Op == syntax.Dec {
+			if word, ok := n.X.(*syntax.Word); ok {
+				names = append(names, word.Lit())
+			}
+		}
+	case *syntax.CallExpr:
+		if len(n.Args) == 0 {
+			return
+		}
+		command := n.Args[0].Lit()
+		if command == "read" || command == "mapfile" || command == "readarray" || functions[command] {
+			for _, arg := range n.Args[1:] {
+				if name := arg.Lit(); syntax.ValidName(name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	return
+}
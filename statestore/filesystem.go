@@ -0,0 +1,135 @@
+package statestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleLockAge is the age of a lock file left by a crashed writer, after which it's broken
+const staleLockAge = 30 * time.Second
+
+// FileStore is a Store of a file per key in a local directory, safe for concurrent processes on the same host.
+// The version of a state is the sha256 of its content.
+type FileStore struct {
+	Dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (f *FileStore) path(key string) (string, error) {
+	if !filepath.IsLocal(key) {
+		return "", fmt.Errorf("invalid state key %q", key)
+	}
+	return filepath.Join(f.Dir, key), nil
+}
+
+func version(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *FileStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", ErrNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+	return data, version(data), nil
+}
+
+func (f *FileStore) CompareAndSwap(ctx context.Context, key string, data []byte, expectedVersion string) (string, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	unlock, err := lock(ctx, path+".lock")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	current, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if expectedVersion != "" {
+			return "", ErrVersionMismatch
+		}
+	} else if err != nil {
+		return "", err
+	} else if version(current) != expectedVersion {
+		return "", ErrVersionMismatch
+	}
+
+	// readers see either the previous or the new state, never a partial one
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return version(data), nil
+}
+
+// lock creates the lock file exclusively, waiting for its holder to remove it
+func lock(ctx context.Context, path string) (unlock func(), err error) {
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > staleLockAge {
+			breakStaleLock(path, info)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// breakStaleLock removes the stale lock file, unless another writer broke it and took the lock meanwhile: the lock is
+// renamed to a unique name first, so only the inspected file is removed and a newer one is put back
+func breakStaleLock(path string, stale os.FileInfo) {
+	breaking := fmt.Sprintf("%s.%d.%d.stale", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, breaking); err != nil {
+		return
+	}
+	defer os.Remove(breaking)
+	if info, err := os.Stat(breaking); err == nil && !os.SameFile(info, stale) {
+		// the newer lock is put back, unless yet another writer took the lock after the rename
+		os.Link(breaking, path)
+	}
+}
@@ -0,0 +1,44 @@
+package statestore
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+type memoryState struct {
+	data    []byte
+	version int
+}
+
+// MemoryStore is a Store in memory, for tests and single process use
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]memoryState
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[string]memoryState)}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[key]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return append([]byte(nil), state.data...), strconv.Itoa(state.version), nil
+}
+
+func (m *MemoryStore) CompareAndSwap(ctx context.Context, key string, data []byte, version string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[key]
+	if (ok && strconv.Itoa(state.version) != version) || (!ok && version != "") {
+		return "", ErrVersionMismatch
+	}
+	state = memoryState{data: append([]byte(nil), data...), version: state.version + 1}
+	m.states[key] = state
+	return strconv.Itoa(state.version), nil
+}
@@ -0,0 +1,89 @@
+package statestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/report"
+)
+
+var (
+	ErrNotFound        = errors.New("state not found")
+	ErrVersionMismatch = errors.New("state version mismatch")
+)
+
+// MaxUpdateAttempts is the number of read-modify-write attempts of Update before it gives up on conflicts
+const MaxUpdateAttempts = 10
+
+// Store keeps versioned states, e.g. ClusterState and InstanceRefreshState, safe to update from concurrent invocations.
+// A version is opaque, like an object storage ETag, and changes whenever the state does.
+type Store interface {
+	// Get returns the state of key and its version, or ErrNotFound
+	Get(ctx context.Context, key string) (data []byte, version string, err error)
+	// CompareAndSwap writes the state of key if its version is still version, an empty version creates the key only if
+	// it doesn't exist. It returns the new version, or ErrVersionMismatch.
+	CompareAndSwap(ctx context.Context, key string, data []byte, version string) (newVersion string, err error)
+}
+
+// Update reads the state of key, calls update and writes the state back. If another writer changed it in the
+// meantime, it retries with the new state, update must therefore have no side effects. A missing state is updated
+// from its zero value.
+func Update[T any](ctx context.Context, store Store, key string, update func(state *T) error) (state T, err error) {
+	for attempt := 1; attempt <= MaxUpdateAttempts; attempt++ {
+		var data []byte
+		var version string
+		state = *new(T)
+		data, version, err = store.Get(ctx, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return
+		}
+		if err == nil {
+			if err = json.Unmarshal(data, &state); err != nil {
+				err = fmt.Errorf("failed to unmarshal state %s: %w", key, err)
+				return
+			}
+		}
+		if err = update(&state); err != nil {
+			return
+		}
+		if data, err = json.Marshal(state); err != nil {
+			return
+		}
+		if _, err = store.CompareAndSwap(ctx, key, data, version); !errors.Is(err, ErrVersionMismatch) {
+			return
+		}
+		if attempt == MaxUpdateAttempts {
+			break
+		}
+
+		// back off with jitter, so concurrent writers don't conflict again
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(time.Duration(attempt*(10+rand.Intn(40))) * time.Millisecond):
+		}
+	}
+	err = fmt.Errorf("failed to update state %s after %d attempts: %w", key, MaxUpdateAttempts, err)
+	return
+}
+
+// UpdateReport adds the report to the ClusterState of key, see report.UpdateReport
+func UpdateReport(ctx context.Context, store Store, key string, clusterReport protocol.Report) (protocol.ClusterState, error) {
+	return Update(ctx, store, key, func(state *protocol.ClusterState) error {
+		return report.UpdateReport(clusterReport, state)
+	})
+}
+
+// AddClusterUpdate adds the update to the ClusterState of key, see report.AddClusterUpdate
+func AddClusterUpdate(ctx context.Context, store Store, key string, update protocol.Update) (protocol.ClusterState, error) {
+	return Update(ctx, store, key, func(state *protocol.ClusterState) error {
+		report.AddClusterUpdate(update, state)
+		return nil
+	})
+}
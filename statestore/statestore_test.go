@@ -0,0 +1,130 @@
+package statestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestStores(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "filesystem": fileStore} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, _, err := store.Get(ctx, "state"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected not found, got %v", err)
+			}
+			version, err := store.CompareAndSwap(ctx, "state", []byte(`{}`), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.CompareAndSwap(ctx, "state", []byte(`{"a": 1}`), ""); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("expected creating an existing state to fail, got %v", err)
+			}
+			if _, err = store.CompareAndSwap(ctx, "state", []byte(`{"a": 1}`), version); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.CompareAndSwap(ctx, "state", []byte(`{"a": 2}`), version); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("expected a stale version to fail, got %v", err)
+			}
+
+			// concurrent reports from many VMs are all kept
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					report := protocol.Report{Type: "progress", Hostname: fmt.Sprintf("weka-%d", i), Message: "Weka containers are ready"}
+					_, err := UpdateReport(ctx, store, "cluster_state", report)
+					errs <- err
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			state, err := Update(ctx, store, "cluster_state", func(state *protocol.ClusterState) error { return nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state.Progress) != 8 || len(state.Events) != 8 {
+				t.Errorf("expected the reports of 8 hosts, got %v", state.Progress)
+			}
+		})
+	}
+}
+
+func TestFileStoreStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockPath := filepath.Join(dir, "state.lock")
+	if err = os.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a lock held by a live writer is waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = store.CompareAndSwap(ctx, "state", []byte(`{}`), ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait for the lock, got %v", err)
+	}
+
+	// a lock left by a crashed writer is broken
+	old := time.Now().Add(-2 * staleLockAge)
+	if err = os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.CompareAndSwap(context.Background(), "state", []byte(`{}`), ""); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "state" {
+		t.Errorf("expected only the state file left, got %v", entries)
+	}
+}
+
+// conflictingStore always fails the CompareAndSwap, cancelling ctx on the last attempt
+type conflictingStore struct {
+	*MemoryStore
+	attempts int
+	cancel   context.CancelFunc
+}
+
+func (c *conflictingStore) CompareAndSwap(ctx context.Context, key string, data []byte, expectedVersion string) (string, error) {
+	c.attempts++
+	if c.attempts == MaxUpdateAttempts {
+		c.cancel()
+	}
+	return "", ErrVersionMismatch
+}
+
+func TestUpdateAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &conflictingStore{MemoryStore: NewMemoryStore(), cancel: cancel}
+	_, err := Update(ctx, store, "state", func(state *protocol.ClusterState) error { return nil })
+	// no back off after the last attempt, which would have returned the cancelled ctx error
+	if !errors.Is(err, ErrVersionMismatch) || store.attempts != MaxUpdateAttempts {
+		t.Errorf("expected a version mismatch after %d attempts, got %v after %d", MaxUpdateAttempts, err, store.attempts)
+	}
+}